@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/blacklee123/go-ios-android/pkg/api"
 	"github.com/blacklee123/go-ios-android/pkg/version"
@@ -30,13 +31,36 @@ to quickly create a Cobra application.`,
 		host, _ := cmd.Flags().GetString("host")
 		port, _ := cmd.Flags().GetInt("port")
 		tmpdir, _ := cmd.Flags().GetString("tmpdir")
+		imagedir, _ := cmd.Flags().GetString("image-dir")
 		level, _ := cmd.Flags().GetString("level")
+		shutdownTimeout, _ := cmd.Flags().GetDuration("shutdown-timeout")
+		enableIOS, _ := cmd.Flags().GetBool("ios")
+		enableAndroid, _ := cmd.Flags().GetBool("android")
+		ffmpeg, _ := cmd.Flags().GetString("ffmpeg")
+		scrcpyServer, _ := cmd.Flags().GetString("scrcpy-server")
+		scrcpyVersion, _ := cmd.Flags().GetString("scrcpy-version")
+		pocoConnectTimeout, _ := cmd.Flags().GetDuration("poco-connect-timeout")
+		pocoReadTimeout, _ := cmd.Flags().GetDuration("poco-read-timeout")
+		pocoIdleTimeout, _ := cmd.Flags().GetDuration("poco-idle-timeout")
+		macroDir, _ := cmd.Flags().GetString("macro-dir")
+		allowedOrigins, _ := cmd.Flags().GetStringSlice("allowed-origins")
 
 		// 配置 Viper
 		viper.Set("host", host)
 		viper.Set("port", port)
 		viper.Set("tmpdir", tmpdir)
+		viper.Set("imagedir", imagedir)
 		viper.Set("level", level)
+		viper.Set("ios", enableIOS)
+		viper.Set("android", enableAndroid)
+		viper.Set("ffmpeg", ffmpeg)
+		viper.Set("scrcpyserver", scrcpyServer)
+		viper.Set("scrcpyversion", scrcpyVersion)
+		viper.Set("pococonnecttimeout", pocoConnectTimeout)
+		viper.Set("pocoreadtimeout", pocoReadTimeout)
+		viper.Set("pocoidletimeout", pocoIdleTimeout)
+		viper.Set("macrodir", macroDir)
+		viper.Set("allowedorigins", allowedOrigins)
 		hostname, _ := os.Hostname()
 		viper.Set("hostname", hostname)
 		viper.Set("version", version.VERSION)
@@ -57,19 +81,31 @@ to quickly create a Cobra application.`,
 
 		// 创建并启动服务器
 		srv, _ := api.NewServer(&srvCfg, logger)
-		httpServer := srv.ListenAndServe()
+		srv.ListenAndServe()
 
 		// 设置信号捕获
-		ctx := context.Background()
-		sc := make(chan os.Signal, 1)
+		sc := make(chan os.Signal, 2)
 		signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 		<-sc
 		logger.Info("shutting down server",
 			zap.String("version", version.VERSION),
-			zap.String("revision", version.REVISION))
+			zap.String("revision", version.REVISION),
+			zap.Duration("timeout", shutdownTimeout))
+
+		// 再次收到信号时强制退出
+		go func() {
+			<-sc
+			logger.Warn("received second signal, forcing exit")
+			logger.Sync()
+			os.Exit(1)
+		}()
 
 		// 关闭服务器
-		httpServer.Shutdown(ctx)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Error("server shutdown failed", zap.Error(err))
+		}
 	},
 }
 
@@ -79,7 +115,19 @@ func init() {
 	serverCmd.Flags().String("host", "0.0.0.0", "Host to bind service to")
 	serverCmd.Flags().Int("port", 15037, "HTTP port to bind service to")
 	serverCmd.Flags().String("tmpdir", ".", "Temporary directory to use")
+	serverCmd.Flags().String("image-dir", "devimages", "Directory with developer disk images")
 	serverCmd.Flags().String("level", "info", "Log level (debug, info, warn, error)")
+	serverCmd.Flags().Bool("ios", true, "Enable iOS devices")
+	serverCmd.Flags().Bool("android", true, "Enable Android devices")
+	serverCmd.Flags().String("ffmpeg", "", "Path to ffmpeg, enables MP4 export of screen recordings")
+	serverCmd.Flags().String("scrcpy-server", "", "Path to scrcpy-server.jar, enables H.264 mirroring of Android devices")
+	serverCmd.Flags().String("scrcpy-version", "2.4", "Version of the scrcpy-server.jar")
+	serverCmd.Flags().Duration("poco-connect-timeout", 10*time.Second, "Time to keep trying to connect to a Poco SDK")
+	serverCmd.Flags().Duration("poco-read-timeout", 30*time.Second, "Time to wait for a Poco SDK to answer a call")
+	serverCmd.Flags().Duration("poco-idle-timeout", 5*time.Minute, "Time after which unused Poco connections are closed")
+	serverCmd.Flags().String("macro-dir", "", "Directory to save macros in, defaults to macros in the tmpdir")
+	serverCmd.Flags().StringSlice("allowed-origins", nil, "Origins besides the server itself allowed to open stream WebSockets, e.g. the dev server http://127.0.0.1:3000")
+	serverCmd.Flags().Duration("shutdown-timeout", 30*time.Second, "Time to wait for WDA sessions, streams and forwards to close on shutdown")
 }
 
 func initZap(logLevel string) (*zap.Logger, error) {
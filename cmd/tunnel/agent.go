@@ -0,0 +1,46 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/spf13/cobra"
+)
+
+var agentClient = &http.Client{
+	Timeout: 5 * time.Second,
+}
+
+// addTunnelInfoPortFlag adds the flag selecting the tunnel info server, it must
+// match the --tunnel-info-port given to `tunnel start`.
+func addTunnelInfoPortFlag(cmd *cobra.Command) {
+	cmd.Flags().Int("tunnel-info-port", ios.HttpApiPort(), "Port of the tunnel info server")
+}
+
+func agentURL(port int, path string) string {
+	return fmt.Sprintf("http://%s:%d%s", ios.HttpApiHost(), port, path)
+}
+
+// agentRequest sends a request to the tunnel info server and fails on any
+// status other than 200.
+func agentRequest(method string, port int, path string) error {
+	req, err := http.NewRequest(method, agentURL(port, path), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := agentClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func isAgentRunning(port int) bool {
+	return agentRequest(http.MethodGet, port, "/health") == nil
+}
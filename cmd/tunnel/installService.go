@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/cobra"
+)
+
+const serviceName = "go-ios-android-tunnel"
+
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=go-ios-android iOS tunnel
+After=network-online.target usbmuxd.service
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart={{.ExecStart}}
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// installServiceCmd represents the install-service command
+var installServiceCmd = &cobra.Command{
+	Use:   "install-service",
+	Short: "Generates a systemd unit that keeps the tunnel running across reboots",
+	Run: func(cmd *cobra.Command, args []string) {
+		useUserspaceNetworking, _ := cmd.Flags().GetBool("userspace")
+		pairRecordsPath, _ := cmd.Flags().GetString("pair-record-path")
+		tunnelInfoPort, _ := cmd.Flags().GetInt("tunnel-info-port")
+		output, _ := cmd.Flags().GetString("output")
+
+		executable, err := os.Executable()
+		exitIfError("failed to get executable path", err)
+		// 服务的工作目录不确定，相对路径要转成绝对路径
+		if strings.ToLower(pairRecordsPath) != "default" {
+			pairRecordsPath, err = filepath.Abs(pairRecordsPath)
+			exitIfError("failed to resolve pair record path", err)
+		}
+
+		execStart := []string{
+			executable, "tunnel", "start",
+			"--pair-record-path", pairRecordsPath,
+			"--tunnel-info-port", fmt.Sprint(tunnelInfoPort),
+		}
+		if useUserspaceNetworking {
+			execStart = append(execStart, "--userspace")
+		}
+
+		var unit strings.Builder
+		err = unitTemplate.Execute(&unit, map[string]string{"ExecStart": systemdCommandLine(execStart)})
+		exitIfError("failed to render unit", err)
+
+		if output == "-" {
+			fmt.Print(unit.String())
+			return
+		}
+		err = os.WriteFile(output, []byte(unit.String()), 0644)
+		exitIfError("failed to write unit, run with sudo or use --output -", err)
+		fmt.Printf("wrote %s, enable it with:\n", output)
+		fmt.Printf("  sudo systemctl daemon-reload && sudo systemctl enable --now %s\n", serviceName)
+	},
+}
+
+// systemdCommandLine joins args for ExecStart. Arguments with whitespace,
+// quotes or backslashes are double quoted with \ and " escaped, $ and % are
+// doubled everywhere so that systemd expands neither variables nor
+// specifiers.
+func systemdCommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		arg = strings.NewReplacer("$", "$$", "%", "%%").Replace(arg)
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\") {
+			arg = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(arg) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+func initTunnelInstallService() {
+	tunnelCmd.AddCommand(installServiceCmd)
+	installServiceCmd.Flags().Bool("userspace", false, "Use userspace networking")
+	installServiceCmd.Flags().String("pair-record-path", ".", "Path to pair records")
+	addTunnelInfoPortFlag(installServiceCmd)
+	installServiceCmd.Flags().String("output", "/etc/systemd/system/"+serviceName+".service", "Where to write the unit, - for stdout")
+}
@@ -0,0 +1,29 @@
+package tunnel
+
+import "testing"
+
+func TestSystemdCommandLine(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"plain", []string{"/usr/bin/gia", "tunnel", "start"}, `/usr/bin/gia tunnel start`},
+		{"space", []string{"/opt/my tools/gia", "--pair-record-path", "/var/lib/pair records"}, `"/opt/my tools/gia" --pair-record-path "/var/lib/pair records"`},
+		{"double quote", []string{`a"b`}, `"a\"b"`},
+		{"single quote", []string{`it's`}, `"it's"`},
+		{"backslash", []string{`C:\gia`}, `"C:\\gia"`},
+		{"dollar", []string{"/home/$USER"}, `/home/$$USER`},
+		{"percent", []string{"/srv/100%"}, `/srv/100%%`},
+		{"dollar with space", []string{"$HOME dir"}, `"$$HOME dir"`},
+		{"newline", []string{"a\nb"}, `"a\nb"`},
+		{"empty", []string{"gia", ""}, `gia ""`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := systemdCommandLine(tt.args); got != tt.want {
+				t.Errorf("systemdCommandLine(%q) = %s, want %s", tt.args, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the running tunnels",
+	Run: func(cmd *cobra.Command, args []string) {
+		tunnelInfoPort, _ := cmd.Flags().GetInt("tunnel-info-port")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		tunnels, err := tunnel.ListRunningTunnels(ios.HttpApiHost(), tunnelInfoPort)
+		exitIfError("failed to list tunnels, is the tunnel running?", err)
+		if asJSON {
+			b, err := json.Marshal(tunnels)
+			exitIfError("failed to marshal tunnels", err)
+			fmt.Println(string(b))
+			return
+		}
+		printTunnels(tunnels)
+	},
+}
+
+func initTunnelList() {
+	tunnelCmd.AddCommand(listCmd)
+	addTunnelInfoPortFlag(listCmd)
+	listCmd.Flags().Bool("json", false, "Print the tunnels as JSON")
+}
+
+func printTunnels(tunnels []tunnel.Tunnel) {
+	if len(tunnels) == 0 {
+		fmt.Println("no tunnels")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "UDID\tADDRESS\tRSD PORT\tUSERSPACE\tUSERSPACE PORT")
+	for _, t := range tunnels {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%t\t%d\n", t.Udid, t.Address, t.RsdPort, t.UserspaceTUN, t.UserspaceTUNPort)
+	}
+	w.Flush()
+}
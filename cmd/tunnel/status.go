@@ -0,0 +1,35 @@
+package tunnel
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/tunnel"
+	"github.com/spf13/cobra"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows whether the tunnel is running and the tunnel of every device",
+	Run: func(cmd *cobra.Command, args []string) {
+		tunnelInfoPort, _ := cmd.Flags().GetInt("tunnel-info-port")
+
+		fmt.Printf("tunnel info server: %s\n", agentURL(tunnelInfoPort, ""))
+		if !isAgentRunning(tunnelInfoPort) {
+			fmt.Println("status: not running")
+			os.Exit(1)
+		}
+		fmt.Println("status: running")
+
+		tunnels, err := tunnel.ListRunningTunnels(ios.HttpApiHost(), tunnelInfoPort)
+		exitIfError("failed to list tunnels", err)
+		printTunnels(tunnels)
+	},
+}
+
+func initTunnelStatus() {
+	tunnelCmd.AddCommand(statusCmd)
+	addTunnelInfoPortFlag(statusCmd)
+}
@@ -0,0 +1,38 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+// stopCmd represents the stop command
+var stopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stops the tunnel service, or only the tunnel of one device with --udid",
+	Run: func(cmd *cobra.Command, args []string) {
+		tunnelInfoPort, _ := cmd.Flags().GetInt("tunnel-info-port")
+		udid, _ := cmd.Flags().GetString("udid")
+
+		if !isAgentRunning(tunnelInfoPort) {
+			fmt.Println("tunnel is not running")
+			return
+		}
+		if udid != "" {
+			err := agentRequest(http.MethodDelete, tunnelInfoPort, "/tunnel/"+udid)
+			exitIfError("failed to stop tunnel for "+udid, err)
+			fmt.Printf("stopped tunnel for %s\n", udid)
+			return
+		}
+		err := agentRequest(http.MethodGet, tunnelInfoPort, "/shutdown")
+		exitIfError("failed to stop tunnel", err)
+		fmt.Println("tunnel is shutting down")
+	},
+}
+
+func initTunnelStop() {
+	tunnelCmd.AddCommand(stopCmd)
+	addTunnelInfoPortFlag(stopCmd)
+	stopCmd.Flags().String("udid", "", "Only stop the tunnel of this device")
+}
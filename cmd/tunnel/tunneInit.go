@@ -8,4 +8,8 @@ func InitTunnel(cmd *cobra.Command) {
 	tunnelCmd = cmd
 
 	initTunnelStart()
+	initTunnelStatus()
+	initTunnelList()
+	initTunnelStop()
+	initTunnelInstallService()
 }
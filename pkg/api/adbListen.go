@@ -8,7 +8,7 @@ import (
 )
 
 func (s *Server) StartAdbListening() {
-	for {
+	for s.ctx.Err() == nil {
 		client, err := adb.NewClient()
 		if err != nil {
 			s.logger.Error("could not connect to adb server, will retry in 3 seconds...",
@@ -34,12 +34,15 @@ func (s *Server) StartAdbListening() {
 						s.logger.Error("failed to get device", zap.Error(err))
 						continue
 					}
-					s.androidDevice[event.Serial] = device
+					s.setAndroidDevice(device)
+					s.markAttached(event.Serial)
 				}
 
 			} else {
 				s.logger.Info("设备断开", zap.String("serial", event.Serial), zap.String("status", event.Status))
-				delete(s.androidDevice, event.Serial)
+				s.deleteAndroidDevice(event.Serial)
+				s.forgetAndroidForwards(event.Serial)
+				s.pocoPool.CloseDevice(event.Serial)
 			}
 		}
 	}
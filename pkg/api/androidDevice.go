@@ -1,10 +1,8 @@
 package api
 
 import (
-	"bytes"
-	"fmt"
-	"image/png"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -18,10 +16,40 @@ func (s *Server) hListAndroid(c *gin.Context) {
 	c.JSON(http.StatusOK, devices)
 }
 
-func (s *Server) listAndroid() []iosvo.Device {
-	devices := make([]iosvo.Device, 0, len(s.androidDevice))
+func (s *Server) setAndroidDevice(device adb.Device) {
+	s.androidDevicesMu.Lock()
+	defer s.androidDevicesMu.Unlock()
+	s.androidDevice[device.Serial()] = device
+}
+
+func (s *Server) deleteAndroidDevice(serial string) {
+	s.androidDevicesMu.Lock()
+	defer s.androidDevicesMu.Unlock()
+	delete(s.androidDevice, serial)
+}
+
+func (s *Server) androidDeviceBySerial(serial string) (adb.Device, bool) {
+	s.androidDevicesMu.RLock()
+	defer s.androidDevicesMu.RUnlock()
+	device, ok := s.androidDevice[serial]
+	return device, ok
+}
 
+func (s *Server) androidDeviceList() []adb.Device {
+	s.androidDevicesMu.RLock()
+	defer s.androidDevicesMu.RUnlock()
+	devices := make([]adb.Device, 0, len(s.androidDevice))
 	for _, device := range s.androidDevice {
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+func (s *Server) listAndroid() []iosvo.Device {
+	androidDevices := s.androidDeviceList()
+	devices := make([]iosvo.Device, 0, len(androidDevices))
+
+	for _, device := range androidDevices {
 		deviceVo := iosvo.Device{
 			UdID:         device.Serial(),
 			Name:         device.GetProp("ro.product.name"),
@@ -55,39 +83,42 @@ func (s *Server) listAndroid() []iosvo.Device {
 
 func (s *Server) hAndroidScreenshot(c *gin.Context) {
 	device := c.MustGet(ANDROID_KEY).(adb.Device)
-	quality := c.DefaultQuery("qulaity", "25")
-	// 解析质量参数
-	q, err := strconv.Atoi(quality)
-	if err != nil || q < 1 || q > 100 {
-		q = 25 // 无效值时使用默认值
+	options, err := parseScreenshotOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
 	}
 
-	img, err := device.Screenshot()
+	img, err := captureAndroidScreen(device)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
 		return
 	}
+	s.writeScreenshot(c, nil, img, options, func() int {
+		return androidOrientation(device)
+	})
+}
 
-	buf := new(bytes.Buffer)
-	encoder := png.Encoder{
-		CompressionLevel: png.DefaultCompression,
-	}
+var surfaceOrientationPattern = regexp.MustCompile(`SurfaceOrientation:\s*(\d)`)
 
-	// 根据质量参数调整压缩级别
-	if q < 30 {
-		encoder.CompressionLevel = png.BestSpeed
-	} else if q > 80 {
-		encoder.CompressionLevel = png.BestCompression
+// androidSurfaceOrientation returns the display rotation in quarter turns
+// (Surface.ROTATION_0 to ROTATION_270), 0 if it is unknown.
+func androidSurfaceOrientation(device adb.Device) int {
+	output, err := device.RunShellCommand("dumpsys", "input")
+	if err != nil {
+		return 0
 	}
-
-	if err := encoder.Encode(buf, img); err != nil {
-		c.JSON(http.StatusInternalServerError, GenericResponse{
-			Error: fmt.Sprintf("failed to encode PNG: %v", err),
-		})
-		return
+	match := surfaceOrientationPattern.FindStringSubmatch(output)
+	if match == nil {
+		return 0
 	}
-	imageBytes := buf.Bytes()
+	rotation, _ := strconv.Atoi(match[1])
+	return rotation
+}
 
-	c.Header("Content-Type", "image/png")
-	c.Data(http.StatusOK, "application/octet-stream", imageBytes)
+// androidOrientation returns the clockwise rotation of the display, 0 if it
+// is unknown. Display rotation 1 (90 degrees) turns the content counter
+// clockwise.
+func androidOrientation(device adb.Device) int {
+	return (4 - androidSurfaceOrientation(device)) % 4 * 90
 }
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/blacklee123/go-ios-android/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// androidForwardPort returns the host port adb forwards to remotePort of
+// the device, the forward is created on first use.
+func (s *Server) androidForwardPort(device adb.Device, remotePort int) (int, error) {
+	serial := device.Serial()
+	s.forwardsMu.Lock()
+	defer s.forwardsMu.Unlock()
+	if hostPort, ok := s.androidForwards[serial][remotePort]; ok {
+		return hostPort, nil
+	}
+	hostPort := utils.GiveAvialablePortFromSpecifyStart(remotePort)
+	if err := device.Forward(hostPort, remotePort); err != nil {
+		s.logger.Error("failed to forward port",
+			zap.String("serial", serial),
+			zap.Int("hostPort", hostPort),
+			zap.Int("phonePort", remotePort), zap.Error(err))
+		return 0, err
+	}
+	if _, ok := s.androidForwards[serial]; !ok {
+		s.androidForwards[serial] = make(map[int]int)
+	}
+	s.androidForwards[serial][remotePort] = hostPort
+	return hostPort, nil
+}
+
+// forgetAndroidForwards drops the forwards of a detached device, adb
+// removes them itself when the device goes away.
+func (s *Server) forgetAndroidForwards(serial string) {
+	s.forwardsMu.Lock()
+	defer s.forwardsMu.Unlock()
+	delete(s.androidForwards, serial)
+}
+
+// closeAndroidForwards removes the forwards of every device from adb.
+func (s *Server) closeAndroidForwards() {
+	s.forwardsMu.Lock()
+	forwards := s.androidForwards
+	s.androidForwards = make(map[string]map[int]int)
+	s.forwardsMu.Unlock()
+	for serial, ports := range forwards {
+		device, ok := s.androidDeviceBySerial(serial)
+		if !ok {
+			continue
+		}
+		for _, hostPort := range ports {
+			if err := device.ForwardKill(hostPort); err != nil {
+				s.logger.Warn("failed to remove forward", zap.String("serial", serial), zap.Int("hostPort", hostPort), zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+	"github.com/blacklee123/go-ios-android/pkg/utils/uiautomator"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// AndroidElementQuery selects nodes of the uiautomator hierarchy, either by
+// XPath, a Poco selector or by attributes that all have to match exactly.
+type AndroidElementQuery struct {
+	XPath       string `form:"xpath"`
+	Selector    string `form:"selector"`
+	ResourceID  string `form:"resource_id"`
+	Text        string `form:"text"`
+	Class       string `form:"class"`
+	ContentDesc string `form:"content_desc"`
+	Index       *int   `form:"index"` // 只返回第几个匹配的节点
+}
+
+type ElementsResponse struct {
+	Count    int          `json:"count"`
+	Elements []*poco.Node `json:"elements"`
+}
+
+func (s *Server) hAndroidHierarchy(c *gin.Context) {
+	device := c.MustGet(ANDROID_KEY).(adb.Device)
+	data, err := dumpAndroidHierarchy(device)
+	if err != nil {
+		s.logger.Error("failed to dump hierarchy", zap.String("serial", device.Serial()), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	if c.Query("format") == "xml" {
+		c.Data(http.StatusOK, "application/xml", data)
+		return
+	}
+	root, err := parseAndroidHierarchy(device, data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, root)
+}
+
+func (s *Server) hAndroidFindElements(c *gin.Context) {
+	device := c.MustGet(ANDROID_KEY).(adb.Device)
+	var query AndroidElementQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if query.XPath == "" && query.Selector == "" && query.ResourceID == "" && query.Text == "" && query.Class == "" && query.ContentDesc == "" {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "one of xpath, selector, resource_id, text, class or content_desc is required"})
+		return
+	}
+
+	root, err := androidHierarchy(device)
+	if err != nil {
+		s.logger.Error("failed to dump hierarchy", zap.String("serial", device.Serial()), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	nodes, err := findAndroidElements(root, query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, elementsResponse(nodes, query.Index))
+}
+
+// elementsResponse returns the nodes without their children, only the one
+// at index if it is given.
+func elementsResponse(nodes []*poco.Node, index *int) ElementsResponse {
+	if index != nil {
+		if *index < 0 || *index >= len(nodes) {
+			nodes = nil
+		} else {
+			nodes = nodes[*index : *index+1]
+		}
+	}
+	elements := make([]*poco.Node, 0, len(nodes))
+	for _, node := range nodes {
+		elements = append(elements, node.Leaf())
+	}
+	return ElementsResponse{Count: len(elements), Elements: elements}
+}
+
+func findAndroidElements(root *poco.Node, query AndroidElementQuery) ([]*poco.Node, error) {
+	if query.XPath != "" {
+		return poco.QueryXPath(root, query.XPath)
+	}
+	if query.Selector != "" {
+		return poco.QuerySelector(root, query.Selector, false)
+	}
+	var nodes []*poco.Node
+	root.Walk(func(node *poco.Node) bool {
+		if node != root &&
+			matchAttr(node, uiautomator.AttrResourceID, query.ResourceID) &&
+			matchAttr(node, poco.AttrText, query.Text) &&
+			matchAttr(node, uiautomator.AttrClass, query.Class) &&
+			matchAttr(node, uiautomator.AttrContentDesc, query.ContentDesc) {
+			nodes = append(nodes, node)
+		}
+		return true
+	})
+	return nodes, nil
+}
+
+// matchAttr reports whether the string attribute equals want, an empty want
+// matches every node.
+func matchAttr(node *poco.Node, name, want string) bool {
+	if want == "" {
+		return true
+	}
+	value, _ := node.Payload[name].(string)
+	return value == want
+}
+
+// androidHierarchy dumps the UI hierarchy of the device as Poco nodes.
+func androidHierarchy(device adb.Device) (*poco.Node, error) {
+	data, err := dumpAndroidHierarchy(device)
+	if err != nil {
+		return nil, err
+	}
+	return parseAndroidHierarchy(device, data)
+}
+
+func parseAndroidHierarchy(device adb.Device, data []byte) (*poco.Node, error) {
+	screen, err := androidScreenInfo(device)
+	if err != nil {
+		return nil, err
+	}
+	return uiautomator.Parse(data, image.Pt(screen.width, screen.height))
+}
+
+// dumpAndroidHierarchy runs `uiautomator dump` and returns the XML. The dump
+// fails while another uiautomator session, e.g. uiautomator2, is running.
+func dumpAndroidHierarchy(device adb.Device) ([]byte, error) {
+	remote := fmt.Sprintf("%s/gia-hierarchy-%d.xml", androidTmpDir, time.Now().UnixNano())
+	defer device.RunShellCommand("rm", "-f", remote)
+	output, err := device.RunShellCommand("uiautomator", "dump", remote)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(output, "dumped to") {
+		return nil, fmt.Errorf("uiautomator dump failed: %s", strings.TrimSpace(output))
+	}
+	data, err := device.RunShellCommandWithBytes("cat", remote)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(string(data), "<hierarchy") {
+		return nil, errors.New("uiautomator dump is empty")
+	}
+	return data, nil
+}
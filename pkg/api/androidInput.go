@@ -0,0 +1,498 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSwipeDuration     = 300
+	defaultLongPressDuration = 1000
+	defaultGestureDuration   = 500
+	maxInputActions          = 200
+	// 手势每一步之间的间隔
+	gestureStepInterval = 16 * time.Millisecond
+
+	adbKeyboardPackage = "com.android.adbkeyboard"
+	adbKeyboardIME     = "com.android.adbkeyboard/.AdbIME"
+)
+
+var (
+	wmSizePattern        = regexp.MustCompile(`(Physical|Override) size:\s*(\d+)x(\d+)`)
+	absMtPositionPattern = regexp.MustCompile(`ABS_MT_POSITION_([XY])\s*:.*max (\d+)`)
+	errNoTouchscreen     = errors.New("no multi-touch screen found in getevent")
+	errNoAdbKeyboard     = errors.New("typing non ASCII text needs ADBKeyBoard (" + adbKeyboardPackage + ") installed on the device")
+)
+
+// AndroidAction is one input action. Coordinates are pixels of the screen in
+// its current orientation, or fractions of it when Normalized is set.
+type AndroidAction struct {
+	Type       string           `json:"type"` // tap | long_press | swipe | gesture | text | key | wait
+	X          float64          `json:"x,omitempty"`
+	Y          float64          `json:"y,omitempty"`
+	ToX        float64          `json:"to_x,omitempty"`
+	ToY        float64          `json:"to_y,omitempty"`
+	Duration   int              `json:"duration,omitempty"` // 毫秒
+	Pointers   [][]GesturePoint `json:"pointers,omitempty"` // gesture：每个手指的轨迹
+	Text       string           `json:"text,omitempty"`
+	Key        string           `json:"key,omitempty"` // keycode 数字或名称，如 HOME、KEYCODE_BACK
+	LongPress  bool             `json:"long_press,omitempty"`
+	Normalized bool             `json:"normalized,omitempty"`
+	Delay      int              `json:"delay,omitempty"` // 执行后等待的毫秒数
+}
+
+type GesturePoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// AndroidInputRequest is either a single action or a batch in Actions.
+type AndroidInputRequest struct {
+	AndroidAction
+	Actions         []AndroidAction `json:"actions"`
+	ContinueOnError bool            `json:"continue_on_error"`
+}
+
+type AndroidActionResult struct {
+	Index    int    `json:"index"`
+	Type     string `json:"type"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration"` // 毫秒
+}
+
+// androidScreen is the display of a device, needed to resolve normalized
+// coordinates and to map them to the touchscreen for gestures.
+type androidScreen struct {
+	width, height int // 当前方向下的尺寸
+	rotation      int // Surface.ROTATION_*
+}
+
+// touchscreen is the multi-touch input device gestures are written to.
+type touchscreen struct {
+	path       string
+	maxX, maxY int
+	eventSize  int // struct input_event 的大小，取决于用户空间的位数
+}
+
+var (
+	touchscreensMu sync.Mutex
+	touchscreens   = make(map[string]touchscreen)
+)
+
+func (s *Server) hAndroidInput(c *gin.Context) {
+	device := c.MustGet(ANDROID_KEY).(adb.Device)
+	var req AndroidInputRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	actions := req.Actions
+	if len(actions) == 0 {
+		actions = []AndroidAction{req.AndroidAction}
+	}
+	if len(actions) > maxInputActions {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: fmt.Sprintf("at most %d actions per request", maxInputActions)})
+		return
+	}
+
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	results := make([]AndroidActionResult, 0, len(actions))
+	failed := false
+	for i, action := range actions {
+		if ctx.Err() != nil {
+			break
+		}
+		started := time.Now()
+		err := s.runAndroidAction(ctx, device, action)
+		result := AndroidActionResult{Index: i, Type: action.Type, OK: err == nil, Duration: time.Since(started).Milliseconds()}
+		if err != nil {
+			s.logger.Warn("android input failed", zap.String("serial", device.Serial()), zap.String("type", action.Type), zap.Error(err))
+			result.Error = err.Error()
+			failed = true
+		} else if macroAction, ok := macroActionFromAndroid(action); ok {
+			s.recordMacroAction(device.Serial(), macroAction)
+		}
+		results = append(results, result)
+		if err != nil && !req.ContinueOnError {
+			break
+		}
+		if action.Delay > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(action.Delay) * time.Millisecond):
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if failed {
+		status = http.StatusInternalServerError
+	}
+	if len(req.Actions) == 0 {
+		if failed {
+			c.JSON(status, GenericResponse{Error: results[0].Error})
+			return
+		}
+		c.JSON(status, results[0])
+		return
+	}
+	c.JSON(status, gin.H{"results": results})
+}
+
+// runAndroidAction executes one action through adb shell, a wait ends early
+// when ctx is done.
+func (s *Server) runAndroidAction(ctx context.Context, device adb.Device, action AndroidAction) error {
+	var screen androidScreen
+	needsScreen := action.Normalized || action.Type == "gesture"
+	if needsScreen {
+		var err error
+		if screen, err = androidScreenInfo(device); err != nil {
+			return err
+		}
+	}
+	point := func(x, y float64) (int, int) {
+		if action.Normalized {
+			return int(x * float64(screen.width)), int(y * float64(screen.height))
+		}
+		return int(x), int(y)
+	}
+
+	switch action.Type {
+	case "tap":
+		x, y := point(action.X, action.Y)
+		return androidTap(device, x, y)
+	case "long_press":
+		x, y := point(action.X, action.Y)
+		duration := action.Duration
+		if duration <= 0 {
+			duration = defaultLongPressDuration
+		}
+		return androidSwipe(device, x, y, x, y, duration)
+	case "swipe":
+		x, y := point(action.X, action.Y)
+		toX, toY := point(action.ToX, action.ToY)
+		duration := action.Duration
+		if duration <= 0 {
+			duration = defaultSwipeDuration
+		}
+		return androidSwipe(device, x, y, toX, toY, duration)
+	case "gesture":
+		if len(action.Pointers) == 0 {
+			return errors.New("gesture needs pointers")
+		}
+		paths := make([][][2]int, len(action.Pointers))
+		for i, pointer := range action.Pointers {
+			if len(pointer) == 0 {
+				return fmt.Errorf("pointer %d has no points", i)
+			}
+			for _, p := range pointer {
+				x, y := point(p.X, p.Y)
+				paths[i] = append(paths[i], [2]int{x, y})
+			}
+		}
+		duration := action.Duration
+		if duration <= 0 {
+			duration = defaultGestureDuration
+		}
+		return androidGesture(device, screen, paths, duration)
+	case "text":
+		return androidText(device, action.Text)
+	case "key":
+		return androidKey(device, action.Key, action.LongPress)
+	case "wait":
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(action.Duration) * time.Millisecond):
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown action type %q", action.Type)
+}
+
+func androidTap(device adb.Device, x, y int) error {
+	return runInput(device, "tap", strconv.Itoa(x), strconv.Itoa(y))
+}
+
+func androidSwipe(device adb.Device, x, y, toX, toY, durationMs int) error {
+	return runInput(device, "swipe", strconv.Itoa(x), strconv.Itoa(y), strconv.Itoa(toX), strconv.Itoa(toY), strconv.Itoa(durationMs))
+}
+
+// androidKey sends a key event, key is a keycode number or a KeyEvent name
+// with or without the KEYCODE_ prefix.
+func androidKey(device adb.Device, key string, longPress bool) error {
+	key = strings.ToUpper(strings.TrimSpace(key))
+	if key == "" {
+		return errors.New("key is missing")
+	}
+	if _, err := strconv.Atoi(key); err != nil && !strings.HasPrefix(key, "KEYCODE_") {
+		key = "KEYCODE_" + key
+	}
+	if longPress {
+		return runInput(device, "keyevent", "--longpress", key)
+	}
+	return runInput(device, "keyevent", key)
+}
+
+// androidText types text. `input text` only handles ASCII, other text goes
+// through the ADBKeyBoard IME which is switched on for the duration.
+func androidText(device adb.Device, text string) error {
+	if text == "" {
+		return nil
+	}
+	if isPrintableASCII(text) {
+		// input text 中空格需写成 %s
+		return runInput(device, "text", shellQuote(strings.ReplaceAll(text, " ", "%s")))
+	}
+
+	packages, err := device.RunShellCommand("pm", "list", "packages", adbKeyboardPackage)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(packages, adbKeyboardPackage) {
+		return errNoAdbKeyboard
+	}
+	previous, _ := device.RunShellCommand("settings", "get", "secure", "default_input_method")
+	previous = strings.TrimSpace(previous)
+	if previous != adbKeyboardIME {
+		if _, err := device.RunShellCommand("ime", "enable", adbKeyboardIME); err != nil {
+			return err
+		}
+		if _, err := device.RunShellCommand("ime", "set", adbKeyboardIME); err != nil {
+			return err
+		}
+		defer func() {
+			if previous != "" && previous != "null" {
+				device.RunShellCommand("ime", "set", previous)
+			}
+		}()
+		// 等待输入法切换完成
+		time.Sleep(300 * time.Millisecond)
+	}
+	_, err = device.RunShellCommand("am", "broadcast", "-a", "ADB_INPUT_B64", "--es", "msg", base64.StdEncoding.EncodeToString([]byte(text)))
+	return err
+}
+
+func isPrintableASCII(text string) bool {
+	for _, r := range text {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// shellQuote quotes s for the device shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func runInput(device adb.Device, args ...string) error {
+	output, err := device.RunShellCommand("input", args...)
+	if err != nil {
+		return err
+	}
+	// input 出错时退出码不会传回，只能检查输出
+	if output = strings.TrimSpace(output); strings.Contains(output, "Error") || strings.Contains(output, "Exception") {
+		return errors.New(output)
+	}
+	return nil
+}
+
+// androidScreenInfo reads the display size in the current orientation.
+func androidScreenInfo(device adb.Device) (androidScreen, error) {
+	output, err := device.RunShellCommand("wm", "size")
+	if err != nil {
+		return androidScreen{}, err
+	}
+	var screen androidScreen
+	// Override size 优先于 Physical size
+	for _, match := range wmSizePattern.FindAllStringSubmatch(output, -1) {
+		if screen.width == 0 || match[1] == "Override" {
+			screen.width, _ = strconv.Atoi(match[2])
+			screen.height, _ = strconv.Atoi(match[3])
+		}
+	}
+	if screen.width == 0 {
+		return androidScreen{}, fmt.Errorf("unexpected wm size output: %s", strings.TrimSpace(output))
+	}
+	screen.rotation = androidSurfaceOrientation(device)
+	if screen.rotation%2 == 1 {
+		screen.width, screen.height = screen.height, screen.width
+	}
+	return screen, nil
+}
+
+// findTouchscreen looks up the input device reporting multi-touch positions.
+func findTouchscreen(device adb.Device) (touchscreen, error) {
+	touchscreensMu.Lock()
+	ts, ok := touchscreens[device.Serial()]
+	touchscreensMu.Unlock()
+	if ok {
+		return ts, nil
+	}
+
+	output, err := device.RunShellCommand("getevent", "-pl")
+	if err != nil {
+		return touchscreen{}, err
+	}
+	for _, block := range strings.Split(output, "add device") {
+		matches := absMtPositionPattern.FindAllStringSubmatch(block, -1)
+		if len(matches) < 2 {
+			continue
+		}
+		path := strings.TrimSpace(strings.SplitN(strings.SplitN(block, "\n", 2)[0], ":", 2)[1])
+		ts = touchscreen{path: path, eventSize: 16}
+		if abi, _ := device.RunShellCommand("getprop", "ro.product.cpu.abi"); strings.Contains(abi, "64") {
+			ts.eventSize = 24
+		}
+		for _, match := range matches {
+			value, _ := strconv.Atoi(match[2])
+			if match[1] == "X" {
+				ts.maxX = value
+			} else {
+				ts.maxY = value
+			}
+		}
+		touchscreensMu.Lock()
+		touchscreens[device.Serial()] = ts
+		touchscreensMu.Unlock()
+		return ts, nil
+	}
+	return touchscreen{}, errNoTouchscreen
+}
+
+// androidGesture plays a multi-finger gesture by writing input events to the
+// touchscreen, since `input` only knows single pointers. Every pointer moves
+// along its path, all paths are interpolated over the same duration. The
+// events of a step are written by one dd from a pushed file, sendevent would
+// start a process per event and stretch the gesture.
+func androidGesture(device adb.Device, screen androidScreen, paths [][][2]int, durationMs int) error {
+	ts, err := findTouchscreen(device)
+	if err != nil {
+		return err
+	}
+	steps := max(1, int(time.Duration(durationMs)*time.Millisecond/gestureStepInterval))
+
+	var events bytes.Buffer
+	count := 0
+	event := func(typ, code, value int) {
+		// 时间戳由内核填写，留空即可
+		events.Write(make([]byte, ts.eventSize-8))
+		binary.Write(&events, binary.LittleEndian, struct {
+			Type, Code uint16
+			Value      int32
+		}{uint16(typ), uint16(code), int32(value)})
+		count++
+	}
+	remote := fmt.Sprintf("%s/gia-gesture-%d", androidTmpDir, time.Now().UnixNano())
+	var script []string
+	// writeStep 让一个 dd 写出上一步之后的事件
+	written := 0
+	writeStep := func(sleep bool) {
+		script = append(script, fmt.Sprintf("dd if=%s.events of=%s bs=%d skip=%d count=%d 2>/dev/null || { echo cannot write to %s; exit 1; }",
+			remote, ts.path, ts.eventSize, written, count-written, ts.path))
+		written = count
+		if sleep {
+			script = append(script, fmt.Sprintf("sleep %.3f", gestureStepInterval.Seconds()))
+		}
+	}
+	const (
+		evSyn, evKey, evAbs                  = 0, 1, 3
+		synReport, btnTouch                  = 0, 0x14a
+		absMtSlot, absMtTrackingID           = 0x2f, 0x39
+		absMtPositionX, absMtPositionY       = 0x35, 0x36
+		absMtTouchMajor, absMtPressure, lift = 0x30, 0x3a, -1
+	)
+	for step := 0; step <= steps; step++ {
+		for slot, path := range paths {
+			x, y := interpolatePath(path, float64(step)/float64(steps))
+			tx, ty := screen.toTouchscreen(ts, x, y)
+			event(evAbs, absMtSlot, slot)
+			if step == 0 {
+				event(evAbs, absMtTrackingID, slot+1)
+				event(evAbs, absMtTouchMajor, 5)
+				event(evAbs, absMtPressure, 50)
+			}
+			event(evAbs, absMtPositionX, tx)
+			event(evAbs, absMtPositionY, ty)
+		}
+		if step == 0 {
+			event(evKey, btnTouch, 1)
+		}
+		event(evSyn, synReport, 0)
+		writeStep(true)
+	}
+	for slot := range paths {
+		event(evAbs, absMtSlot, slot)
+		event(evAbs, absMtTrackingID, lift)
+	}
+	event(evKey, btnTouch, 0)
+	event(evSyn, synReport, 0)
+	writeStep(false)
+
+	// 脚本较长，超过 adb shell 命令长度限制，和事件一起推送到设备上执行
+	defer device.RunShellCommand("rm", "-f", remote+".events", remote+".sh")
+	if err := device.Push(&events, remote+".events", time.Now(), 0644); err != nil {
+		return err
+	}
+	if err := device.Push(strings.NewReader(strings.Join(script, "\n")+"\n"), remote+".sh", time.Now(), 0644); err != nil {
+		return err
+	}
+	output, err := device.RunShellCommand("sh", remote+".sh")
+	if err != nil {
+		return err
+	}
+	if output = strings.TrimSpace(output); output != "" {
+		return errors.New(output)
+	}
+	return nil
+}
+
+// interpolatePath returns the point at fraction t of a polyline.
+func interpolatePath(path [][2]int, t float64) (float64, float64) {
+	if len(path) == 1 {
+		return float64(path[0][0]), float64(path[0][1])
+	}
+	pos := t * float64(len(path)-1)
+	i := min(int(pos), len(path)-2)
+	f := pos - float64(i)
+	a, b := path[i], path[i+1]
+	return float64(a[0]) + float64(b[0]-a[0])*f, float64(a[1]) + float64(b[1]-a[1])*f
+}
+
+// toTouchscreen maps a point of the rotated display to the raw coordinates of
+// the touchscreen, which always uses the natural orientation.
+func (screen androidScreen) toTouchscreen(ts touchscreen, x, y float64) (int, int) {
+	naturalW, naturalH := float64(screen.width), float64(screen.height)
+	if screen.rotation%2 == 1 {
+		naturalW, naturalH = naturalH, naturalW
+	}
+	nx, ny := x, y
+	switch screen.rotation {
+	case 1:
+		nx, ny = naturalW-y, x
+	case 2:
+		nx, ny = naturalW-x, naturalH-y
+	case 3:
+		nx, ny = y, naturalH-x
+	}
+	return int(nx * float64(ts.maxX) / naturalW), int(ny * float64(ts.maxY) / naturalH)
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+	"github.com/gin-gonic/gin"
+)
+
+// AndroidPocoMiddleware forwards the SDK port of the device with adb if
+// needed and sets a client connected through it as POCO_KEY.
+func (s *Server) AndroidPocoMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		port, err := pocoPort(c.Param("port"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, GenericResponse{Error: "invalid port"})
+			return
+		}
+		device := c.MustGet(ANDROID_KEY).(adb.Device)
+		pocoClient, release, err := s.androidPocoClient(device, port)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+			return
+		}
+		defer release()
+		c.Set(POCO_KEY, pocoClient)
+		c.Next()
+	}
+}
+
+// androidPocoClient returns the pooled client for the SDK port of the
+// device, release has to be called once the client is no longer used.
+func (s *Server) androidPocoClient(device adb.Device, port int) (*poco.PocoClient, func(), error) {
+	forwaredPort, err := s.androidForwardPort(device, port)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, release := s.pocoPool.Get(device.Serial(), port, forwaredPort)
+	return client, release, nil
+}
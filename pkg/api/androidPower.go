@@ -0,0 +1,67 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/blacklee123/go-ios-android/pkg/utils/adbhost"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// hAndroidReboot reboots the device, mode can be bootloader or recovery.
+// wait=true is only supported for normal reboots, the call returns once adb
+// sees the device again and sys.boot_completed is set.
+func (s *Server) hAndroidReboot(c *gin.Context) {
+	device := c.MustGet(ANDROID_KEY).(adb.Device)
+	serial := device.Serial()
+	mode := c.Query("mode")
+	if mode != "" && mode != "bootloader" && mode != "recovery" {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "mode must be bootloader or recovery"})
+		return
+	}
+	wait, timeout, err := rebootWaitOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if wait && mode != "" {
+		// bootloader 和 recovery 模式下设备不会以 device 状态出现
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "wait is not supported for mode " + mode})
+		return
+	}
+
+	generation := s.attachGeneration(serial)
+	s.logger.Info("rebooting", zap.String("serial", serial), zap.String("mode", mode))
+	if err := adbhost.Reboot(serial, mode); err != nil {
+		s.logger.Error("failed to reboot", zap.String("serial", serial), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	if !wait {
+		c.JSON(http.StatusAccepted, GenericResponse{Message: "rebooting " + serial})
+		return
+	}
+
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	err = s.waitForReattach(ctx, serial, generation, timeout, func() (bool, error) {
+		device, ok := s.androidDeviceBySerial(serial)
+		if !ok {
+			return false, nil
+		}
+		completed, err := device.RunShellCommand("getprop", "sys.boot_completed")
+		return err == nil && strings.TrimSpace(completed) == "1", nil
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errRebootTimeout) {
+			status = http.StatusGatewayTimeout
+		}
+		c.JSON(status, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, GenericResponse{Message: "rebooted " + serial})
+}
@@ -0,0 +1,277 @@
+package api
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/blacklee123/go-ios-android/pkg/api/iosvo"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	// screenrecord 单次最长 3 分钟，超过后需要开始新的分段
+	screenrecordTimeLimit = 180
+	screenrecordPoll      = 2 * time.Second
+	screenrecordStopWait  = 10 * time.Second
+	androidTmpDir         = "/data/local/tmp"
+)
+
+var (
+	screenrecordSizePattern = regexp.MustCompile(`^\d+x\d+$`)
+	errNoSegments           = errors.New("recording has no segments")
+)
+
+// screenrecordSegments are the local files of the pulled segments in order.
+type screenrecordSegments struct {
+	mu    sync.Mutex
+	files []string
+}
+
+func (s *Server) hStartAndroidRecording(c *gin.Context) {
+	device := c.MustGet(ANDROID_KEY).(adb.Device)
+	options, maxDuration, err := parseRecordingOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if options.Size != "" && !screenrecordSizePattern.MatchString(options.Size) {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "size must look like 720x1280"})
+		return
+	}
+	if options.BitRate < 0 {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "bit_rate must be positive"})
+		return
+	}
+
+	segments := &screenrecordSegments{}
+	rec, err := s.startRecording(device.Serial(), "android", s.screenrecordFormats(0), maxDuration,
+		func(ctx context.Context, rec *recording) error {
+			return s.captureScreenrecord(ctx, rec, device, options, segments)
+		},
+		func(rec *recording) func(ctx context.Context, format string) (string, error) {
+			return func(ctx context.Context, format string) (string, error) {
+				if format == "zip" {
+					return exportScreenrecordZip(rec, segments)
+				}
+				return s.exportScreenrecord(ctx, rec, segments)
+			}
+		})
+	if err != nil {
+		c.JSON(http.StatusConflict, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, rec.snapshot())
+}
+
+// screenrecordFormats returns the formats of a recording with count segments.
+// Several segments can only be joined into one mp4 with ffmpeg, without it
+// they are offered as a zip of the segments instead.
+func (s *Server) screenrecordFormats(count int) []string {
+	if count > 1 && s.config.FFmpeg == "" {
+		return []string{"zip"}
+	}
+	return []string{"mp4"}
+}
+
+// captureScreenrecord chains screenrecord runs until ctx is done, each
+// segment is pulled to the recording dir and removed from the device.
+func (s *Server) captureScreenrecord(ctx context.Context, rec *recording, device adb.Device, options RecordingOptions, segments *screenrecordSegments) error {
+	var total int64
+	for i := 0; ctx.Err() == nil; i++ {
+		remote := fmt.Sprintf("%s/gia-%s-%03d.mp4", androidTmpDir, rec.info.ID, i)
+		recordErr := s.recordSegment(ctx, device, remote, options, func(size int64) error {
+			rec.update(func(info *iosvo.Recording) {
+				info.Size = total + size
+				info.Duration = time.Since(info.StartedAt).Seconds()
+			})
+			if total+size > options.MaxSize {
+				return errRecordingMaxSize
+			}
+			return nil
+		})
+
+		local := filepath.Join(rec.dir, fmt.Sprintf("segment-%03d.mp4", i))
+		size, pullErr := pullAndRemove(device, remote, local)
+		if pullErr == nil && size > 0 {
+			total += size
+			segments.mu.Lock()
+			segments.files = append(segments.files, local)
+			count := len(segments.files)
+			segments.mu.Unlock()
+			rec.update(func(info *iosvo.Recording) {
+				info.Size = total
+				info.Segments = count
+				info.Duration = time.Since(info.StartedAt).Seconds()
+				info.Formats = s.screenrecordFormats(count)
+			})
+		}
+		if recordErr != nil {
+			return recordErr
+		}
+		if pullErr != nil {
+			return fmt.Errorf("pull segment %d: %w", i, pullErr)
+		}
+	}
+	return nil
+}
+
+// recordSegment runs one screenrecord until its time limit, ctx is done or
+// checkSize fails, which is called with the size of the segment on the device.
+func (s *Server) recordSegment(ctx context.Context, device adb.Device, remote string, options RecordingOptions, checkSize func(int64) error) error {
+	args := []string{"--time-limit", strconv.Itoa(screenrecordTimeLimit)}
+	if options.BitRate > 0 {
+		args = append(args, "--bit-rate", strconv.Itoa(options.BitRate))
+	}
+	if options.Size != "" {
+		args = append(args, "--size", options.Size)
+	}
+	args = append(args, remote)
+
+	done := make(chan error, 1)
+	go func() {
+		output, err := device.RunShellCommand("screenrecord", args...)
+		if err == nil && strings.Contains(output, "ERROR") {
+			err = errors.New(strings.TrimSpace(output))
+		}
+		done <- err
+	}()
+
+	ticker := time.NewTicker(screenrecordPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			s.stopScreenrecord(device, remote, done)
+			return nil
+		case <-ticker.C:
+			output, err := device.RunShellCommand("stat", "-c", "%s", remote)
+			if err != nil {
+				continue
+			}
+			size, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+			if err != nil {
+				continue
+			}
+			if err := checkSize(size); err != nil {
+				s.stopScreenrecord(device, remote, done)
+				return err
+			}
+		}
+	}
+}
+
+// stopScreenrecord interrupts screenrecord so that it finishes the mp4 file,
+// a killed screenrecord leaves an unplayable file behind.
+func (s *Server) stopScreenrecord(device adb.Device, remote string, done <-chan error) {
+	if _, err := device.RunShellCommand("pkill", "-INT", "-f", remote); err != nil {
+		s.logger.Warn("failed to stop screenrecord", zap.String("serial", device.Serial()), zap.Error(err))
+	}
+	select {
+	case <-done:
+	case <-time.After(screenrecordStopWait):
+		s.logger.Warn("screenrecord did not stop in time", zap.String("serial", device.Serial()))
+	}
+}
+
+func pullAndRemove(device adb.Device, remote, local string) (int64, error) {
+	defer device.RunShellCommand("rm", "-f", remote)
+	f, err := os.Create(local)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := device.Pull(remote, f); err != nil {
+		os.Remove(local)
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// exportScreenrecord returns the only segment as is, several segments are
+// concatenated with ffmpeg without re-encoding. mp4 is only offered for
+// several segments when ffmpeg is configured, see screenrecordFormats.
+func (s *Server) exportScreenrecord(ctx context.Context, rec *recording, segments *screenrecordSegments) (string, error) {
+	segments.mu.Lock()
+	files := append([]string(nil), segments.files...)
+	segments.mu.Unlock()
+	switch len(files) {
+	case 0:
+		return "", errNoSegments
+	case 1:
+		return files[0], nil
+	}
+
+	return exportOnce(filepath.Join(rec.dir, "recording.mp4"), func(tmp string) error {
+		var list strings.Builder
+		for _, file := range files {
+			fmt.Fprintf(&list, "file '%s'\n", filepath.Base(file))
+		}
+		listPath := filepath.Join(rec.dir, "segments.txt")
+		if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+			return err
+		}
+		return s.ffmpeg(ctx, "-f", "concat", "-safe", "0", "-i", listPath, "-c", "copy", "-f", "mp4", tmp)
+	})
+}
+
+// exportScreenrecordZip stores the segments in a zip in the order they were
+// recorded, mp4 is already compressed.
+func exportScreenrecordZip(rec *recording, segments *screenrecordSegments) (string, error) {
+	segments.mu.Lock()
+	files := append([]string(nil), segments.files...)
+	segments.mu.Unlock()
+	if len(files) == 0 {
+		return "", errNoSegments
+	}
+
+	return exportOnce(filepath.Join(rec.dir, "segments.zip"), func(tmp string) error {
+		f, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		archive := zip.NewWriter(f)
+		for _, file := range files {
+			if err := addZipFile(archive, file); err != nil {
+				return err
+			}
+		}
+		if err := archive.Close(); err != nil {
+			return err
+		}
+		return f.Close()
+	})
+}
+
+func addZipFile(archive *zip.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer, err := archive.CreateHeader(&zip.FileHeader{Name: filepath.Base(path), Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, file)
+	return err
+}
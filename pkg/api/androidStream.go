@@ -0,0 +1,559 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/blacklee123/go-ios-android/pkg/utils/imageutil"
+	"github.com/blacklee123/go-ios-android/pkg/utils/scrcpy"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	streamModeJpeg = "jpeg"
+	streamModeH264 = "h264"
+
+	defaultStreamFps     = 15
+	defaultStreamMaxSize = 720
+	defaultStreamQuality = 70
+	defaultStreamBitRate = 4000000
+	minStreamMaxSize     = 320
+	minStreamQuality     = 40
+	minStreamBitRate     = 1000000
+
+	streamWriteTimeout  = 5 * time.Second
+	streamStatsInterval = 5 * time.Second
+	// 连续多少帧发送很快才提高分辨率
+	streamUpgradeFrames = 20
+	// H.264 包积压超过该数量时降低分辨率和码率重启 scrcpy
+	streamPacketQueue = 60
+	// 按下到抬起小于该时间且几乎没有移动视为点击
+	tapMaxDuration = 500 * time.Millisecond
+	tapMaxDistance = 0.01
+)
+
+var (
+	// CheckOrigin 由 Server.checkOrigin 设置
+	streamUpgrader = websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 64 << 10,
+	}
+	errStreamOverload    = errors.New("client too slow")
+	errStreamReconfigure = errors.New("stream reconfigured")
+)
+
+// checkOrigin lets pages of the server itself and of AllowedOrigins open the
+// stream, other pages could inject input into the device. Clients that are
+// not browsers send no Origin.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.config.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamOptions are the targets of a stream, adaptation only goes below them.
+type streamOptions struct {
+	Fps     int `json:"fps"`
+	MaxSize int `json:"max_size"`
+	Quality int `json:"quality"`
+	BitRate int `json:"bit_rate"`
+}
+
+// streamControl is a message from the client. Coordinates are relative to the
+// screen (0-1) so they do not depend on the current stream resolution.
+type streamControl struct {
+	Type      string  `json:"type"`   // touch | key | text | config
+	Action    string  `json:"action"` // touch: down | move | up，key: down | up | press
+	X         float64 `json:"x"`
+	Y         float64 `json:"y"`
+	PointerID uint64  `json:"pointer_id"`
+	Keycode   int     `json:"keycode"`
+	Text      string  `json:"text"`
+	streamOptions
+}
+
+type touchStart struct {
+	x, y float64
+	at   time.Time
+}
+
+type androidStream struct {
+	s      *Server
+	conn   *websocket.Conn
+	device adb.Device
+	mode   string
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	options  streamOptions
+	configCh chan struct{}
+	// jpeg 模式下最近一帧的屏幕尺寸，用于换算触摸坐标
+	screenW, screenH int
+	touches          map[uint64]touchStart
+	// 宏录制用的触摸起点，两种模式都记录
+	macroTouches map[uint64]touchStart
+	// h264 模式下当前的 scrcpy 会话
+	session *scrcpy.Session
+}
+
+// hAndroidStream mirrors the screen over a WebSocket. mode=jpeg (default)
+// sends every frame as a binary JPEG message, mode=h264 runs scrcpy-server
+// and sends binary messages of an 8 byte big endian PTS with flags (bit 63
+// config, bit 62 key frame) followed by an Annex B access unit. Text messages
+// from the client are control messages, see streamControl.
+func (s *Server) hAndroidStream(c *gin.Context) {
+	device := c.MustGet(ANDROID_KEY).(adb.Device)
+	mode := c.DefaultQuery("mode", streamModeJpeg)
+	if mode != streamModeJpeg && mode != streamModeH264 {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "mode must be jpeg or h264"})
+		return
+	}
+	if mode == streamModeH264 && s.config.ScrcpyServer == "" {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "h264 needs scrcpy, start the server with --scrcpy-server"})
+		return
+	}
+	options := streamOptions{
+		Fps:     queryInt(c, "fps", defaultStreamFps),
+		MaxSize: queryInt(c, "max_size", defaultStreamMaxSize),
+		Quality: queryInt(c, "quality", defaultStreamQuality),
+		BitRate: queryInt(c, "bit_rate", defaultStreamBitRate),
+	}
+	options = options.merge(streamOptions{})
+
+	upgrader := streamUpgrader
+	upgrader.CheckOrigin = s.checkOrigin
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		s.logger.Error("websocket upgrade failed", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	st := &androidStream{
+		s:            s,
+		conn:         conn,
+		device:       device,
+		mode:         mode,
+		options:      options,
+		configCh:     make(chan struct{}, 1),
+		touches:      make(map[uint64]touchStart),
+		macroTouches: make(map[uint64]touchStart),
+	}
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	go func() {
+		defer cancel()
+		st.readControl()
+	}()
+
+	s.logger.Info("stream started", zap.String("serial", device.Serial()), zap.String("mode", mode))
+	if mode == streamModeH264 {
+		err = st.streamH264(ctx)
+	} else {
+		err = st.streamJpeg(ctx)
+	}
+	switch {
+	case s.ctx.Err() != nil:
+		st.writeJSON(gin.H{"type": closeStreamEvent, "reason": "server shutting down"})
+	case err != nil && ctx.Err() == nil:
+		s.logger.Error("stream failed", zap.String("serial", device.Serial()), zap.Error(err))
+		st.writeJSON(gin.H{"type": "error", "error": err.Error()})
+	}
+	st.writeMu.Lock()
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	st.writeMu.Unlock()
+	s.logger.Info("stream stopped", zap.String("serial", device.Serial()))
+}
+
+func queryInt(c *gin.Context, key string, def int) int {
+	value, err := strconv.Atoi(c.Query(key))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// merge applies the non zero fields of update and clamps the result.
+func (o streamOptions) merge(update streamOptions) streamOptions {
+	if update.Fps > 0 {
+		o.Fps = update.Fps
+	}
+	if update.MaxSize > 0 {
+		o.MaxSize = update.MaxSize
+	}
+	if update.Quality > 0 {
+		o.Quality = update.Quality
+	}
+	if update.BitRate > 0 {
+		o.BitRate = update.BitRate
+	}
+	o.Fps = min(max(o.Fps, 1), 60)
+	o.MaxSize = max(o.MaxSize, minStreamMaxSize)
+	o.Quality = min(max(o.Quality, 1), 100)
+	o.BitRate = max(o.BitRate, minStreamBitRate)
+	return o
+}
+
+func (st *androidStream) currentOptions() streamOptions {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.options
+}
+
+func (st *androidStream) writeJSON(v interface{}) error {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+	st.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return st.conn.WriteJSON(v)
+}
+
+func (st *androidStream) writeBinary(data []byte) error {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+	st.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return st.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// readControl handles control messages until the client goes away.
+func (st *androidStream) readControl() {
+	for {
+		messageType, data, err := st.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		var msg streamControl
+		if err := json.Unmarshal(data, &msg); err != nil {
+			st.writeJSON(gin.H{"type": "error", "error": err.Error()})
+			continue
+		}
+		if err := st.handleControl(msg); err != nil {
+			st.s.logger.Warn("stream control failed", zap.String("serial", st.device.Serial()), zap.String("type", msg.Type), zap.Error(err))
+			st.writeJSON(gin.H{"type": "error", "error": err.Error()})
+		}
+	}
+}
+
+func (st *androidStream) handleControl(msg streamControl) error {
+	if msg.Type == "config" {
+		st.mu.Lock()
+		st.options = st.options.merge(msg.streamOptions)
+		st.mu.Unlock()
+		select {
+		case st.configCh <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	st.mu.Lock()
+	session := st.session
+	st.mu.Unlock()
+	var err error
+	if st.mode == streamModeH264 {
+		if session == nil {
+			return errors.New("stream is not running")
+		}
+		err = st.controlScrcpy(session, msg)
+	} else {
+		err = st.controlAdb(msg)
+	}
+	if err == nil {
+		st.recordControl(msg)
+	}
+	return err
+}
+
+// recordControl adds the control message to the macro recorded on the
+// device, touches are recorded on up from their down position.
+func (st *androidStream) recordControl(msg streamControl) {
+	var start touchStart
+	if msg.Type == "touch" {
+		st.mu.Lock()
+		switch msg.Action {
+		case "down":
+			st.macroTouches[msg.PointerID] = touchStart{x: msg.X, y: msg.Y, at: time.Now()}
+		case "up":
+			start = st.macroTouches[msg.PointerID]
+			delete(st.macroTouches, msg.PointerID)
+		}
+		st.mu.Unlock()
+		if start.at.IsZero() {
+			return
+		}
+	}
+	if action, ok := androidControlMacroAction(msg, start); ok {
+		st.s.recordMacroAction(st.device.Serial(), action)
+	}
+}
+
+func (st *androidStream) controlScrcpy(session *scrcpy.Session, msg streamControl) error {
+	switch msg.Type {
+	case "touch":
+		meta := session.Meta()
+		x, y := int(msg.X*float64(meta.Width)), int(msg.Y*float64(meta.Height))
+		switch msg.Action {
+		case "down":
+			return session.InjectTouch(scrcpy.ActionDown, msg.PointerID, x, y, 1)
+		case "move":
+			return session.InjectTouch(scrcpy.ActionMove, msg.PointerID, x, y, 1)
+		case "up":
+			return session.InjectTouch(scrcpy.ActionUp, msg.PointerID, x, y, 0)
+		}
+	case "key":
+		switch msg.Action {
+		case "down":
+			return session.InjectKeycode(scrcpy.ActionDown, uint32(msg.Keycode), 0, 0)
+		case "up":
+			return session.InjectKeycode(scrcpy.ActionUp, uint32(msg.Keycode), 0, 0)
+		case "press", "":
+			if err := session.InjectKeycode(scrcpy.ActionDown, uint32(msg.Keycode), 0, 0); err != nil {
+				return err
+			}
+			return session.InjectKeycode(scrcpy.ActionUp, uint32(msg.Keycode), 0, 0)
+		}
+	case "text":
+		return session.InjectText(msg.Text)
+	}
+	return fmt.Errorf("unsupported control %s %s", msg.Type, msg.Action)
+}
+
+// controlAdb turns control messages into `input` commands. Touches are only
+// dispatched on up, as a tap or a swipe from the down position.
+func (st *androidStream) controlAdb(msg streamControl) error {
+	switch msg.Type {
+	case "touch":
+		st.mu.Lock()
+		w, h := float64(st.screenW), float64(st.screenH)
+		start, ok := st.touches[msg.PointerID]
+		switch msg.Action {
+		case "down":
+			st.touches[msg.PointerID] = touchStart{x: msg.X, y: msg.Y, at: time.Now()}
+			st.mu.Unlock()
+			return nil
+		case "move":
+			st.mu.Unlock()
+			return nil
+		}
+		delete(st.touches, msg.PointerID)
+		st.mu.Unlock()
+		if msg.Action != "up" {
+			break
+		}
+		if !ok || w == 0 {
+			return errors.New("touch up without down")
+		}
+		duration := time.Since(start.at)
+		if math.Hypot(msg.X-start.x, msg.Y-start.y) < tapMaxDistance && duration < tapMaxDuration {
+			return androidTap(st.device, int(start.x*w), int(start.y*h))
+		}
+		return androidSwipe(st.device, int(start.x*w), int(start.y*h), int(msg.X*w), int(msg.Y*h), int(duration.Milliseconds()))
+	case "key":
+		if msg.Action == "down" {
+			return nil
+		}
+		return androidKey(st.device, strconv.Itoa(msg.Keycode), false)
+	case "text":
+		return androidText(st.device, msg.Text)
+	}
+	return fmt.Errorf("unsupported control %s %s", msg.Type, msg.Action)
+}
+
+// streamJpeg captures the screen over adb and sends JPEG frames. The frame
+// rate follows how fast frames can be captured, resolution and quality drop
+// while sending frames is slow and recover once it is fast again.
+func (st *androidStream) streamJpeg(ctx context.Context) error {
+	target := st.currentOptions()
+	maxSize, quality := target.MaxSize, target.Quality
+	var last []byte
+	fastFrames, frames := 0, 0
+	statsAt := time.Now()
+	for ctx.Err() == nil {
+		started := time.Now()
+		target = st.currentOptions()
+		maxSize, quality = min(maxSize, target.MaxSize), min(quality, target.Quality)
+		interval := time.Second / time.Duration(target.Fps)
+
+		img, err := captureAndroidScreen(st.device)
+		if err != nil {
+			return err
+		}
+		bounds := img.Bounds()
+		st.mu.Lock()
+		st.screenW, st.screenH = bounds.Dx(), bounds.Dy()
+		st.mu.Unlock()
+
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, imageutil.Fit(img, maxSize), &jpeg.Options{Quality: quality}); err != nil {
+			return err
+		}
+		// 画面没有变化时不发送
+		var writeTime time.Duration
+		if !bytes.Equal(buf.Bytes(), last) {
+			writeStart := time.Now()
+			if err := st.writeBinary(buf.Bytes()); err != nil {
+				return err
+			}
+			writeTime = time.Since(writeStart)
+			last = buf.Bytes()
+			frames++
+		}
+
+		switch {
+		case writeTime > interval/2:
+			maxSize = max(minStreamMaxSize, maxSize*3/4)
+			quality = max(minStreamQuality, quality-10)
+			fastFrames = 0
+		case writeTime < interval/8:
+			fastFrames++
+			if fastFrames >= streamUpgradeFrames {
+				maxSize = min(target.MaxSize, maxSize*4/3)
+				quality = min(target.Quality, quality+10)
+				fastFrames = 0
+			}
+		}
+
+		if since := time.Since(statsAt); since >= streamStatsInterval {
+			st.writeJSON(gin.H{"type": "stats", "fps": float64(frames) / since.Seconds(), "max_size": maxSize, "quality": quality})
+			frames, statsAt = 0, time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-st.configCh:
+		case <-time.After(interval - time.Since(started)):
+		}
+	}
+	return nil
+}
+
+// captureAndroidScreen prefers raw screencap output, which is much faster
+// than encoding and decoding PNG on slow devices.
+func captureAndroidScreen(device adb.Device) (image.Image, error) {
+	raw, err := device.RunShellCommandWithBytes("screencap")
+	if err == nil {
+		if img, err := imageutil.DecodeScreencap(raw); err == nil {
+			return img, nil
+		}
+	}
+	return device.Screenshot()
+}
+
+// streamH264 relays the scrcpy video stream. When packets pile up because the
+// client is too slow, scrcpy is restarted with a lower resolution and bit rate.
+func (st *androidStream) streamH264(ctx context.Context) error {
+	options := st.currentOptions()
+	for ctx.Err() == nil {
+		session, err := scrcpy.Start(ctx, st.device, st.s.config.ScrcpyServer, st.s.config.ScrcpyVersion, scrcpy.Options{
+			MaxSize: options.MaxSize,
+			MaxFps:  options.Fps,
+			BitRate: options.BitRate,
+		})
+		if err != nil {
+			return err
+		}
+		st.mu.Lock()
+		st.session = session
+		st.mu.Unlock()
+
+		cause := st.relayPackets(ctx, session, options)
+		session.Close()
+		st.mu.Lock()
+		st.session = nil
+		st.mu.Unlock()
+
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(cause, errStreamOverload):
+			options.MaxSize = max(minStreamMaxSize, options.MaxSize*3/4)
+			options.BitRate = max(minStreamBitRate, options.BitRate/2)
+			st.s.logger.Info("stream degraded", zap.String("serial", st.device.Serial()),
+				zap.Int("maxSize", options.MaxSize), zap.Int("bitRate", options.BitRate))
+		case errors.Is(cause, errStreamReconfigure):
+			options = st.currentOptions()
+		default:
+			return cause
+		}
+	}
+	return nil
+}
+
+// relayPackets sends the packets of session until it fails, the client is
+// too slow or the options change, and returns why it stopped.
+func (st *androidStream) relayPackets(ctx context.Context, session *scrcpy.Session, options streamOptions) error {
+	meta := session.Meta()
+	if err := st.writeJSON(gin.H{"type": "meta", "meta": meta, "options": options}); err != nil {
+		return err
+	}
+
+	queue := make(chan scrcpy.Packet, streamPacketQueue)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			packet, err := session.ReadPacket()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case queue <- packet:
+			default:
+				readErr <- errStreamOverload
+				return
+			}
+		}
+	}()
+
+	header := make([]byte, 8)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-st.configCh:
+			return errStreamReconfigure
+		case err := <-readErr:
+			return err
+		case packet := <-queue:
+			flags := packet.PTS
+			if packet.Config {
+				flags |= 1 << 63
+			}
+			if packet.KeyFrame {
+				flags |= 1 << 62
+			}
+			binary.BigEndian.PutUint64(header, flags)
+			if err := st.writeBinary(append(header, packet.Data...)); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	s := &Server{config: &Config{AllowedOrigins: []string{"http://127.0.0.1:3000/"}}}
+	tests := []struct {
+		name   string
+		origin string
+		want   bool
+	}{
+		{"no origin", "", true},
+		{"same origin", "http://devices.local:15037", true},
+		{"same origin other case", "http://DEVICES.local:15037", true},
+		{"allowed", "http://127.0.0.1:3000", true},
+		{"other port", "http://devices.local:8080", false},
+		{"other site", "https://example.com", false},
+		{"allowed host other scheme", "https://127.0.0.1:3000", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://devices.local:15037/api/android/stream", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := s.checkOrigin(r); got != tt.want {
+				t.Errorf("checkOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 剪贴板内容类型，url 只在 iOS 上与 text 不同
+const (
+	clipboardText  = "text"
+	clipboardImage = "image"
+	clipboardURL   = "url"
+
+	maxClipboardSize = 10 << 20
+
+	clipperPackage = "ca.zgrs.clipper"
+	clipperService = clipperPackage + "/.ClipboardService"
+
+	// 剪贴板图片先放进媒体库，其他应用通过 content URI 读取
+	androidClipboardImageDir = "/sdcard/Pictures"
+	androidMediaImages       = "content://media/external/images/media"
+	mediaScanAttempts        = 10
+	mediaScanInterval        = 300 * time.Millisecond
+
+	codeClipboardUnsupported = "clipboard_unsupported"
+	codeNoClipper            = "clipper_not_installed"
+	codeClipboardNoAccess    = "clipboard_not_readable"
+)
+
+var (
+	clipperDataPattern = regexp.MustCompile(`(?s)result=(-?\d+)(?:, data="(.*)")?\s*$`)
+	errNoClipper       = errors.New("the Android clipboard needs clipper (" + clipperPackage + ") installed on the device")
+	errClipboardImage  = errors.New("clipper on the device only copies text, images need a build that sets a clip from the uri extra")
+	errImageNotScanned = errors.New("the media scanner did not pick up the image")
+	mediaIDPattern     = regexp.MustCompile(`_id=(\d+)`)
+	errClipperNoAccess = errors.New("clipper could not read the clipboard, since Android 10 it has to be in the foreground")
+	errNotAnImage      = errors.New("content is not an image")
+)
+
+// wdaPasteboardTypes are the content types of WDA's pasteboard endpoints
+var wdaPasteboardTypes = map[string]string{
+	clipboardText:  "plaintext",
+	clipboardImage: "image",
+	clipboardURL:   "url",
+}
+
+// Clipboard is the content of the clipboard, images are base64 encoded.
+type Clipboard struct {
+	Type    string `json:"type" binding:"omitempty,oneof=text image url"`
+	Content string `json:"content"`
+}
+
+// hGetClipboard returns the text of the clipboard, type=image returns the
+// image itself. iOS reads the pasteboard through WDA, which may need to be
+// in the foreground on newer versions. On Android an image is a clip with a
+// content URI, which is read with `content read`.
+func (s *Server) hGetClipboard(c *gin.Context) {
+	udid := c.Param("udid")
+	contentType := c.DefaultQuery("type", clipboardText)
+	if _, ok := wdaPasteboardTypes[contentType]; !ok {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "type must be text, image or url"})
+		return
+	}
+
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	var data []byte
+	var err error
+	if _, ok := s.iosDevice(udid); ok {
+		if s.tunnelRequired(udid) {
+			c.JSON(http.StatusServiceUnavailable, GenericResponse{Error: errTunnelRequired.Error()})
+			return
+		}
+		data, err = s.wdaPasteboard(ctx, udid, contentType)
+	} else if device, ok := s.androidDeviceBySerial(udid); ok {
+		if contentType == clipboardImage {
+			data, err = androidClipboardImage(device)
+		} else {
+			var text string
+			text, err = androidClipboard(device)
+			data = []byte(text)
+		}
+	} else {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: errDeviceNotFound.Error()})
+		return
+	}
+	if err != nil {
+		s.logger.Warn("failed to get clipboard", zap.String("udid", udid), zap.Error(err))
+		clipboardError(c, err)
+		return
+	}
+
+	if contentType == clipboardImage {
+		if len(data) == 0 {
+			c.JSON(http.StatusNotFound, GenericResponse{Error: "clipboard has no image"})
+			return
+		}
+		c.Data(http.StatusOK, http.DetectContentType(data), data)
+		return
+	}
+	c.JSON(http.StatusOK, Clipboard{Type: contentType, Content: string(data)})
+}
+
+// hSetClipboard puts text or an image on the clipboard. The body is a
+// Clipboard or a multipart form with the image as "file".
+func (s *Server) hSetClipboard(c *gin.Context) {
+	udid := c.Param("udid")
+	clipboard, data, err := readClipboardRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	if _, ok := s.iosDevice(udid); ok {
+		if s.tunnelRequired(udid) {
+			c.JSON(http.StatusServiceUnavailable, GenericResponse{Error: errTunnelRequired.Error()})
+			return
+		}
+		err = s.setWdaPasteboard(ctx, udid, clipboard.Type, data)
+	} else if device, ok := s.androidDeviceBySerial(udid); ok {
+		if clipboard.Type == clipboardImage {
+			err = setAndroidClipboardImage(device, data)
+		} else {
+			err = setAndroidClipboard(device, string(data))
+		}
+	} else {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: errDeviceNotFound.Error()})
+		return
+	}
+	if err != nil {
+		s.logger.Warn("failed to set clipboard", zap.String("udid", udid), zap.String("type", clipboard.Type), zap.Error(err))
+		clipboardError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, GenericResponse{Message: fmt.Sprintf("copied %s of %d bytes", clipboard.Type, len(data))})
+}
+
+// readClipboardRequest returns the clipboard of the request with its
+// content decoded.
+func readClipboardRequest(c *gin.Context) (Clipboard, []byte, error) {
+	var clipboard Clipboard
+	var data []byte
+	if c.ContentType() == gin.MIMEMultipartPOSTForm {
+		file, err := c.FormFile("file")
+		if err != nil {
+			return clipboard, nil, err
+		}
+		if file.Size > maxClipboardSize {
+			return clipboard, nil, fmt.Errorf("file is larger than %d bytes", maxClipboardSize)
+		}
+		f, err := file.Open()
+		if err != nil {
+			return clipboard, nil, err
+		}
+		defer f.Close()
+		if data, err = io.ReadAll(f); err != nil {
+			return clipboard, nil, err
+		}
+		clipboard.Type = clipboardImage
+	} else {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, 2*maxClipboardSize)
+		if err := c.ShouldBindJSON(&clipboard); err != nil {
+			return clipboard, nil, err
+		}
+		if clipboard.Type == "" {
+			clipboard.Type = clipboardText
+		}
+		data = []byte(clipboard.Content)
+		if clipboard.Type == clipboardImage {
+			var err error
+			if data, err = base64.StdEncoding.DecodeString(clipboard.Content); err != nil {
+				return clipboard, nil, fmt.Errorf("image content must be base64: %w", err)
+			}
+		}
+	}
+	if clipboard.Type == clipboardImage {
+		if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+			return clipboard, nil, errNotAnImage
+		}
+	}
+	return clipboard, data, nil
+}
+
+func clipboardError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errClipboardImage):
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error(), Code: codeClipboardUnsupported})
+	case errors.Is(err, errClipperNoAccess):
+		c.JSON(http.StatusServiceUnavailable, GenericResponse{Error: err.Error(), Code: codeClipboardNoAccess})
+	case errors.Is(err, errNoClipper):
+		c.JSON(http.StatusServiceUnavailable, GenericResponse{Error: err.Error(), Code: codeNoClipper})
+	default:
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+	}
+}
+
+// wdaPasteboard reads the pasteboard, WDA returns the content base64 encoded.
+func (s *Server) wdaPasteboard(ctx context.Context, udid, contentType string) ([]byte, error) {
+	var content string
+	err := s.wdaSessionRequest(ctx, udid, http.MethodPost, "/wda/getPasteboard", gin.H{"contentType": wdaPasteboardTypes[contentType]}, &content)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(content)
+}
+
+func (s *Server) setWdaPasteboard(ctx context.Context, udid, contentType string, data []byte) error {
+	return s.wdaSessionRequest(ctx, udid, http.MethodPost, "/wda/setPasteboard", gin.H{
+		"content":     base64.StdEncoding.EncodeToString(data),
+		"contentType": wdaPasteboardTypes[contentType],
+	}, nil)
+}
+
+// androidClipboard reads the clipboard through clipper's broadcast receiver.
+// Since Android 10 only the focused app may read the clipboard, clipper then
+// gets nothing unless it is in the foreground.
+func androidClipboard(device adb.Device) (string, error) {
+	output, err := clipperBroadcast(device, "clipper.get")
+	if err != nil {
+		return "", err
+	}
+	match := clipperDataPattern.FindStringSubmatch(strings.TrimSpace(output))
+	if match == nil {
+		return "", fmt.Errorf("unexpected output of clipper: %s", strings.TrimSpace(output))
+	}
+	// 非 RESULT_OK 时 clipper 没有读到剪贴板，data 不可信
+	if match[1] != "-1" {
+		return "", errClipperNoAccess
+	}
+	return match[2], nil
+}
+
+func setAndroidClipboard(device adb.Device, text string) error {
+	output, err := clipperBroadcast(device, "clipper.set", "-e", "text", shellQuote(text))
+	if err != nil {
+		return err
+	}
+	// clipper 成功时返回 RESULT_OK(-1)
+	if match := clipperDataPattern.FindStringSubmatch(strings.TrimSpace(output)); match == nil || match[1] != "-1" {
+		return fmt.Errorf("clipper did not set the clipboard: %s", strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// androidClipboardImage returns the image the clip points to, nothing if the
+// clip is no content URI. ClipboardManager.getText of clipper turns a URI
+// clip into the URI.
+func androidClipboardImage(device adb.Device) ([]byte, error) {
+	text, err := androidClipboard(device)
+	if err != nil {
+		return nil, err
+	}
+	uri := strings.TrimSpace(text)
+	if !strings.HasPrefix(uri, "content://") {
+		return nil, nil
+	}
+	// 二进制内容经过 shell 输出可能被转换换行，先写到文件再拉取
+	remote := fmt.Sprintf("%s/gia-clipboard-%d", androidTmpDir, time.Now().UnixNano())
+	defer device.RunShellCommand("rm", "-f", remote)
+	output, err := device.RunShellCommand("content", "read", "--uri", shellQuote(uri), ">", remote)
+	if err != nil {
+		return nil, err
+	}
+	if output = strings.TrimSpace(output); output != "" {
+		return nil, fmt.Errorf("content read %s: %s", uri, output)
+	}
+	var buf bytes.Buffer
+	if err := device.Pull(remote, &buf); err != nil {
+		return nil, err
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(buf.Bytes())); err != nil {
+		return nil, errNotAnImage
+	}
+	return buf.Bytes(), nil
+}
+
+// setAndroidClipboardImage adds the image to the media store and has
+// clipper set a clip with its content URI, which needs a clipper build that
+// handles the uri extra of clipper.set.
+func setAndroidClipboardImage(device adb.Device, data []byte) error {
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return errNotAnImage
+	}
+	remote := fmt.Sprintf("%s/gia-clipboard-%d.%s", androidClipboardImageDir, time.Now().UnixNano(), format)
+	if err := device.Push(bytes.NewReader(data), remote, time.Now(), 0644); err != nil {
+		return err
+	}
+	uri, err := scanAndroidImage(device, remote)
+	if err != nil {
+		device.RunShellCommand("rm", "-f", remote)
+		return err
+	}
+	output, err := clipperBroadcast(device, "clipper.set", "-e", "uri", shellQuote(uri))
+	if err != nil {
+		return err
+	}
+	// 不支持 uri 的 clipper 没有 text 时返回 RESULT_CANCELED(0)
+	if match := clipperDataPattern.FindStringSubmatch(strings.TrimSpace(output)); match == nil || match[1] != "-1" {
+		return errClipboardImage
+	}
+	return nil
+}
+
+// scanAndroidImage has the media scanner add the file and returns its
+// content URI.
+func scanAndroidImage(device adb.Device, path string) (string, error) {
+	_, err := device.RunShellCommand("am", "broadcast", "-a", "android.intent.action.MEDIA_SCANNER_SCAN_FILE", "-d", "file://"+path)
+	if err != nil {
+		return "", err
+	}
+	where := shellQuote("_data='" + path + "'")
+	for attempt := 0; attempt < mediaScanAttempts; attempt++ {
+		output, err := device.RunShellCommand("content", "query", "--uri", androidMediaImages, "--projection", "_id", "--where", where)
+		if err != nil {
+			return "", err
+		}
+		if match := mediaIDPattern.FindStringSubmatch(output); match != nil {
+			return androidMediaImages + "/" + match[1], nil
+		}
+		time.Sleep(mediaScanInterval)
+	}
+	return "", errImageNotScanned
+}
+
+// clipperBroadcast sends an action to clipper, its service is started first
+// as older versions only register the receiver from it.
+func clipperBroadcast(device adb.Device, action string, extras ...string) (string, error) {
+	packages, err := device.RunShellCommand("pm", "list", "packages", clipperPackage)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(packages, clipperPackage) {
+		return "", errNoClipper
+	}
+	device.RunShellCommand("am", "startservice", clipperService)
+	return device.RunShellCommand("am", append([]string{"broadcast", "-a", action}, extras...)...)
+}
@@ -0,0 +1,344 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultElementTimeout  = 10 * time.Second
+	defaultElementInterval = 500 * time.Millisecond
+	maxElementTimeout      = 5 * time.Minute
+
+	codeElementNotFound = "element_not_found"
+)
+
+var (
+	errInvalidElementQuery = errors.New("invalid element query")
+	errElementNoBounds     = errors.New("element has no bounds")
+)
+
+// ElementTapRequest locates an element in the hierarchy of source and taps
+// its center. Each source takes its own locators, a Poco selector works
+// with all of them.
+type ElementTapRequest struct {
+	Source      string `json:"source" binding:"required,oneof=poco wda uiautomator"`
+	Selector    string `json:"selector"`
+	XPath       string `json:"xpath"`        // wda、uiautomator
+	Predicate   string `json:"predicate"`    // wda
+	ClassChain  string `json:"class_chain"`  // wda
+	ResourceID  string `json:"resource_id"`  // uiautomator
+	Text        string `json:"text"`         // uiautomator
+	Class       string `json:"class"`        // uiautomator
+	ContentDesc string `json:"content_desc"` // uiautomator
+	Index       int    `json:"index" binding:"min=0"`
+	Port        string `json:"port"`     // poco：SDK 端口或引擎名，默认 unity
+	Timeout     int    `json:"timeout"`  // 毫秒，等待元素出现的时长
+	Interval    int    `json:"interval"` // 毫秒，查找的间隔
+	Duration    int    `json:"duration"` // 毫秒，大于 0 时长按
+}
+
+// ElementTapResponse is the tapped element, the coordinates are pixels on
+// Android and points, the coordinates of WDA, on iOS.
+type ElementTapResponse struct {
+	Platform string     `json:"platform"`
+	Element  *poco.Node `json:"element"`
+	X        int        `json:"x"`
+	Y        int        `json:"y"`
+	Rect     poco.Rect  `json:"rect"`
+	Attempts int        `json:"attempts"`
+	Elapsed  int64      `json:"elapsed"` // 毫秒
+}
+
+// elementTarget finds elements with one source on a device and taps them.
+type elementTarget struct {
+	platform string
+	fetch    func(ctx context.Context) (*poco.Node, error)
+	query    func(root *poco.Node) ([]*poco.Node, error)
+	// screen returns the size of the screen in the coordinates of tap
+	screen func(ctx context.Context) (width, height float64, err error)
+	tap    func(ctx context.Context, x, y int, duration time.Duration) error
+	// release frees the resources of the target, e.g. the Poco client
+	release func()
+}
+
+// hTapElement waits for the element to appear and taps it on the platform
+// of the device.
+func (s *Server) hTapElement(c *gin.Context) {
+	udid := c.Param("udid")
+	var req ElementTapRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	timeout, interval := elementWaitOptions(req)
+
+	var target *elementTarget
+	var err error
+	if device, ok := s.iosDevice(udid); ok {
+		if s.tunnelRequired(udid) {
+			c.JSON(http.StatusServiceUnavailable, GenericResponse{Error: errTunnelRequired.Error()})
+			return
+		}
+		target, err = s.iosElementTarget(device, req)
+	} else if device, ok := s.androidDeviceBySerial(udid); ok {
+		target, err = s.androidElementTarget(device, req)
+	} else {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: errDeviceNotFound.Error()})
+		return
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errInvalidElementQuery) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, GenericResponse{Error: err.Error()})
+		return
+	}
+	defer target.release()
+	// 查询有语法错误时不必等到超时
+	if _, err := target.query(&poco.Node{Payload: map[string]interface{}{}}); err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	started := time.Now()
+	node, attempts, err := target.wait(ctx, req.Index, timeout, interval)
+	if err != nil {
+		s.logger.Warn("failed to locate element", zap.String("udid", udid), zap.String("source", req.Source), zap.Error(err))
+		// Poco 的连接错误和超时按 pocoError 的状态码返回，其他为 500
+		pocoError(c, err)
+		return
+	}
+	if node == nil {
+		c.JSON(http.StatusNotFound, GenericResponse{
+			Error: fmt.Sprintf("no element found within %s", timeout),
+			Code:  codeElementNotFound,
+		})
+		return
+	}
+	x, y, rect, err := target.center(ctx, node)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errElementNoBounds) {
+			status = http.StatusUnprocessableEntity
+		}
+		c.JSON(status, GenericResponse{Error: err.Error()})
+		return
+	}
+	if err := target.tap(ctx, x, y, time.Duration(req.Duration)*time.Millisecond); err != nil {
+		s.logger.Error("failed to tap element", zap.String("udid", udid), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	s.recordMacroAction(udid, touchMacroAction(float64(x), float64(y), float64(x), float64(y), time.Duration(req.Duration)*time.Millisecond, false))
+	c.JSON(http.StatusOK, ElementTapResponse{
+		Platform: target.platform,
+		Element:  node.Leaf(),
+		X:        x,
+		Y:        y,
+		Rect:     rect,
+		Attempts: attempts,
+		Elapsed:  time.Since(started).Milliseconds(),
+	})
+}
+
+// elementWaitOptions returns the timeout and interval of the request with
+// their defaults.
+func elementWaitOptions(req ElementTapRequest) (timeout, interval time.Duration) {
+	timeout = defaultElementTimeout
+	if req.Timeout > 0 {
+		timeout = min(time.Duration(req.Timeout)*time.Millisecond, maxElementTimeout)
+	}
+	interval = defaultElementInterval
+	if req.Interval > 0 {
+		interval = time.Duration(req.Interval) * time.Millisecond
+	}
+	return timeout, interval
+}
+
+// center returns the center of node in the coordinates of tap and its
+// bounds in those of the screen.
+func (t *elementTarget) center(ctx context.Context, node *poco.Node) (x, y int, rect poco.Rect, err error) {
+	frame, ok := node.Frame()
+	if !ok {
+		return 0, 0, rect, errElementNoBounds
+	}
+	width, height, err := t.screen(ctx)
+	if err != nil {
+		return 0, 0, rect, err
+	}
+	cx, cy := frame.Center()
+	return int(math.Round(cx * width)), int(math.Round(cy * height)), frame.Scale(width, height), nil
+}
+
+// wait looks for the element every interval until it is found or timeout
+// passed. The node is nil if there was no match, the error is the last one
+// getting the hierarchy if that never succeeded.
+func (t *elementTarget) wait(ctx context.Context, index int, timeout, interval time.Duration) (*poco.Node, int, error) {
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	fetched := false
+	for attempts := 1; ; attempts++ {
+		root, err := t.fetch(ctx)
+		if err == nil {
+			fetched = true
+			var nodes []*poco.Node
+			if nodes, err = t.query(root); err == nil && index < len(nodes) {
+				return nodes[index], attempts, nil
+			}
+		}
+		if err != nil {
+			lastErr = err
+		}
+		wait := min(interval, time.Until(deadline))
+		if wait <= 0 {
+			if fetched {
+				return nil, attempts, nil
+			}
+			return nil, attempts, lastErr
+		}
+		select {
+		case <-ctx.Done():
+			return nil, attempts, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (s *Server) iosElementTarget(device ios.DeviceEntry, req ElementTapRequest) (*elementTarget, error) {
+	udid := device.Properties.SerialNumber
+	target := &elementTarget{
+		platform: "ios",
+		screen: func(ctx context.Context) (float64, float64, error) {
+			return s.wdaWindowSize(ctx, udid)
+		},
+		tap: func(ctx context.Context, x, y int, duration time.Duration) error {
+			return s.wdaTap(ctx, udid, float64(x), float64(y), duration)
+		},
+		release: func() {},
+	}
+	if err := req.checkLocator("ios"); err != nil {
+		return nil, err
+	}
+	switch req.Source {
+	case "poco":
+		return s.pocoElementTarget(target, req, func(port int) (*poco.PocoClient, func(), error) {
+			return s.iosPocoClient(device, port)
+		})
+	case "wda":
+		query := IosElementQuery{Predicate: req.Predicate, ClassChain: req.ClassChain, XPath: req.XPath, Selector: req.Selector}
+		target.fetch = func(ctx context.Context) (*poco.Node, error) {
+			return s.iosHierarchy(ctx, udid)
+		}
+		target.query = func(root *poco.Node) ([]*poco.Node, error) {
+			return findIosElements(root, query)
+		}
+		return target, nil
+	}
+	return nil, fmt.Errorf("%w: source %s is not available on iOS", errInvalidElementQuery, req.Source)
+}
+
+func (s *Server) androidElementTarget(device adb.Device, req ElementTapRequest) (*elementTarget, error) {
+	target := &elementTarget{
+		platform: "android",
+		screen: func(context.Context) (float64, float64, error) {
+			screen, err := androidScreenInfo(device)
+			return float64(screen.width), float64(screen.height), err
+		},
+		tap: func(_ context.Context, x, y int, duration time.Duration) error {
+			if duration > 0 {
+				return androidSwipe(device, x, y, x, y, int(duration.Milliseconds()))
+			}
+			return androidTap(device, x, y)
+		},
+		release: func() {},
+	}
+	if err := req.checkLocator("android"); err != nil {
+		return nil, err
+	}
+	switch req.Source {
+	case "poco":
+		return s.pocoElementTarget(target, req, func(port int) (*poco.PocoClient, func(), error) {
+			return s.androidPocoClient(device, port)
+		})
+	case "uiautomator":
+		query := AndroidElementQuery{
+			XPath:       req.XPath,
+			Selector:    req.Selector,
+			ResourceID:  req.ResourceID,
+			Text:        req.Text,
+			Class:       req.Class,
+			ContentDesc: req.ContentDesc,
+		}
+		target.fetch = func(context.Context) (*poco.Node, error) {
+			return androidHierarchy(device)
+		}
+		target.query = func(root *poco.Node) ([]*poco.Node, error) {
+			return findAndroidElements(root, query)
+		}
+		return target, nil
+	}
+	return nil, fmt.Errorf("%w: source %s is not available on Android", errInvalidElementQuery, req.Source)
+}
+
+// checkLocator reports why the request cannot locate an element on the
+// platform, each source only understands some of the locators.
+func (req ElementTapRequest) checkLocator(platform string) error {
+	switch {
+	case req.Source == "poco":
+		if req.Selector == "" {
+			return fmt.Errorf("%w: poco needs a selector", errInvalidElementQuery)
+		}
+	case req.Source == "wda" && platform == "ios":
+		if req.Predicate == "" && req.ClassChain == "" && req.XPath == "" && req.Selector == "" {
+			return fmt.Errorf("%w: one of predicate, class_chain, xpath or selector is required", errInvalidElementQuery)
+		}
+	case req.Source == "uiautomator" && platform == "android":
+		if req.XPath == "" && req.Selector == "" && req.ResourceID == "" && req.Text == "" && req.Class == "" && req.ContentDesc == "" {
+			return fmt.Errorf("%w: one of xpath, selector, resource_id, text, class or content_desc is required", errInvalidElementQuery)
+		}
+	case platform == "ios":
+		return fmt.Errorf("%w: source %s is not available on iOS", errInvalidElementQuery, req.Source)
+	default:
+		return fmt.Errorf("%w: source %s is not available on Android", errInvalidElementQuery, req.Source)
+	}
+	return nil
+}
+
+// pocoElementTarget finds elements in the dump of the Poco SDK, taps still
+// go through the platform as the SDK may not implement them.
+func (s *Server) pocoElementTarget(target *elementTarget, req ElementTapRequest, client func(port int) (*poco.PocoClient, func(), error)) (*elementTarget, error) {
+	portParam := req.Port
+	if portParam == "" {
+		portParam = "unity"
+	}
+	port, err := pocoPort(portParam)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid port %s", errInvalidElementQuery, portParam)
+	}
+	pocoClient, release, err := client(port)
+	if err != nil {
+		return nil, err
+	}
+	target.release = release
+	target.fetch = func(context.Context) (*poco.Node, error) {
+		return pocoClient.DumpTree(true)
+	}
+	target.query = func(root *poco.Node) ([]*poco.Node, error) {
+		return poco.QuerySelector(root, req.Selector, true)
+	}
+	return target, nil
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+var errFFmpegNotConfigured = errors.New("ffmpeg is not configured, start the server with --ffmpeg")
+
+// ffmpeg runs the configured ffmpeg binary, its output is part of the error.
+func (s *Server) ffmpeg(ctx context.Context, args ...string) error {
+	if s.config.FFmpeg == "" {
+		return errFFmpegNotConfigured
+	}
+	cmd := exec.CommandContext(ctx, s.config.FFmpeg, append([]string{"-hide_banner", "-loglevel", "error", "-y"}, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, out)
+	}
+	return nil
+}
+
+// ffmpegPipe feeds input to ffmpeg on stdin and returns what it writes to
+// stdout, args have to read from pipe:0 and write to pipe:1.
+func (s *Server) ffmpegPipe(ctx context.Context, input []byte, args ...string) ([]byte, error) {
+	if s.config.FFmpeg == "" {
+		return nil, errFFmpegNotConfigured
+	}
+	cmd := exec.CommandContext(ctx, s.config.FFmpeg, append([]string{"-hide_banner", "-loglevel", "error"}, args...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, stderr.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
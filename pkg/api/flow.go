@@ -0,0 +1,399 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"reflect"
+	"time"
+
+	"github.com/antchfx/xpath"
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+	"github.com/blacklee123/go-ios-android/pkg/utils/wda"
+	"gopkg.in/yaml.v3"
+)
+
+// flow 步骤类型
+const (
+	flowInstall    = "install"
+	flowLaunch     = "launch"
+	flowWait       = "wait"
+	flowTap        = "tap"
+	flowType       = "type"
+	flowAssertText = "assert_text"
+	flowScreenshot = "screenshot"
+	flowPull       = "pull"
+	flowSleep      = "sleep"
+
+	maxFlowSize  = 1 << 20
+	maxFlowSteps = 500
+	maxFlowSleep = 10 * time.Minute
+)
+
+var errInvalidFlow = errors.New("invalid flow")
+
+// flowActions maps the step types to the argument a scalar value sets, e.g.
+// `- launch: com.example.app` sets app.
+var flowActions = map[string]string{
+	flowInstall:    "url",
+	flowLaunch:     "app",
+	flowWait:       "selector",
+	flowTap:        "selector",
+	flowType:       "text",
+	flowAssertText: "selector",
+	flowScreenshot: "name",
+	flowPull:       "path",
+	flowSleep:      "duration",
+}
+
+// Flow is a declarative script run step by step on every device of a run,
+// written in YAML:
+//
+//	name: login smoke test
+//	apps:
+//	  ios: com.example.app
+//	  android: com.example.app
+//	steps:
+//	  - install: https://example.com/app.ipa
+//	    platform: ios
+//	  - launch
+//	  - tap: {selector: 'poco(text="Log in")', timeout: 20000}
+//	  - type: secret
+//	  - assert_text: {selector: 'poco(name="welcome")', contains: Hello}
+//	  - screenshot: home
+type Flow struct {
+	Name string `json:"name" yaml:"name"`
+	// Apps 按平台给出 launch 默认的应用
+	Apps            map[string]string `json:"apps,omitempty" yaml:"apps"`
+	ContinueOnError bool              `json:"continue_on_error,omitempty" yaml:"continue_on_error"`
+	// ScreenshotOnFailure 默认为 true，失败的步骤附上截图
+	ScreenshotOnFailure *bool      `json:"screenshot_on_failure,omitempty" yaml:"screenshot_on_failure"`
+	Steps               []FlowStep `json:"steps" yaml:"steps"`
+}
+
+// FlowStep is one action, Platform limits it to the devices of a platform.
+type FlowStep struct {
+	Action   string `json:"action"`
+	Name     string `json:"name,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	FlowStepArgs
+}
+
+// FlowStepArgs are the arguments of all step types. The element of wait, tap
+// and assert_text is located like ElementTapRequest, by default with wda on
+// iOS and uiautomator on Android, where a Poco selector works on both.
+type FlowStepArgs struct {
+	Source      string `json:"source,omitempty" yaml:"source"`
+	Selector    string `json:"selector,omitempty" yaml:"selector"`
+	XPath       string `json:"xpath,omitempty" yaml:"xpath"`
+	Predicate   string `json:"predicate,omitempty" yaml:"predicate"`
+	ClassChain  string `json:"class_chain,omitempty" yaml:"class_chain"`
+	ResourceID  string `json:"resource_id,omitempty" yaml:"resource_id"`
+	Text        string `json:"text,omitempty" yaml:"text"` // type 时为输入的文本
+	Class       string `json:"class,omitempty" yaml:"class"`
+	ContentDesc string `json:"content_desc,omitempty" yaml:"content_desc"`
+	Index       int    `json:"index,omitempty" yaml:"index"`
+	Port        string `json:"port,omitempty" yaml:"port"`
+	Timeout     int    `json:"timeout,omitempty" yaml:"timeout"`   // 毫秒
+	Interval    int    `json:"interval,omitempty" yaml:"interval"` // 毫秒
+
+	// tap 按坐标点击，iOS 为 point，Android 为像素
+	X *float64 `json:"x,omitempty" yaml:"x"`
+	Y *float64 `json:"y,omitempty" yaml:"y"`
+	// 毫秒，tap 时大于 0 为长按，sleep 的时长
+	Duration int `json:"duration,omitempty" yaml:"duration"`
+
+	// install 的安装包，http(s) 地址或随 flow 上传的文件名
+	URL string `json:"url,omitempty" yaml:"url"`
+	App string `json:"app,omitempty" yaml:"app"`
+
+	Equals   string `json:"equals,omitempty" yaml:"equals"`
+	Contains string `json:"contains,omitempty" yaml:"contains"`
+
+	// pull 的设备路径，iOS 上有 bundle_id 时相对于应用的 Documents
+	Path     string `json:"path,omitempty" yaml:"path"`
+	BundleID string `json:"bundle_id,omitempty" yaml:"bundle_id"`
+}
+
+// flowArgKeys are the yaml keys of FlowStepArgs, unknown keys are rejected
+// so that typos do not silently drop an argument.
+var flowArgKeys = func() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(FlowStepArgs{})
+	for i := 0; i < t.NumField(); i++ {
+		keys[t.Field(i).Tag.Get("yaml")] = true
+	}
+	return keys
+}()
+
+// UnmarshalYAML reads a step written as the action alone (`- launch`), the
+// action with its main argument (`- launch: com.example.app`) or with a
+// mapping of arguments (`- tap: {x: 100, y: 200}`).
+func (step *FlowStep) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		step.Action = value.Value
+		if _, ok := flowActions[step.Action]; !ok {
+			return fmt.Errorf("line %d: unknown step %q", value.Line, step.Action)
+		}
+		return nil
+	case yaml.MappingNode:
+	default:
+		return fmt.Errorf("line %d: a step must be an action or a mapping", value.Line)
+	}
+
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key, arg := value.Content[i], value.Content[i+1]
+		switch key.Value {
+		case "name":
+			if err := arg.Decode(&step.Name); err != nil {
+				return err
+			}
+		case "platform":
+			if err := arg.Decode(&step.Platform); err != nil {
+				return err
+			}
+		default:
+			primary, ok := flowActions[key.Value]
+			if !ok {
+				return fmt.Errorf("line %d: unknown step %q", key.Line, key.Value)
+			}
+			if step.Action != "" {
+				return fmt.Errorf("line %d: step has both %s and %s", key.Line, step.Action, key.Value)
+			}
+			step.Action = key.Value
+			if err := step.decodeArgs(arg, primary); err != nil {
+				return err
+			}
+		}
+	}
+	if step.Action == "" {
+		return fmt.Errorf("line %d: step has no action", value.Line)
+	}
+	return nil
+}
+
+func (step *FlowStep) decodeArgs(arg *yaml.Node, primary string) error {
+	switch arg.Kind {
+	case yaml.ScalarNode:
+		if arg.Tag == "!!null" {
+			return nil
+		}
+		// screenshot 的名字即步骤的名字
+		if primary == "name" {
+			return arg.Decode(&step.Name)
+		}
+		mapping := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: primary},
+			arg,
+		}}
+		return mapping.Decode(&step.FlowStepArgs)
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(arg.Content); i += 2 {
+			key := arg.Content[i]
+			if key.Value == "name" {
+				if err := arg.Content[i+1].Decode(&step.Name); err != nil {
+					return err
+				}
+				continue
+			}
+			if !flowArgKeys[key.Value] {
+				return fmt.Errorf("line %d: unknown argument %q of %s", key.Line, key.Value, step.Action)
+			}
+		}
+		return arg.Decode(&step.FlowStepArgs)
+	}
+	return fmt.Errorf("line %d: arguments of %s must be a value or a mapping", arg.Line, step.Action)
+}
+
+// parseFlow reads and validates a flow, JSON works as well since it is YAML.
+func parseFlow(r io.Reader) (*Flow, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxFlowSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFlowSize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", errInvalidFlow, maxFlowSize)
+	}
+	var flow Flow
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&flow); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: empty", errInvalidFlow)
+		}
+		return nil, fmt.Errorf("%w: %s", errInvalidFlow, err)
+	}
+	if err := validateFlow(&flow); err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidFlow, err)
+	}
+	return &flow, nil
+}
+
+func validateFlow(flow *Flow) error {
+	if len(flow.Steps) == 0 {
+		return errors.New("flow has no steps")
+	}
+	if len(flow.Steps) > maxFlowSteps {
+		return fmt.Errorf("flow has more than %d steps", maxFlowSteps)
+	}
+	for platform := range flow.Apps {
+		if platform != "ios" && platform != "android" {
+			return fmt.Errorf("apps: unknown platform %s", platform)
+		}
+	}
+	for i, step := range flow.Steps {
+		if err := validateFlowStep(flow, step); err != nil {
+			return fmt.Errorf("step %d (%s): %s", i+1, step.Action, err)
+		}
+	}
+	return nil
+}
+
+func validateFlowStep(flow *Flow, step FlowStep) error {
+	if step.Platform != "" && step.Platform != "ios" && step.Platform != "android" {
+		return errors.New("platform must be ios or android")
+	}
+	switch step.Source {
+	case "", "poco", "wda", "uiautomator":
+	default:
+		return errors.New("source must be poco, wda or uiautomator")
+	}
+	if step.Index < 0 || step.Timeout < 0 || step.Interval < 0 || step.Duration < 0 {
+		return errors.New("index, timeout, interval and duration must not be negative")
+	}
+
+	if err := step.compileLocators(); err != nil {
+		return err
+	}
+
+	switch step.Action {
+	case flowInstall:
+		if step.URL == "" {
+			return errors.New("url is required")
+		}
+	case flowLaunch:
+		if step.App != "" {
+			return nil
+		}
+		for _, platform := range []string{"ios", "android"} {
+			if (step.Platform == "" || step.Platform == platform) && flow.Apps[platform] == "" {
+				return fmt.Errorf("app is required as apps has no %s app", platform)
+			}
+		}
+	case flowWait, flowAssertText:
+		if err := step.checkLocator(); err != nil {
+			return err
+		}
+		if step.Action == flowAssertText && step.Equals == "" && step.Contains == "" {
+			return errors.New("equals or contains is required")
+		}
+	case flowTap:
+		if (step.X == nil) != (step.Y == nil) {
+			return errors.New("x and y must be given together")
+		}
+		if step.X == nil {
+			if err := step.checkLocator(); err != nil {
+				return fmt.Errorf("x and y or an element locator are required: %w", err)
+			}
+		}
+	case flowType:
+		if step.Text == "" {
+			return errors.New("text is required")
+		}
+	case flowPull:
+		if step.Path == "" {
+			return errors.New("path is required")
+		}
+	case flowSleep:
+		if step.Duration <= 0 || time.Duration(step.Duration)*time.Millisecond > maxFlowSleep {
+			return fmt.Errorf("duration must be between 1 and %d milliseconds", maxFlowSleep.Milliseconds())
+		}
+	}
+	return nil
+}
+
+// checkLocator checks that the step locates its element with the source it
+// uses on every platform it runs on, text for example only works with
+// uiautomator and so needs platform: android.
+func (step FlowStep) checkLocator() error {
+	for _, platform := range []string{"ios", "android"} {
+		if step.Platform != "" && step.Platform != platform {
+			continue
+		}
+		if err := step.elementRequest(platform).checkLocator(platform); err != nil {
+			return fmt.Errorf("on %s: %w", platform, err)
+		}
+	}
+	return nil
+}
+
+// compileLocators checks the syntax of the locators, so that a typo fails
+// the validation instead of the step on every device.
+func (a FlowStepArgs) compileLocators() error {
+	if a.Selector != "" {
+		if _, err := poco.ParseSelector(a.Selector); err != nil {
+			return err
+		}
+	}
+	if a.XPath != "" {
+		if _, err := xpath.Compile(a.XPath); err != nil {
+			return fmt.Errorf("invalid xpath %q: %w", a.XPath, err)
+		}
+	}
+	if a.Predicate != "" {
+		if _, err := wda.CompilePredicate(a.Predicate); err != nil {
+			return err
+		}
+	}
+	if a.ClassChain != "" {
+		return wda.ValidateClassChain(a.ClassChain)
+	}
+	return nil
+}
+
+// elementRequest turns the locator into the request of hTapElement, with the
+// default source of the platform.
+func (a FlowStepArgs) elementRequest(platform string) ElementTapRequest {
+	source := a.Source
+	if source == "" {
+		source = "uiautomator"
+		if platform == "ios" {
+			source = "wda"
+		}
+	}
+	return ElementTapRequest{
+		Source:      source,
+		Selector:    a.Selector,
+		XPath:       a.XPath,
+		Predicate:   a.Predicate,
+		ClassChain:  a.ClassChain,
+		ResourceID:  a.ResourceID,
+		Text:        a.Text,
+		Class:       a.Class,
+		ContentDesc: a.ContentDesc,
+		Index:       a.Index,
+		Port:        a.Port,
+		Timeout:     a.Timeout,
+		Interval:    a.Interval,
+		Duration:    a.Duration,
+	}
+}
+
+// isRemotePackage reports whether the install url is downloaded rather than
+// uploaded with the flow.
+func isRemotePackage(pkg string) bool {
+	u, err := url.Parse(pkg)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// packageName is the file name of the package behind an install url.
+func packageName(pkg string) string {
+	if u, err := url.Parse(pkg); err == nil && u.Path != "" {
+		pkg = u.Path
+	}
+	return path.Base(pkg)
+}
@@ -0,0 +1,396 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// flow run、设备和步骤的状态
+const (
+	flowStatusRunning = "running"
+	flowStatusPassed  = "passed"
+	flowStatusFailed  = "failed"
+	flowStatusStopped = "stopped"
+	flowStatusSkipped = "skipped"
+)
+
+var (
+	errFlowRunNotFound = errors.New("flow run not found")
+	errFlowRunActive   = errors.New("flow run is still running")
+	errFlowStopped     = errors.New("stopped")
+)
+
+// FlowReport is the result of a run, it grows step by step while the run is
+// going. Screenshots and pulled files are URLs of the run's artifacts.
+type FlowReport struct {
+	ID        string             `json:"id"`
+	Name      string             `json:"name"`
+	Status    string             `json:"status"`
+	Error     string             `json:"error,omitempty"`
+	StartedAt time.Time          `json:"started_at"`
+	Elapsed   int64              `json:"elapsed"` // 毫秒
+	Steps     int                `json:"steps"`
+	Devices   []FlowDeviceReport `json:"devices,omitempty"`
+}
+
+type FlowDeviceReport struct {
+	UDID     string           `json:"udid"`
+	Platform string           `json:"platform"`
+	Status   string           `json:"status"`
+	Elapsed  int64            `json:"elapsed"` // 毫秒
+	Results  []FlowStepResult `json:"results"`
+}
+
+type FlowStepResult struct {
+	Index      int      `json:"index"`
+	Action     string   `json:"action"`
+	Name       string   `json:"name,omitempty"`
+	Status     string   `json:"status"`
+	Error      string   `json:"error,omitempty"`
+	Duration   int64    `json:"duration"` // 毫秒
+	Logs       []string `json:"logs,omitempty"`
+	Screenshot string   `json:"screenshot,omitempty"`
+	Artifact   string   `json:"artifact,omitempty"`
+}
+
+func (r *FlowStepResult) logf(format string, args ...interface{}) {
+	r.Logs = append(r.Logs, time.Now().Format("15:04:05.000 ")+fmt.Sprintf(format, args...))
+}
+
+// flowDevice is a device a flow runs on, only the field of its platform is
+// set.
+type flowDevice struct {
+	udid     string
+	platform string
+	ios      ios.DeviceEntry
+	android  adb.Device
+}
+
+type flowRun struct {
+	mu     sync.Mutex
+	report FlowReport
+	flow   *Flow
+	dir    string
+	// packages are the local files of install steps by url
+	packages map[string]string
+	cancel   context.CancelCauseFunc
+	done     chan struct{}
+}
+
+func (r *flowRun) snapshot() FlowReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := r.report
+	report.Devices = make([]FlowDeviceReport, len(r.report.Devices))
+	for i, device := range r.report.Devices {
+		device.Results = append([]FlowStepResult(nil), device.Results...)
+		report.Devices[i] = device
+	}
+	return report
+}
+
+func (r *flowRun) update(fn func(report *FlowReport)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.report)
+}
+
+// artifactURL is the URL hRetrieveFlowArtifact serves the file at rel of the
+// run's directory under.
+func (r *flowRun) artifactURL(rel string) string {
+	return fmt.Sprintf("/api/flows/runs/%s/artifacts/%s", r.report.ID, filepath.ToSlash(rel))
+}
+
+// hValidateFlow parses the flow and returns it with the steps in their full
+// form.
+func (s *Server) hValidateFlow(c *gin.Context) {
+	flow, _, err := readFlowRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, flow)
+}
+
+// hRunFlow starts the flow on every device of udids. The flow is the body or
+// the "flow" field of a multipart form, whose "files" are packages install
+// steps refer to by name. wait=true returns once the run is done.
+func (s *Server) hRunFlow(c *gin.Context) {
+	var devices []flowDevice
+	seen := make(map[string]bool)
+	for _, udid := range strings.Split(c.Query("udids"), ",") {
+		if udid = strings.TrimSpace(udid); udid == "" || seen[udid] {
+			continue
+		}
+		seen[udid] = true
+		device, err := s.flowDevice(udid)
+		if err != nil {
+			c.JSON(macroDeviceErrorStatus(err), GenericResponse{Error: fmt.Sprintf("%s: %s", udid, err)})
+			return
+		}
+		devices = append(devices, device)
+	}
+	if len(devices) == 0 {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "udids is required"})
+		return
+	}
+	flow, files, err := readFlowRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	run, err := s.startFlowRun(flow, devices, files)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errInvalidFlow) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, GenericResponse{Error: err.Error()})
+		return
+	}
+	if c.Query("wait") != "true" {
+		c.JSON(http.StatusAccepted, run.snapshot())
+		return
+	}
+	select {
+	case <-run.done:
+	case <-c.Request.Context().Done():
+		return
+	}
+	report := run.snapshot()
+	status := http.StatusOK
+	if report.Status != flowStatusPassed {
+		status = http.StatusInternalServerError
+	}
+	c.JSON(status, report)
+}
+
+// readFlowRequest reads the flow and the uploaded packages by file name.
+func readFlowRequest(c *gin.Context) (*Flow, map[string]*multipart.FileHeader, error) {
+	if c.ContentType() != gin.MIMEMultipartPOSTForm {
+		flow, err := parseFlow(c.Request.Body)
+		return flow, nil, err
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, nil, err
+	}
+	var flow *Flow
+	if headers := form.File["flow"]; len(headers) > 0 {
+		f, err := headers[0].Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		flow, err = parseFlow(f)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if values := form.Value["flow"]; len(values) > 0 {
+		if flow, err = parseFlow(strings.NewReader(values[0])); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		return nil, nil, errors.New("flow is required")
+	}
+	files := make(map[string]*multipart.FileHeader)
+	for _, header := range form.File["files"] {
+		files[filepath.Base(header.Filename)] = header
+	}
+	return flow, files, nil
+}
+
+func (s *Server) flowDevice(udid string) (flowDevice, error) {
+	if device, ok := s.iosDevice(udid); ok {
+		if s.tunnelRequired(udid) {
+			return flowDevice{}, errTunnelRequired
+		}
+		return flowDevice{udid: udid, platform: "ios", ios: device}, nil
+	}
+	if device, ok := s.androidDeviceBySerial(udid); ok {
+		return flowDevice{udid: udid, platform: "android", android: device}, nil
+	}
+	return flowDevice{}, errDeviceNotFound
+}
+
+// startFlowRun saves the uploaded packages into the dir of a new run and
+// runs the flow in the background.
+func (s *Server) startFlowRun(flow *Flow, devices []flowDevice, files map[string]*multipart.FileHeader) (*flowRun, error) {
+	id := uuid.New().String()
+	dir := filepath.Join(s.config.TmpDir, "flows", id)
+	if err := os.MkdirAll(filepath.Join(dir, "packages"), os.ModePerm); err != nil {
+		return nil, err
+	}
+	run := &flowRun{
+		report: FlowReport{
+			ID:        id,
+			Name:      flow.Name,
+			Status:    flowStatusRunning,
+			StartedAt: time.Now(),
+			Steps:     len(flow.Steps),
+		},
+		flow:     flow,
+		dir:      dir,
+		packages: make(map[string]string),
+		done:     make(chan struct{}),
+	}
+	for _, device := range devices {
+		run.report.Devices = append(run.report.Devices, FlowDeviceReport{
+			UDID:     device.udid,
+			Platform: device.platform,
+			Status:   flowStatusRunning,
+			Results:  []FlowStepResult{},
+		})
+	}
+	for _, step := range flow.Steps {
+		if step.Action != flowInstall || isRemotePackage(step.URL) || run.packages[step.URL] != "" {
+			continue
+		}
+		header, ok := files[step.URL]
+		if !ok {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("%w: %s is neither a http(s) url nor an uploaded file", errInvalidFlow, step.URL)
+		}
+		local := filepath.Join(dir, "packages", step.URL)
+		if err := saveMultipartFile(header, local); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		run.packages[step.URL] = local
+	}
+
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	run.cancel = cancel
+	s.flowRunsMu.Lock()
+	s.flowRuns[id] = run
+	s.flowRunsMu.Unlock()
+
+	s.logger.Info("flow run started", zap.String("id", id), zap.String("name", flow.Name), zap.Int("devices", len(devices)))
+	go func() {
+		defer cancel(nil)
+		s.runFlow(ctx, run, devices)
+	}()
+	return run, nil
+}
+
+func (s *Server) flowRun(c *gin.Context) (*flowRun, error) {
+	s.flowRunsMu.Lock()
+	defer s.flowRunsMu.Unlock()
+	run, ok := s.flowRuns[c.Param("id")]
+	if !ok {
+		return nil, errFlowRunNotFound
+	}
+	return run, nil
+}
+
+func (s *Server) hListFlowRuns(c *gin.Context) {
+	s.flowRunsMu.Lock()
+	reports := make([]FlowReport, 0, len(s.flowRuns))
+	for _, run := range s.flowRuns {
+		report := run.snapshot()
+		for i := range report.Devices {
+			report.Devices[i].Results = nil
+		}
+		reports = append(reports, report)
+	}
+	s.flowRunsMu.Unlock()
+	sort.Slice(reports, func(i, j int) bool { return reports[i].StartedAt.After(reports[j].StartedAt) })
+	c.JSON(http.StatusOK, reports)
+}
+
+func (s *Server) hRetrieveFlowRun(c *gin.Context) {
+	run, err := s.flowRun(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, run.snapshot())
+}
+
+// hStopFlowRun stops the run, the steps left are skipped.
+func (s *Server) hStopFlowRun(c *gin.Context) {
+	run, err := s.flowRun(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: err.Error()})
+		return
+	}
+	run.cancel(errFlowStopped)
+	select {
+	case <-run.done:
+	case <-c.Request.Context().Done():
+		return
+	}
+	c.JSON(http.StatusOK, run.snapshot())
+}
+
+func (s *Server) hDeleteFlowRun(c *gin.Context) {
+	run, err := s.flowRun(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: err.Error()})
+		return
+	}
+	select {
+	case <-run.done:
+	default:
+		c.JSON(http.StatusConflict, GenericResponse{Error: errFlowRunActive.Error()})
+		return
+	}
+	s.flowRunsMu.Lock()
+	delete(s.flowRuns, run.report.ID)
+	s.flowRunsMu.Unlock()
+	os.RemoveAll(run.dir)
+	c.JSON(http.StatusOK, GenericResponse{Message: "deleted " + run.report.ID})
+}
+
+// hRetrieveFlowArtifact serves a screenshot or pulled file of the run.
+func (s *Server) hRetrieveFlowArtifact(c *gin.Context) {
+	run, err := s.flowRun(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: err.Error()})
+		return
+	}
+	rel := filepath.Clean("/" + c.Param("filepath"))
+	local := filepath.Join(run.dir, rel)
+	info, err := os.Stat(local)
+	if err != nil || info.IsDir() || strings.HasPrefix(rel, "/packages/") {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: "artifact not found"})
+		return
+	}
+	if c.Query("download") == "true" {
+		c.FileAttachment(local, filepath.Base(local))
+		return
+	}
+	c.File(local)
+}
+
+func saveMultipartFile(header *multipart.FileHeader, dst string) error {
+	src, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, src)
+	return err
+}
@@ -0,0 +1,404 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blacklee123/go-ios-android/pkg/utils"
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+	"github.com/danielpaulus/go-ios/ios/afc"
+	"go.uber.org/zap"
+)
+
+var artifactNamePattern = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// runFlow downloads the packages of the flow and runs it on all devices at
+// once, each device goes through the steps in order.
+func (s *Server) runFlow(ctx context.Context, run *flowRun, devices []flowDevice) {
+	defer close(run.done)
+	err := s.downloadFlowPackages(ctx, run)
+	if err == nil {
+		var wg sync.WaitGroup
+		for i, device := range devices {
+			wg.Add(1)
+			go func(i int, device flowDevice) {
+				defer wg.Done()
+				s.runFlowOnDevice(ctx, run, i, device)
+			}(i, device)
+		}
+		wg.Wait()
+	}
+
+	run.update(func(report *FlowReport) {
+		report.Elapsed = time.Since(report.StartedAt).Milliseconds()
+		switch {
+		case ctx.Err() != nil:
+			report.Status = flowStatusStopped
+		case err != nil:
+			report.Status = flowStatusFailed
+			report.Error = err.Error()
+		default:
+			report.Status = flowStatusPassed
+			for _, device := range report.Devices {
+				if device.Status != flowStatusPassed {
+					report.Status = flowStatusFailed
+				}
+			}
+		}
+	})
+	report := run.snapshot()
+	s.logger.Info("flow run finished", zap.String("id", report.ID), zap.String("status", report.Status), zap.Int64("elapsed", report.Elapsed))
+}
+
+// downloadFlowPackages fetches the http(s) packages of install steps into
+// the run once for all devices.
+func (s *Server) downloadFlowPackages(ctx context.Context, run *flowRun) error {
+	for i, step := range run.flow.Steps {
+		if step.Action != flowInstall || run.packages[step.URL] != "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		local := filepath.Join(run.dir, "packages", fmt.Sprintf("%03d-%s", i, packageName(step.URL)))
+		s.logger.Info("downloading flow package", zap.String("id", run.report.ID), zap.String("url", step.URL))
+		if err := downloadFile(step.URL, local); err != nil {
+			return fmt.Errorf("failed to download %s: %w", step.URL, err)
+		}
+		run.packages[step.URL] = local
+	}
+	return nil
+}
+
+// runFlowOnDevice runs the steps in order, after a failure the rest are
+// skipped unless the flow continues on errors.
+func (s *Server) runFlowOnDevice(ctx context.Context, run *flowRun, i int, device flowDevice) {
+	started := time.Now()
+	failed := false
+	screenshotOnFailure := run.flow.ScreenshotOnFailure == nil || *run.flow.ScreenshotOnFailure
+	for index, step := range run.flow.Steps {
+		result := FlowStepResult{Index: index, Action: step.Action, Name: step.Name, Status: flowStatusSkipped}
+		switch {
+		case ctx.Err() != nil || failed && !run.flow.ContinueOnError:
+		case step.Platform != "" && step.Platform != device.platform:
+			result.logf("only runs on %s", step.Platform)
+		default:
+			stepStarted := time.Now()
+			err := s.runFlowStep(ctx, run, device, index, step, &result)
+			result.Status = flowStatusPassed
+			if err != nil {
+				s.logger.Warn("flow step failed", zap.String("id", run.report.ID), zap.String("udid", device.udid),
+					zap.Int("index", index), zap.String("action", step.Action), zap.Error(err))
+				failed = true
+				result.Status = flowStatusFailed
+				result.Error = err.Error()
+				if screenshotOnFailure && result.Screenshot == "" && ctx.Err() == nil {
+					if err := s.flowScreenshot(run, device, index, "failure", &result); err != nil {
+						result.logf("failed to take a screenshot: %s", err)
+					}
+				}
+			}
+			result.Duration = time.Since(stepStarted).Milliseconds()
+		}
+		run.update(func(report *FlowReport) {
+			report.Devices[i].Results = append(report.Devices[i].Results, result)
+		})
+	}
+
+	run.update(func(report *FlowReport) {
+		report.Devices[i].Elapsed = time.Since(started).Milliseconds()
+		switch {
+		case ctx.Err() != nil:
+			report.Devices[i].Status = flowStatusStopped
+		case failed:
+			report.Devices[i].Status = flowStatusFailed
+		default:
+			report.Devices[i].Status = flowStatusPassed
+		}
+	})
+}
+
+func (s *Server) runFlowStep(ctx context.Context, run *flowRun, device flowDevice, index int, step FlowStep, result *FlowStepResult) error {
+	switch step.Action {
+	case flowInstall:
+		return s.flowInstall(run, device, step, result)
+	case flowLaunch:
+		app := step.App
+		if app == "" {
+			app = run.flow.Apps[device.platform]
+		}
+		var err error
+		if device.platform == "ios" {
+			err = launchIosApp(device.ios, app)
+		} else {
+			err = androidLaunchApp(device.android, app)
+		}
+		if err != nil {
+			return err
+		}
+		result.logf("launched %s", app)
+		return nil
+	case flowWait:
+		_, err := s.flowElement(ctx, device, step, nil, result)
+		return err
+	case flowTap:
+		return s.flowTap(ctx, device, step, result)
+	case flowType:
+		if device.platform == "ios" {
+			return s.wdaKeys(ctx, device.udid, step.Text)
+		}
+		return androidText(device.android, step.Text)
+	case flowAssertText:
+		return s.flowAssertText(ctx, device, step, result)
+	case flowScreenshot:
+		name := step.Name
+		if name == "" {
+			name = flowScreenshot
+		}
+		return s.flowScreenshot(run, device, index, name, result)
+	case flowPull:
+		return s.flowPull(run, device, index, step, result)
+	case flowSleep:
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(step.Duration) * time.Millisecond):
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown step %q", step.Action)
+}
+
+func (s *Server) flowInstall(run *flowRun, device flowDevice, step FlowStep, result *FlowStepResult) error {
+	local := run.packages[step.URL]
+	isApk := strings.EqualFold(filepath.Ext(packageName(step.URL)), ".apk")
+	if device.platform == "ios" {
+		if isApk {
+			return fmt.Errorf("%s is an Android package", packageName(step.URL))
+		}
+		if err := _installApp(device.ios, local); err != nil {
+			return err
+		}
+	} else {
+		if !isApk {
+			return fmt.Errorf("%s is not an apk", packageName(step.URL))
+		}
+		if err := androidInstallApp(device.android, local); err != nil {
+			return err
+		}
+	}
+	result.logf("installed %s", packageName(step.URL))
+	return nil
+}
+
+// flowElement waits for the element of the step, match further filters the
+// element found by the locator, e.g. by its text.
+func (s *Server) flowElement(ctx context.Context, device flowDevice, step FlowStep, match func(node *poco.Node) bool, result *FlowStepResult) (*poco.Node, error) {
+	target, err := s.flowElementTarget(device, step)
+	if err != nil {
+		return nil, err
+	}
+	defer target.release()
+	return waitFlowElement(ctx, target, step, match, result)
+}
+
+func (s *Server) flowElementTarget(device flowDevice, step FlowStep) (*elementTarget, error) {
+	req := step.elementRequest(device.platform)
+	var target *elementTarget
+	var err error
+	if device.platform == "ios" {
+		target, err = s.iosElementTarget(device.ios, req)
+	} else {
+		target, err = s.androidElementTarget(device.android, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := target.query(&poco.Node{Payload: map[string]interface{}{}}); err != nil {
+		target.release()
+		return nil, err
+	}
+	return target, nil
+}
+
+func waitFlowElement(ctx context.Context, target *elementTarget, step FlowStep, match func(node *poco.Node) bool, result *FlowStepResult) (*poco.Node, error) {
+	timeout, interval := elementWaitOptions(ElementTapRequest{Timeout: step.Timeout, Interval: step.Interval})
+	index := step.Index
+	if match != nil {
+		// 只看 index 处的元素，匹配时作为唯一的结果
+		query := target.query
+		target.query = func(root *poco.Node) ([]*poco.Node, error) {
+			nodes, err := query(root)
+			if err != nil || index >= len(nodes) || !match(nodes[index]) {
+				return nil, err
+			}
+			return nodes[index : index+1], nil
+		}
+		index = 0
+	}
+	node, attempts, err := target.wait(ctx, index, timeout, interval)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, fmt.Errorf("no element found within %s", timeout)
+	}
+	result.logf("found %s after %d attempts", node.Name, attempts)
+	return node, nil
+}
+
+func (s *Server) flowTap(ctx context.Context, device flowDevice, step FlowStep, result *FlowStepResult) error {
+	duration := time.Duration(step.Duration) * time.Millisecond
+	if step.X != nil {
+		x, y := *step.X, *step.Y
+		result.logf("tapping %.0f,%.0f", x, y)
+		if device.platform == "ios" {
+			return s.wdaTap(ctx, device.udid, x, y, duration)
+		}
+		if duration > 0 {
+			return androidSwipe(device.android, int(x), int(y), int(x), int(y), int(duration.Milliseconds()))
+		}
+		return androidTap(device.android, int(x), int(y))
+	}
+
+	target, err := s.flowElementTarget(device, step)
+	if err != nil {
+		return err
+	}
+	defer target.release()
+	node, err := waitFlowElement(ctx, target, step, nil, result)
+	if err != nil {
+		return err
+	}
+	x, y, _, err := target.center(ctx, node)
+	if err != nil {
+		return err
+	}
+	result.logf("tapping %d,%d", x, y)
+	return target.tap(ctx, x, y, duration)
+}
+
+// flowAssertText waits until the text of the element meets the step, the
+// text it had last is reported otherwise.
+func (s *Server) flowAssertText(ctx context.Context, device flowDevice, step FlowStep, result *FlowStepResult) error {
+	match := func(node *poco.Node) bool {
+		text, _ := node.Payload[poco.AttrText].(string)
+		return (step.Equals == "" || text == step.Equals) && strings.Contains(text, step.Contains)
+	}
+	node, err := s.flowElement(ctx, device, step, match, result)
+	if err == nil {
+		result.logf("text is %q", node.Payload[poco.AttrText])
+		return nil
+	}
+	if ctx.Err() != nil {
+		return err
+	}
+	step.Timeout, step.Interval = 1, 1
+	last, lastErr := s.flowElement(ctx, device, step, nil, result)
+	if lastErr != nil {
+		return err
+	}
+	text, _ := last.Payload[poco.AttrText].(string)
+	if step.Equals != "" {
+		return fmt.Errorf("text is %q, expected %q", text, step.Equals)
+	}
+	return fmt.Errorf("text %q does not contain %q", text, step.Contains)
+}
+
+// flowScreenshot saves a PNG of the screen as artifact of the step.
+func (s *Server) flowScreenshot(run *flowRun, device flowDevice, index int, name string, result *FlowStepResult) error {
+	img, _, _, err := s.captureScreen(device.udid)
+	if err != nil {
+		return err
+	}
+	rel, local, err := flowArtifactPath(run, device, index, name+".png")
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		return err
+	}
+	result.Screenshot = run.artifactURL(rel)
+	result.logf("saved screenshot %s", filepath.Base(rel))
+	return nil
+}
+
+// flowPull copies a file of the device into the artifacts of the step,
+// directories pulled from iOS are zipped.
+func (s *Server) flowPull(run *flowRun, device flowDevice, index int, step FlowStep, result *FlowStepResult) error {
+	rel, local, err := flowArtifactPath(run, device, index, filepath.Base(step.Path))
+	if err != nil {
+		return err
+	}
+	if device.platform == "ios" {
+		if err := pullIosFile(device, step, local); err != nil {
+			return err
+		}
+		if info, err := os.Stat(local); err == nil && info.IsDir() {
+			defer os.RemoveAll(local)
+			if err := utils.ZipDir(local, local+".zip"); err != nil {
+				return err
+			}
+			rel, local = rel+".zip", local+".zip"
+		}
+	} else {
+		f, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+		err = device.android.Pull(step.Path, f)
+		f.Close()
+		if err != nil {
+			os.Remove(local)
+			return err
+		}
+	}
+	result.Artifact = run.artifactURL(rel)
+	result.logf("pulled %s", step.Path)
+	return nil
+}
+
+func pullIosFile(device flowDevice, step FlowStep, local string) error {
+	remote := filepath.Clean(step.Path)
+	var afcService *afc.Connection
+	var err error
+	if step.BundleID == "" {
+		afcService, err = afc.New(device.ios)
+	} else {
+		remote = filepath.Join("Documents", remote)
+		afcService, err = afc.NewContainer(device.ios, step.BundleID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed opening afc service: %w", err)
+	}
+	defer afcService.Close()
+	return afcService.Pull(remote, local)
+}
+
+// flowArtifactPath returns the path of an artifact relative to the run and
+// on disk, named after the device and the step.
+func flowArtifactPath(run *flowRun, device flowDevice, index int, name string) (string, string, error) {
+	name = artifactNamePattern.ReplaceAllString(name, "_")
+	if strings.Trim(name, "._") == "" {
+		return "", "", errors.New("invalid artifact name")
+	}
+	rel := filepath.Join(artifactNamePattern.ReplaceAllString(device.udid, "_"), fmt.Sprintf("%03d-%s", index, name))
+	local := filepath.Join(run.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(local), os.ModePerm); err != nil {
+		return "", "", err
+	}
+	return rel, local, nil
+}
@@ -0,0 +1,32 @@
+package api
+
+import "testing"
+
+func TestValidateFlowStepLocator(t *testing.T) {
+	x, y := 10.0, 20.0
+	tests := []struct {
+		name    string
+		step    FlowStep
+		wantErr bool
+	}{
+		{"selector on both", FlowStep{Action: flowWait, FlowStepArgs: FlowStepArgs{Selector: `poco(text="Log in")`}}, false},
+		{"text on both", FlowStep{Action: flowWait, FlowStepArgs: FlowStepArgs{Text: "Log in"}}, true},
+		{"text on android", FlowStep{Action: flowWait, Platform: "android", FlowStepArgs: FlowStepArgs{Text: "Log in"}}, false},
+		{"text on ios", FlowStep{Action: flowTap, Platform: "ios", FlowStepArgs: FlowStepArgs{Text: "Log in"}}, true},
+		{"predicate on ios", FlowStep{Action: flowTap, Platform: "ios", FlowStepArgs: FlowStepArgs{Predicate: `label == "Log in"`}}, false},
+		{"predicate on both", FlowStep{Action: flowTap, FlowStepArgs: FlowStepArgs{Predicate: `label == "Log in"`}}, true},
+		{"uiautomator on both", FlowStep{Action: flowWait, FlowStepArgs: FlowStepArgs{Source: "uiautomator", XPath: "//*"}}, true},
+		{"wda on ios", FlowStep{Action: flowWait, Platform: "ios", FlowStepArgs: FlowStepArgs{Source: "wda", ClassChain: "**/XCUIElementTypeButton"}}, false},
+		{"poco without selector", FlowStep{Action: flowWait, FlowStepArgs: FlowStepArgs{Source: "poco", Text: "Log in"}}, true},
+		{"tap by coordinates", FlowStep{Action: flowTap, FlowStepArgs: FlowStepArgs{X: &x, Y: &y}}, false},
+		{"tap without target", FlowStep{Action: flowTap}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFlowStep(&Flow{}, tt.step)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateFlowStep = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package api
 
 import (
+	"time"
+
+	"github.com/blacklee123/go-ios-android/pkg/api/iosvo"
 	"github.com/blacklee123/go-ios-android/pkg/utils"
 
 	"github.com/danielpaulus/go-ios/ios"
@@ -15,17 +18,71 @@ func (s *Server) retrieveDevice(udid string) (ios.DeviceEntry, error) {
 		s.logger.Error("failed to get device", zap.String("udid", udid), zap.Error(err))
 		return ios.DeviceEntry{}, err
 	}
+	if _, err := readPairRecord(udid); err != nil {
+		return device, err
+	}
 	info, err := tunnel.TunnelInfoForDevice(device.Properties.SerialNumber, ios.HttpApiHost(), ios.HttpApiPort())
 	if err == nil {
+		s.setTunnelRequired(udid, false)
 		device.UserspaceTUNPort = info.UserspaceTUNPort
 		device.UserspaceTUN = info.UserspaceTUN
-		return s.deviceWithRsdProvider(device, device.Properties.SerialNumber, info.Address, info.RsdPort)
+		tunnelInfo := iosvo.TunnelInfo{
+			Address:          info.Address,
+			RsdPort:          info.RsdPort,
+			UserspaceTUN:     info.UserspaceTUN,
+			UserspaceTUNPort: info.UserspaceTUNPort,
+		}
+		device, err = s.deviceWithRsdProvider(device, device.Properties.SerialNumber, info.Address, info.RsdPort)
+		if err != nil {
+			tunnelInfo.Error = err.Error()
+		} else {
+			now := time.Now()
+			tunnelInfo.LastHandshake = &now
+		}
+		s.setTunnelInfo(udid, tunnelInfo)
+		return device, err
+	}
+	// 没有隧道时 iOS 17 以下的设备依然可以通过 usbmuxd 使用，不算错误
+	required := needsTunnel(device)
+	if required {
+		s.logger.Warn("failed to get tunnel info", zap.String("udid", device.Properties.SerialNumber), zap.Error(err))
+		s.setTunnelInfo(udid, iosvo.TunnelInfo{Error: err.Error()})
 	} else {
-		s.logger.Warn("failed to get tunnel info", zap.String("udid", device.Properties.SerialNumber))
+		s.deleteTunnelInfo(udid)
 	}
+	s.setTunnelRequired(udid, required)
 	return device, nil
 }
 
+func (s *Server) setIosDevice(device ios.DeviceEntry) {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	s.iosDevices[device.Properties.SerialNumber] = device
+}
+
+func (s *Server) deleteIosDevice(udid string) {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+	delete(s.iosDevices, udid)
+}
+
+func (s *Server) iosDevice(udid string) (ios.DeviceEntry, bool) {
+	s.devicesMu.RLock()
+	defer s.devicesMu.RUnlock()
+	device, ok := s.iosDevices[udid]
+	return device, ok
+}
+
+func (s *Server) iosDeviceList() []ios.DeviceEntry {
+	s.devicesMu.RLock()
+	defer s.devicesMu.RUnlock()
+	devices := make([]ios.DeviceEntry, 0, len(s.iosDevices))
+	for _, device := range s.iosDevices {
+		devices = append(devices, device)
+	}
+	return devices
+}
+
 func (s *Server) deviceWithRsdProvider(device ios.DeviceEntry, udid string, address string, rsdPort int) (ios.DeviceEntry, error) {
 	rsdService, err := ios.NewWithAddrPortDevice(address, rsdPort, device)
 	if err != nil {
@@ -48,16 +105,77 @@ func (s *Server) deviceWithRsdProvider(device ios.DeviceEntry, udid string, addr
 	return device1, nil
 }
 
-func (s *Server) addForward(udid string, hostPort int, targetPort int) {
-	if _, exists := s.iosForwards[udid]; !exists {
-		s.iosForwards[udid] = make(map[int]int)
+// forwardPort returns the host port forwarded to targetPort of the device.
+func (s *Server) forwardPort(udid string, targetPort int) (int, bool) {
+	s.forwardsMu.Lock()
+	defer s.forwardsMu.Unlock()
+	hostPort, ok := s.iosForwards[udid][targetPort]
+	return hostPort, ok
+}
+
+// deviceForwards returns a copy of the forwards of the device by target port.
+func (s *Server) deviceForwards(udid string) map[int]int {
+	s.forwardsMu.Lock()
+	defer s.forwardsMu.Unlock()
+	forwards := make(map[int]int, len(s.iosForwards[udid]))
+	for targetPort, hostPort := range s.iosForwards[udid] {
+		forwards[targetPort] = hostPort
+	}
+	return forwards
+}
+
+// removeForward closes the forward cl to targetPort of the device unless it
+// was already replaced. ConnListener may only be closed once, so every
+// forward must be closed through here.
+func (s *Server) removeForward(udid string, targetPort int, cl *forward.ConnListener) {
+	s.forwardsMu.Lock()
+	if s.forwardListeners[udid][targetPort] != cl {
+		s.forwardsMu.Unlock()
+		return
 	}
-	s.iosForwards[udid][targetPort] = hostPort
+	delete(s.forwardListeners[udid], targetPort)
+	delete(s.iosForwards[udid], targetPort)
+	s.forwardsMu.Unlock()
+	stopForwarding(cl)
+}
 
+// closeForwards closes every forward of the device, a detached device must
+// not leave listeners behind for the next attach to reuse.
+func (s *Server) closeForwards(udid string) {
+	s.forwardsMu.Lock()
+	listeners := s.forwardListeners[udid]
+	delete(s.forwardListeners, udid)
+	delete(s.iosForwards, udid)
+	s.forwardsMu.Unlock()
+	for _, cl := range listeners {
+		stopForwarding(cl)
+	}
 }
 
+// closeAllForwards closes the forwards of every device.
+func (s *Server) closeAllForwards() {
+	s.forwardsMu.Lock()
+	listeners := s.forwardListeners
+	s.forwardListeners = make(map[string]map[int]*forward.ConnListener)
+	s.iosForwards = make(map[string]map[int]int)
+	s.forwardsMu.Unlock()
+	for _, deviceListeners := range listeners {
+		for _, cl := range deviceListeners {
+			stopForwarding(cl)
+		}
+	}
+}
+
+// createForward forwards hostPort, any free port for 0, to phonePort of the
+// device. An existing forward to phonePort is returned instead of creating a
+// second one.
 func (s *Server) createForward(device ios.DeviceEntry, hostPort int, phonePort int) (*forward.ConnListener, int, error) {
-	// targetPort = 5001
+	udid := device.Properties.SerialNumber
+	s.forwardsMu.Lock()
+	defer s.forwardsMu.Unlock()
+	if cl, ok := s.forwardListeners[udid][phonePort]; ok {
+		return cl, s.iosForwards[udid][phonePort], nil
+	}
 	if hostPort == 0 {
 		hostPort = utils.GiveAvialablePortFromSpecifyStart(phonePort)
 	}
@@ -65,11 +183,16 @@ func (s *Server) createForward(device ios.DeviceEntry, hostPort int, phonePort i
 	cl, err := forward.Forward(device, uint16(hostPort), uint16(phonePort))
 	if err != nil {
 		s.logger.Error("failed to forward port",
-			zap.String("udid", device.Properties.SerialNumber),
+			zap.String("udid", udid),
 			zap.Uint16("hostPort", uint16(hostPort)),
 			zap.Uint16("phonePort", uint16(phonePort)), zap.Error(err))
 		return nil, hostPort, err
 	}
-	s.addForward(device.Properties.SerialNumber, hostPort, phonePort)
+	if _, exists := s.iosForwards[udid]; !exists {
+		s.iosForwards[udid] = make(map[int]int)
+		s.forwardListeners[udid] = make(map[int]*forward.ConnListener)
+	}
+	s.iosForwards[udid][phonePort] = hostPort
+	s.forwardListeners[udid][phonePort] = cl
 	return cl, hostPort, nil
 }
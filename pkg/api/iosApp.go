@@ -115,19 +115,22 @@ func (s *Server) hLaunchApp(c *gin.Context) {
 	}
 	s.logger.Info("launchApp", zap.String("udid", device.Properties.SerialNumber), zap.String("bundleId", bundleId))
 
-	pControl, err := instruments.NewProcessControl(device)
-	if err != nil {
+	if err := launchIosApp(device, bundleId); err != nil {
 		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
 		return
 	}
+	s.recordMacroAction(device.Properties.SerialNumber, MacroAction{Type: macroLaunch, App: bundleId})
 
-	_, err = pControl.LaunchApp(bundleId, nil)
+	c.JSON(http.StatusOK, GenericResponse{Message: bundleId + " launched successfully"})
+}
+
+func launchIosApp(device ios.DeviceEntry, bundleId string) error {
+	pControl, err := instruments.NewProcessControl(device)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
-		return
+		return err
 	}
-
-	c.JSON(http.StatusOK, GenericResponse{Message: bundleId + " launched successfully"})
+	_, err = pControl.LaunchApp(bundleId, nil)
+	return err
 }
 
 func (s *Server) hKillApp(c *gin.Context) {
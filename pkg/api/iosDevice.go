@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"strconv"
@@ -24,8 +25,9 @@ func (s *Server) hListIOS(c *gin.Context) {
 }
 
 func (s *Server) listIOS() []iosvo.Device {
-	devices := make([]iosvo.Device, 0, len(s.iosDevices))
-	for _, device := range s.iosDevices {
+	iosDevices := s.iosDeviceList()
+	devices := make([]iosvo.Device, 0, len(iosDevices))
+	for _, device := range iosDevices {
 
 		allValues, err := ios.GetValues(device)
 		s.logger.Info("allValues", zap.Any("allValues", allValues))
@@ -33,15 +35,19 @@ func (s *Server) listIOS() []iosvo.Device {
 			continue
 		}
 		deviceVo := iosvo.Device{
-			UdID:         device.Properties.SerialNumber,
-			Name:         allValues.Value.DeviceName,
-			Model:        "",
-			Platform:     "ios",
-			Size:         allValues.Value.SerialNumber,
-			CPU:          allValues.Value.CPUArchitecture,
-			Manufacturer: "APPLE",
-			IsHm:         false,
-			Version:      allValues.Value.ProductVersion,
+			UdID:           device.Properties.SerialNumber,
+			Name:           allValues.Value.DeviceName,
+			Model:          "",
+			Platform:       "ios",
+			Size:           allValues.Value.SerialNumber,
+			CPU:            allValues.Value.CPUArchitecture,
+			Manufacturer:   "APPLE",
+			IsHm:           false,
+			Version:        allValues.Value.ProductVersion,
+			TunnelRequired: s.tunnelRequired(device.Properties.SerialNumber),
+		}
+		if state := s.deviceState(device.Properties.SerialNumber); state != nil {
+			deviceVo.State = state.State
 		}
 		if allValues.Value.ProductType != "" {
 			deviceVo.Model = utils.GenerationMap[allValues.Value.ProductType]
@@ -82,34 +88,46 @@ func (s *Server) hRetrieveIOS(c *gin.Context) {
 		return
 	}
 
+	wdaHostPort, _ := s.forwardPort(device.Properties.SerialNumber, wdaPort)
 	c.JSON(http.StatusOK, iosvo.DeviceInfo{
 		CPUArchitecture: allValues.Value.CPUArchitecture,
 		DeviceName:      allValues.Value.DeviceName,
 		DevicePlatform:  "ios",
 		DeviceSerialNo:  device.Properties.SerialNumber,
-		WdaPort:         s.iosForwards[device.Properties.SerialNumber][8100],
+		WdaPort:         wdaHostPort,
 		Version:         allValues.Value.ProductVersion,
+		TunnelRequired:  s.tunnelRequired(device.Properties.SerialNumber),
+		Tunnel:          s.tunnelInfo(device.Properties.SerialNumber),
+		Readiness:       s.deviceState(device.Properties.SerialNumber),
 	})
 }
 
 func (s *Server) hScreenshot(c *gin.Context) {
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
-
-	screenshotService, err := instruments.NewScreenshotService(device)
+	options, err := parseScreenshotOptions(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
 		return
 	}
-	defer screenshotService.Close()
 
-	imageBytes, err := screenshotService.TakeScreenshot()
+	imageBytes, err := captureIosScreenshot(device)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
 		return
 	}
+	s.writeScreenshot(c, imageBytes, nil, options, func() int {
+		return s.wdaOrientation(device.Properties.SerialNumber)
+	})
+}
 
-	c.Header("Content-Type", "image/png")
-	c.Data(http.StatusOK, "application/octet-stream", imageBytes)
+// captureIosScreenshot returns the screenshot as png.
+func captureIosScreenshot(device ios.DeviceEntry) ([]byte, error) {
+	screenshotService, err := instruments.NewScreenshotService(device)
+	if err != nil {
+		return nil, err
+	}
+	defer screenshotService.Close()
+	return screenshotService.TakeScreenshot()
 }
 
 func (s *Server) hSyslog(c *gin.Context) {
@@ -121,9 +139,17 @@ func (s *Server) hSyslog(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
 	}
+	// ReadLogMessage 会阻塞，请求结束或服务关闭时关闭连接使其返回
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	context.AfterFunc(ctx, func() { syslogConnection.Close() })
 	c.Stream(func(w io.Writer) bool {
 		logMessage, err := syslogConnection.ReadLogMessage()
 		if err != nil {
+			if s.ctx.Err() != nil {
+				s.closeStream(c)
+				return false
+			}
 			s.logger.Error("failed reading log message", zap.Error(err))
 			return false
 		}
@@ -142,8 +168,6 @@ func (s *Server) hSyslog(c *gin.Context) {
 	})
 }
 
-
-
 type Location struct {
 	Lat float64 `json:"lat" binding:"required"`
 	Lon float64 `json:"lon" binding:"required"`
@@ -158,28 +182,35 @@ func (s *Server) hSetLocation(c *gin.Context) {
 		return
 	}
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	if err := s.setIosLocation(device, location.Lat, location.Lon); err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	s.recordMacroAction(device.Properties.SerialNumber, MacroAction{Type: macroLocation, Lat: location.Lat, Lon: location.Lon})
+}
+
+func (s *Server) hResetLocation(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	simlocation.ResetLocation(device)
+	s.recordMacroAction(device.Properties.SerialNumber, MacroAction{Type: macroLocationReset})
+}
+
+func (s *Server) setIosLocation(device ios.DeviceEntry, lat, lon float64) error {
 	if device.SupportsRsd() {
 		server, err := instruments.NewLocationSimulationService(device)
 		if err != nil {
 			s.logger.Error("failed to create location simulation service", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
-			return
+			return err
 		}
-		if err := server.StartSimulateLocation(location.Lat, location.Lon); err != nil {
+		if err := server.StartSimulateLocation(lat, lon); err != nil {
 			s.logger.Error("location simulation failed to start with", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
-			return
+			return err
 		}
-		return
+		return nil
 	}
-	if err := simlocation.SetLocation(device, strconv.FormatFloat(location.Lat, 'f', -1, 64), strconv.FormatFloat(location.Lon, 'f', -1, 64)); err != nil {
+	if err := simlocation.SetLocation(device, strconv.FormatFloat(lat, 'f', -1, 64), strconv.FormatFloat(lon, 'f', -1, 64)); err != nil {
 		s.logger.Error("Setting location failed with", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
-		return
+		return err
 	}
-}
-
-func (s *Server) hResetLocation(c *gin.Context) {
-	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
-	simlocation.ResetLocation(device)
+	return nil
 }
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/blacklee123/go-ios-android/pkg/utils/validator"
@@ -10,7 +11,7 @@ import (
 
 func (s *Server) hListForward(c *gin.Context) {
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
-	c.JSON(http.StatusOK, s.iosForwards[device.Properties.SerialNumber])
+	c.JSON(http.StatusOK, s.deviceForwards(device.Properties.SerialNumber))
 }
 
 func (s *Server) hRetrieveForward(c *gin.Context) {
@@ -22,15 +23,7 @@ func (s *Server) hRetrieveForward(c *gin.Context) {
 	}
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
 
-	// 检查是否已存在转发
-	if deviceForwards, exists := s.iosForwards[device.Properties.SerialNumber]; exists {
-		if forwardedPort, ok := deviceForwards[port]; ok {
-			c.JSON(http.StatusOK, gin.H{"port": forwardedPort})
-			return
-		}
-	}
-
-	// 创建新转发
+	// 已存在的转发直接返回
 	_, hostPort, err := s.createForward(device, 0, port)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
@@ -54,12 +47,12 @@ func (s *Server) hCreateForward(c *gin.Context) {
 	}
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
 	for _, port := range ports.Ports {
-
-		cl, _, err := s.createForward(device, 0, port)
-		if err == nil {
-			defer stopForwarding(cl)
+		// 转发保持打开，由 Server 关闭时统一释放
+		if _, _, err := s.createForward(device, 0, port); err != nil {
+			c.JSON(http.StatusInternalServerError, GenericResponse{Error: fmt.Sprintf("port %d: %s", port, err)})
+			return
 		}
 	}
-	c.JSON(http.StatusOK, s.iosForwards[device.Properties.SerialNumber])
+	c.JSON(http.StatusOK, s.deviceForwards(device.Properties.SerialNumber))
 
 }
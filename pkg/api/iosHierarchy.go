@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+	"github.com/blacklee123/go-ios-android/pkg/utils/wda"
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// IosElementQuery selects nodes of the WDA source by one of WDA's locator
+// strategies, evaluated on the server against a single source snapshot.
+type IosElementQuery struct {
+	Predicate  string `form:"predicate"`
+	ClassChain string `form:"class_chain"`
+	XPath      string `form:"xpath"`
+	Selector   string `form:"selector"` // Poco 选择器
+	Index      *int   `form:"index"`    // 只返回第几个匹配的节点
+}
+
+// hIosHierarchy returns the WDA source as Poco nodes, format selects the
+// source format requested from WDA (json or xml) and raw=true returns it
+// unconverted.
+func (s *Server) hIosHierarchy(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "xml" {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "format must be json or xml"})
+		return
+	}
+
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	source, err := s.wdaSource(ctx, udid, format)
+	if err != nil {
+		s.logger.Error("failed to get WDA source", zap.String("udid", udid), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	if c.Query("raw") == "true" {
+		if format == "xml" {
+			var xml string
+			if err := json.Unmarshal(source, &xml); err != nil {
+				s.logger.Error("invalid WDA xml source", zap.String("udid", udid), zap.Error(err))
+				c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+				return
+			}
+			c.Data(http.StatusOK, "application/xml", []byte(xml))
+			return
+		}
+		c.Data(http.StatusOK, "application/json", source)
+		return
+	}
+	root, err := parseWdaSource(source, format)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, root)
+}
+
+func (s *Server) hIosFindElements(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+	var query IosElementQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if query.Predicate == "" && query.ClassChain == "" && query.XPath == "" && query.Selector == "" {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "one of predicate, class_chain, xpath or selector is required"})
+		return
+	}
+
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	root, err := s.iosHierarchy(ctx, udid)
+	if err != nil {
+		s.logger.Error("failed to get WDA source", zap.String("udid", udid), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	nodes, err := findIosElements(root, query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, elementsResponse(nodes, query.Index))
+}
+
+func findIosElements(root *poco.Node, query IosElementQuery) ([]*poco.Node, error) {
+	switch {
+	case query.Predicate != "":
+		return wda.QueryPredicate(root, query.Predicate)
+	case query.ClassChain != "":
+		return wda.QueryClassChain(root, query.ClassChain)
+	case query.Selector != "":
+		// WDA 的 visible 并不可靠，不按可见性过滤
+		return poco.QuerySelector(root, query.Selector, false)
+	}
+	return poco.QueryXPath(root, query.XPath)
+}
+
+// iosHierarchy returns the JSON source of WDA as Poco nodes.
+func (s *Server) iosHierarchy(ctx context.Context, udid string) (*poco.Node, error) {
+	source, err := s.wdaSource(ctx, udid, "json")
+	if err != nil {
+		return nil, err
+	}
+	return parseWdaSource(source, "json")
+}
+
+// wdaSource returns the value of WDA's /source, for xml a JSON string.
+func (s *Server) wdaSource(ctx context.Context, udid, format string) (json.RawMessage, error) {
+	var source json.RawMessage
+	if err := s.wdaRequest(ctx, udid, http.MethodGet, "/source?format="+format, nil, &source); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func parseWdaSource(source json.RawMessage, format string) (*poco.Node, error) {
+	if format == "json" {
+		return wda.ParseJSONSource(source)
+	}
+	var xml string
+	if err := json.Unmarshal(source, &xml); err != nil {
+		return nil, err
+	}
+	return wda.ParseXMLSource([]byte(xml))
+}
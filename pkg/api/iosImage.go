@@ -0,0 +1,145 @@
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/imagemounter"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	ddiImageFile     = "DeveloperDiskImage.dmg"
+	ddiBuildManifest = "BuildManifest.plist"
+)
+
+var errImageNotFound = errors.New("no matching developer disk image in image dir")
+
+func (s *Server) hRetrieveImage(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	version, err := ios.GetProductVersion(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	signatures, err := listImageSignatures(device)
+	if err != nil {
+		s.logger.Error("failed to list images", zap.String("udid", device.Properties.SerialNumber), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	hexSignatures := make([]string, 0, len(signatures))
+	for _, signature := range signatures {
+		hexSignatures = append(hexSignatures, hex.EncodeToString(signature))
+	}
+
+	ret := gin.H{
+		"version":      version.String(),
+		"personalized": version.Major() >= 17,
+		"mounted":      len(signatures) > 0,
+		"signatures":   hexSignatures,
+	}
+	if devMode, err := imagemounter.IsDevModeEnabled(device); err == nil {
+		ret["developer_mode"] = devMode
+	}
+	if imagePath, err := findLocalImage(s.config.ImageDir, version); err == nil {
+		ret["image"] = imagePath
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+// hMountImage mounts the image matching the iOS version from ImageDir, with
+// download=true missing images are downloaded into ImageDir first.
+func (s *Server) hMountImage(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+	version, err := ios.GetProductVersion(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	imagePath, err := findLocalImage(s.config.ImageDir, version)
+	if err != nil && c.Query("download") == "true" {
+		s.logger.Info("downloading developer disk image", zap.String("udid", udid), zap.String("imageDir", s.config.ImageDir))
+		imagePath, err = imagemounter.DownloadImageFor(device, s.config.ImageDir)
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	s.logger.Info("mounting developer disk image", zap.String("udid", udid), zap.String("image", imagePath))
+	if err := imagemounter.MountImage(device, imagePath); err != nil {
+		s.logger.Error("failed to mount image", zap.String("udid", udid), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	// 挂载后重新走就绪流程，启动 WDA
+	if state := s.deviceState(udid); state != nil && state.State != stateReady {
+		s.startReadiness(udid)
+	}
+	c.JSON(http.StatusOK, GenericResponse{Message: "mounted " + imagePath})
+}
+
+func listImageSignatures(device ios.DeviceEntry) ([][]byte, error) {
+	conn, err := imagemounter.NewImageMounter(device)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ListImages()
+}
+
+// findLocalImage picks the image for the iOS version from imageDir. The layout
+// is the one imagemounter.DownloadImageFor uses: iOS 17+ takes a personalized
+// image (a Restore dir with a BuildManifest.plist), older versions take
+// <version>/DeveloperDiskImage.dmg of the closest version not newer than the
+// device.
+func findLocalImage(imageDir string, version *semver.Version) (string, error) {
+	if version.Major() >= 17 {
+		manifests, _ := filepath.Glob(filepath.Join(imageDir, "*", "Restore", ddiBuildManifest))
+		if len(manifests) == 0 {
+			return "", errImageNotFound
+		}
+		return filepath.Dir(manifests[len(manifests)-1]), nil
+	}
+
+	entries, err := os.ReadDir(imageDir)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errImageNotFound, err)
+	}
+	var best *semver.Version
+	var bestPath string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// 目录名形如 "16.4" 或 "9.3 (13E230)"
+		dirVersion, err := semver.NewVersion(strings.Split(entry.Name(), " (")[0])
+		if err != nil || dirVersion.GreaterThan(version) {
+			continue
+		}
+		imagePath := filepath.Join(imageDir, entry.Name(), ddiImageFile)
+		if _, err := os.Stat(imagePath); err != nil {
+			continue
+		}
+		if best == nil || dirVersion.GreaterThan(best) {
+			best = dirVersion
+			bestPath = imagePath
+		}
+	}
+	if best == nil {
+		return "", errImageNotFound
+	}
+	return bestPath, nil
+}
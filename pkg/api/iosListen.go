@@ -22,7 +22,7 @@ var (
 )
 
 func (s *Server) StartIosListening() {
-	for {
+	for s.ctx.Err() == nil {
 		deviceConn, err := ios.NewDeviceConnection(ios.GetUsbmuxdSocket())
 		if err != nil {
 			s.logger.Error("could not connect to usbmuxd, will retry in 3 seconds...",
@@ -41,22 +41,34 @@ func (s *Server) StartIosListening() {
 			time.Sleep(time.Second * 3)
 			continue
 		}
+		// 关闭时断开 usbmuxd 连接，让 attachedReceiver 返回
+		stopListen := context.AfterFunc(s.ctx, func() { deviceConn.Close() })
 		for {
 			msg, err := attachedReceiver()
 			if err != nil {
+				if s.ctx.Err() != nil {
+					s.logger.Info("Stopped listening because server is shutting down")
+					break
+				}
 				s.logger.Error("Stopped listening because of error", zap.Error(err))
 				break
 			}
 			fmt.Println(convertToJSONString((msg)))
 			if msg.MessageType == "Attached" {
-				time.Sleep(time.Second * 3)
-				device, _ := s.retrieveDevice(msg.Properties.SerialNumber)
-				s.iosDevices[msg.Properties.SerialNumber] = device
-				go s.runWdaCommand(device)
+				s.markAttached(msg.Properties.SerialNumber)
+				// 配对、隧道、开发者镜像和 WDA 依次检查并重试
+				s.startReadiness(msg.Properties.SerialNumber)
 			} else if msg.MessageType == "Detached" {
-				delete(s.iosDevices, msg.Properties.SerialNumber)
+				s.stopReadiness(msg.Properties.SerialNumber)
+				s.deleteIosDevice(msg.Properties.SerialNumber)
+				s.setTunnelRequired(msg.Properties.SerialNumber, false)
+				s.deleteTunnelInfo(msg.Properties.SerialNumber)
+				s.stopWda(msg.Properties.SerialNumber)
+				s.closeForwards(msg.Properties.SerialNumber)
+				s.pocoPool.CloseDevice(msg.Properties.SerialNumber)
 			}
 		}
+		stopListen()
 	}
 }
 
@@ -77,15 +89,96 @@ func marshalJSON(data interface{}) ([]byte, error) {
 	}
 }
 
-func (s *Server) runWdaCommand(device ios.DeviceEntry) {
+// startWda runs WDA on the device in the background until the device is
+// detached or the server shuts down.
+func (s *Server) startWda(device ios.DeviceEntry) {
+	if s.ctx.Err() != nil {
+		return
+	}
+	udid := device.Properties.SerialNumber
+	ctx, cancel := context.WithCancel(s.ctx)
+	run := &wdaRun{cancel: cancel, done: make(chan struct{})}
+	s.wdaMu.Lock()
+	prev, ok := s.wdaRuns[udid]
+	if ok {
+		prev.cancel()
+	}
+	s.wdaRuns[udid] = run
+	s.wdaMu.Unlock()
+
+	s.wdaWg.Add(1)
+	go func() {
+		defer s.wdaWg.Done()
+		defer close(run.done)
+		defer cancel()
+		defer s.removeWdaRun(udid, run)
+		// 上一次运行的转发释放之后再开始，否则会关掉新的转发
+		if ok {
+			<-prev.done
+		}
+		if ctx.Err() == nil {
+			s.runWdaCommand(ctx, device)
+		}
+	}()
+}
+
+// wdaRun is a WDA test run of a device, done is closed once it released its
+// forwards. A run stays in wdaRuns until it ended, also when it was stopped,
+// so that the next run of the device waits for it.
+type wdaRun struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// stopWda cancels the WDA test run of the device if there is one.
+func (s *Server) stopWda(udid string) {
+	s.wdaMu.Lock()
+	run, ok := s.wdaRuns[udid]
+	s.wdaMu.Unlock()
+	if ok {
+		run.cancel()
+	}
+}
+
+// removeWdaRun removes the ended run of the device unless a newer run
+// already replaced it, together with its proxies.
+func (s *Server) removeWdaRun(udid string, run *wdaRun) {
+	s.wdaMu.Lock()
+	defer s.wdaMu.Unlock()
+	if s.wdaRuns[udid] != run {
+		return
+	}
+	delete(s.wdaRuns, udid)
+	delete(s.wdaProxys, udid)
+	delete(s.wdaVideoProxys, udid)
+}
+
+// setWdaProxies sets the proxies to WDA and its MJPEG server of the device.
+func (s *Server) setWdaProxies(udid string, proxy, videoProxy *httputil.ReverseProxy) {
+	s.wdaMu.Lock()
+	defer s.wdaMu.Unlock()
+	s.wdaProxys[udid] = proxy
+	s.wdaVideoProxys[udid] = videoProxy
+}
+
+// wdaProxies returns the proxies to WDA and its MJPEG server of the device.
+func (s *Server) wdaProxies(udid string) (proxy, videoProxy *httputil.ReverseProxy) {
+	s.wdaMu.Lock()
+	defer s.wdaMu.Unlock()
+	return s.wdaProxys[udid], s.wdaVideoProxys[udid]
+}
+
+func (s *Server) runWdaCommand(parent context.Context, device ios.DeviceEntry) {
 
 	bundleID, testbundleID, xctestconfig := "com.facebook.WebDriverAgentRunner.QAQ.xctrunner", "com.facebook.WebDriverAgentRunner.QAQ.xctrunner", "WebDriverAgentRunner.xctest"
 	writer := io.Discard
 
-	errorChannel := make(chan error)
-	defer close(errorChannel)
-	ctx, stopWda := context.WithCancel(context.Background())
+	// 带缓冲，runWdaCommand 先返回时测试协程也不会阻塞
+	errorChannel := make(chan error, 1)
+	testDone := make(chan struct{})
+	ctx, stopWda := context.WithCancel(parent)
 	go func() {
+		defer close(testDone)
 		_, err := testmanagerd.RunTestWithConfig(ctx, testmanagerd.TestConfig{
 			BundleId:           bundleID,
 			TestRunnerBundleId: testbundleID,
@@ -101,25 +194,24 @@ func (s *Server) runWdaCommand(device ios.DeviceEntry) {
 		stopWda()
 	}()
 
+	udid := device.Properties.SerialNumber
 	targetPort := 8100
 	cl, hostPort, err := s.createForward(device, 0, targetPort)
 	if err == nil {
-		defer stopForwarding(cl)
+		defer s.removeForward(udid, targetPort, cl)
 	}
 	targetURL, _ := url.Parse(fmt.Sprintf("http://localhost:%d", hostPort))
 
 	videoTargetPort := 9100
 	videoCl, videoHostPort, err := s.createForward(device, 0, videoTargetPort)
 	if err == nil {
-		defer stopForwarding(videoCl)
+		defer s.removeForward(udid, videoTargetPort, videoCl)
 	}
 	videoTargetURL, _ := url.Parse(fmt.Sprintf("http://localhost:%d", videoHostPort))
 
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-	s.wdaProxys[device.Properties.SerialNumber] = proxy
-
 	videoProxy := httputil.NewSingleHostReverseProxy(videoTargetURL)
-	s.wdaVideoProxys[device.Properties.SerialNumber] = videoProxy
+	s.setWdaProxies(udid, proxy, videoProxy)
 
 	// client := &http.Client{
 	// 	Timeout: 2 * time.Second, // 设置超时避免阻塞
@@ -157,8 +249,14 @@ func (s *Server) runWdaCommand(device ios.DeviceEntry) {
 		s.logger.Error("Failed running WDA", zap.Error(err))
 		stopWda()
 	case <-ctx.Done():
-		s.logger.Error("WDA process ended unexpectedly")
+		if parent.Err() != nil {
+			s.logger.Info("WDA cancelled", zap.String("udid", udid))
+		} else {
+			s.logger.Error("WDA process ended unexpectedly")
+		}
 	}
+	// 等待 XCTest 会话真正结束后再释放转发
+	<-testDone
 	s.logger.Info("Done Closing")
 }
 
@@ -0,0 +1,360 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 配对相关的错误码，放在 GenericResponse.Code 中返回
+const (
+	codeNotPaired    = "device_not_paired"
+	codeTrustPending = "trust_pending"
+)
+
+const (
+	mcInstallService = "com.apple.mobile.MCInstall"
+	lockdownLabel    = "go-ios-android"
+)
+
+// lockdown 的错误码
+const (
+	lockdownInvalidHostID     = "InvalidHostID"
+	lockdownInvalidPairRecord = "InvalidPairRecord"
+	lockdownUserDeniedPairing = "UserDeniedPairing"
+	lockdownDialogPending     = "PairingDialogResponsePending"
+)
+
+var (
+	errNotPaired    = errors.New("device is not paired with this host")
+	errTrustPending = errors.New("please accept the trust dialog on the device and pair again")
+)
+
+// lockdownError is the error code lockdown answered a request with, it
+// matches errNotPaired and errTrustPending with errors.Is.
+type lockdownError struct {
+	request string
+	code    string
+}
+
+func (e *lockdownError) Error() string {
+	return fmt.Sprintf("lockdown %s: %s", e.request, e.code)
+}
+
+func (e *lockdownError) Is(target error) bool {
+	switch target {
+	case errNotPaired:
+		return e.code == lockdownInvalidHostID || e.code == lockdownInvalidPairRecord || e.code == lockdownUserDeniedPairing
+	case errTrustPending:
+		return e.code == lockdownDialogPending
+	}
+	return false
+}
+
+// lockdownRequest sends a request and returns the response, an Error in it
+// is returned as lockdownError.
+func lockdownRequest(lockdown *ios.LockDownConnection, request map[string]interface{}) (map[string]interface{}, error) {
+	request["Label"] = lockdownLabel
+	if err := lockdown.Send(request); err != nil {
+		return nil, err
+	}
+	resp, err := lockdown.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	respPlist, err := ios.ParsePlist(resp)
+	if err != nil {
+		return nil, err
+	}
+	if code, ok := respPlist["Error"].(string); ok {
+		return nil, &lockdownError{request: fmt.Sprint(request["Request"]), code: code}
+	}
+	return respPlist, nil
+}
+
+// readPairRecord reads the pair record of the device from usbmuxd, which
+// only fails to answer with one when the host is not paired.
+func readPairRecord(udid string) (ios.PairRecord, error) {
+	muxConn, err := ios.NewUsbMuxConnectionSimple()
+	if err != nil {
+		return ios.PairRecord{}, err
+	}
+	defer muxConn.Close()
+	pairRecord, err := muxConn.ReadPair(udid)
+	if err != nil {
+		return ios.PairRecord{}, fmt.Errorf("%w: %v", errNotPaired, err)
+	}
+	return pairRecord, nil
+}
+
+// startLockdownSession connects to lockdown and starts a session with the
+// pair record of the host. Unlike ios.ConnectLockdownWithSession it keeps
+// the error code of lockdown, a device that revoked the trust answers with
+// InvalidHostID.
+func startLockdownSession(device ios.DeviceEntry) (*ios.LockDownConnection, error) {
+	pairRecord, err := readPairRecord(device.Properties.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	muxConn, err := ios.NewUsbMuxConnectionSimple()
+	if err != nil {
+		return nil, err
+	}
+	lockdown, err := muxConn.ConnectLockdown(device.DeviceID)
+	if err != nil {
+		muxConn.Close()
+		return nil, err
+	}
+	resp, err := lockdownRequest(lockdown, map[string]interface{}{
+		"Request":         "StartSession",
+		"ProtocolVersion": "2",
+		"HostID":          pairRecord.HostID,
+		"SystemBUID":      pairRecord.SystemBUID,
+	})
+	if err == nil {
+		if ssl, _ := resp["EnableSessionSSL"].(bool); ssl {
+			err = lockdown.EnableSessionSsl(pairRecord)
+		}
+	}
+	if err != nil {
+		lockdown.Close()
+		return nil, err
+	}
+	return lockdown, nil
+}
+
+// isPairingDialogPending reports whether ios.Pair failed because the trust
+// dialog is still open. go-ios turns lockdown's PairingDialogResponsePending
+// into this message only, ios.Pair has no error value to match instead.
+func isPairingDialogPending(err error) bool {
+	return err != nil && err.Error() == "Please accept the PairingDialog on the device and run pairing again!"
+}
+
+// errorCode returns the API error code for pairing errors, "" for others.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, errNotPaired):
+		return codeNotPaired
+	case errors.Is(err, errTrustPending):
+		return codeTrustPending
+	}
+	return ""
+}
+
+// AttachedDeviceMiddleware is DeviceMiddleware for devices that are attached
+// but not usable yet, e.g. because they are not paired.
+func (s *Server) AttachedDeviceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		udid := c.Param("udid")
+		if udid == "" {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"message": "udid is missing"})
+			return
+		}
+		device, ok := s.iosDevice(udid)
+		if !ok {
+			var err error
+			device, err = ios.GetDevice(udid)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "device not found on the host"})
+				return
+			}
+		}
+		c.Set(IOS_KEY, device)
+		c.Next()
+	}
+}
+
+func (s *Server) hRetrievePairing(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+
+	paired := false
+	// 有配对记录还要能建立会话，设备端可能已经取消信任
+	lockdown, err := startLockdownSession(device)
+	if err == nil {
+		lockdown.Close()
+		paired = true
+	}
+	ret := gin.H{
+		"paired":        paired,
+		"trust_pending": s.trustPending(udid),
+	}
+	if err != nil {
+		ret["error"] = err.Error()
+	}
+	if paired {
+		if supervised, err := isSupervised(device); err == nil {
+			ret["supervised"] = supervised
+		} else {
+			s.logger.Warn("failed to get supervision status", zap.String("udid", udid), zap.Error(err))
+		}
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+// hPair pairs the host with the device. Unsupervised devices show the trust
+// dialog on the first call, after accepting it the call has to be repeated.
+// Supervised devices pair silently when the supervision identity is uploaded
+// as p12 form file with its password.
+func (s *Server) hPair(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+
+	var err error
+	if file, formErr := c.FormFile("p12"); formErr == nil {
+		f, openErr := file.Open()
+		if openErr != nil {
+			c.JSON(http.StatusBadRequest, GenericResponse{Error: openErr.Error()})
+			return
+		}
+		p12, readErr := io.ReadAll(f)
+		f.Close()
+		if readErr != nil {
+			c.JSON(http.StatusBadRequest, GenericResponse{Error: readErr.Error()})
+			return
+		}
+		s.logger.Info("pairing supervised", zap.String("udid", udid))
+		err = ios.PairSupervised(device, p12, c.PostForm("password"))
+	} else {
+		s.logger.Info("pairing", zap.String("udid", udid))
+		err = ios.Pair(device)
+	}
+	if isPairingDialogPending(err) {
+		s.setTrustPending(udid)
+		c.JSON(http.StatusAccepted, GenericResponse{Error: errTrustPending.Error(), Code: codeTrustPending})
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to pair", zap.String("udid", udid), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	s.startReadiness(udid)
+	c.JSON(http.StatusOK, GenericResponse{Message: "paired " + udid})
+}
+
+func (s *Server) hUnpair(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+	s.logger.Info("unpairing", zap.String("udid", udid))
+
+	if err := unpair(device); err != nil {
+		s.logger.Error("failed to unpair", zap.String("udid", udid), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error(), Code: errorCode(err)})
+		return
+	}
+
+	// 设备不再可用，重新走就绪流程让状态变为未配对
+	s.stopWda(udid)
+	s.deleteIosDevice(udid)
+	s.startReadiness(udid)
+	c.JSON(http.StatusOK, GenericResponse{Message: "unpaired " + udid})
+}
+
+func (s *Server) trustPending(udid string) bool {
+	state := s.deviceState(udid)
+	return state != nil && state.State == stateTrustPending
+}
+
+func (s *Server) setTrustPending(udid string) {
+	s.readinessMu.Lock()
+	defer s.readinessMu.Unlock()
+	if state, ok := s.readiness[udid]; ok {
+		state.State = stateTrustPending
+	}
+}
+
+// unpair removes the pairing on the device and the pair record of usbmuxd.
+func unpair(device ios.DeviceEntry) error {
+	udid := device.Properties.SerialNumber
+	pairRecord, err := readPairRecord(udid)
+	if err != nil {
+		return err
+	}
+
+	muxConn, err := ios.NewUsbMuxConnectionSimple()
+	if err != nil {
+		return err
+	}
+	lockdown, err := muxConn.ConnectLockdown(device.DeviceID)
+	if err != nil {
+		muxConn.Close()
+		return err
+	}
+	defer lockdown.Close()
+	_, err = lockdownRequest(lockdown, map[string]interface{}{
+		"Request": "Unpair",
+		"PairRecord": map[string]interface{}{
+			"HostID":            pairRecord.HostID,
+			"SystemBUID":        pairRecord.SystemBUID,
+			"HostCertificate":   pairRecord.HostCertificate,
+			"DeviceCertificate": pairRecord.DeviceCertificate,
+			"RootCertificate":   pairRecord.RootCertificate,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return deletePairRecord(udid)
+}
+
+func deletePairRecord(udid string) error {
+	muxConn, err := ios.NewUsbMuxConnectionSimple()
+	if err != nil {
+		return err
+	}
+	defer muxConn.Close()
+	err = muxConn.Send(map[string]interface{}{
+		"BundleID":            "go.ios.control",
+		"ClientVersionString": "go-usbmux-0.0.1",
+		"MessageType":         "DeletePairRecord",
+		"ProgName":            "go-usbmux",
+		"kLibUSBMuxVersion":   3,
+		"PairRecordID":        udid,
+	})
+	if err != nil {
+		return err
+	}
+	msg, err := muxConn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	result, err := ios.ParsePlist(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if number, ok := result["Number"].(uint64); ok && number != 0 {
+		return fmt.Errorf("usbmuxd: DeletePairRecord failed with %d", number)
+	}
+	return nil
+}
+
+// isSupervised reads the cloud configuration of the device from MCInstall.
+func isSupervised(device ios.DeviceEntry) (bool, error) {
+	conn, err := ios.ConnectToService(device, mcInstallService)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	plistRw := ios.NewPlistCodecReadWriter(conn.Reader(), conn.Writer())
+	if err := plistRw.Write(map[string]interface{}{"RequestType": "GetCloudConfiguration"}); err != nil {
+		return false, err
+	}
+	var resp map[string]interface{}
+	if err := plistRw.Read(&resp); err != nil {
+		return false, err
+	}
+	config, ok := resp["CloudConfiguration"].(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+	supervised, _ := config["IsSupervised"].(bool)
+	return supervised, nil
+}
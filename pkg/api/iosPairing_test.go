@@ -0,0 +1,33 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestLockdownError(t *testing.T) {
+	tests := []struct {
+		code         string
+		notPaired    bool
+		trustPending bool
+	}{
+		{lockdownInvalidHostID, true, false},
+		{lockdownInvalidPairRecord, true, false},
+		{lockdownUserDeniedPairing, true, false},
+		{lockdownDialogPending, false, true},
+		{"PasswordProtected", false, false},
+		{"SessionInactive", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			err := fmt.Errorf("lockdown: %w", &lockdownError{request: "StartSession", code: tt.code})
+			if got := errors.Is(err, errNotPaired); got != tt.notPaired {
+				t.Errorf("errors.Is(errNotPaired) = %v, want %v", got, tt.notPaired)
+			}
+			if got := errors.Is(err, errTrustPending); got != tt.trustPending {
+				t.Errorf("errors.Is(errTrustPending) = %v, want %v", got, tt.trustPending)
+			}
+		})
+	}
+}
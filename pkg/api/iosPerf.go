@@ -115,6 +115,9 @@ func (s *Server) hPerf(c *gin.Context) {
 		case <-c.Request.Context().Done(): // 处理客户端断开
 			s.logger.Info("client disconnected, stop streaming.")
 			return false
+		case <-s.ctx.Done(): // 服务关闭
+			s.closeStream(c)
+			return false
 		case jsonData, ok := <-sysData:
 			if !ok {
 				s.logger.Info("performance data channel closed.")
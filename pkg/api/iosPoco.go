@@ -1,51 +1,42 @@
 package api
 
 import (
-	"encoding/json"
 	"net/http"
 
 	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
-	"github.com/blacklee123/go-ios-android/pkg/utils/validator"
 	"github.com/danielpaulus/go-ios/ios"
 	"github.com/gin-gonic/gin"
 )
 
-func (s *Server) hPocoDump(c *gin.Context) {
-	portStr := c.Param("port")
-	port, err := validator.Port(portStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, GenericResponse{Error: "invalid port"})
-		return
-	}
-	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
-
-	forwaredPort, ok := s.iosForwards[device.Properties.SerialNumber][port]
-
-	if !ok {
-		_, forwaredPort, err = s.createForward(device, 0, port)
+// IosPocoMiddleware forwards the SDK port of the device if needed and sets
+// a client connected through it as POCO_KEY.
+func (s *Server) IosPocoMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		port, err := pocoPort(c.Param("port"))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+			c.AbortWithStatusJSON(http.StatusBadRequest, GenericResponse{Error: "invalid port"})
 			return
 		}
+		device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+		pocoClient, release, err := s.iosPocoClient(device, port)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+			return
+		}
+		defer release()
+		c.Set(POCO_KEY, pocoClient)
+		c.Next()
 	}
-	pocoClient := poco.NewPocoClient(forwaredPort)
-	dump, err := pocoClient.Dump()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
-		return
-	}
-
-	// 提取result字段
-	var result map[string]interface{}
-	if err := json.Unmarshal([]byte(dump), &result); err != nil {
-		c.JSON(http.StatusInternalServerError, GenericResponse{Error: "Failed to parse dump result"})
-		return
-	}
+}
 
-	if resultData, exists := result["result"]; exists {
-		c.JSON(http.StatusOK, resultData)
-	} else {
-		c.JSON(http.StatusInternalServerError, GenericResponse{Error: "No result field found in response"})
+// iosPocoClient returns the pooled client for the SDK port of the device,
+// release has to be called once the client is no longer used.
+func (s *Server) iosPocoClient(device ios.DeviceEntry, port int) (*poco.PocoClient, func(), error) {
+	udid := device.Properties.SerialNumber
+	_, forwaredPort, err := s.createForward(device, 0, port)
+	if err != nil {
+		return nil, nil, err
 	}
-
+	client, release := s.pocoPool.Get(udid, port, forwaredPort)
+	return client, release, nil
 }
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/diagnostics"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const diagnosticsRelayService = "com.apple.mobile.diagnostics_relay"
+
+// hIosReboot restarts the device, with wait=true the call returns once the
+// device is attached again and the readiness pipeline reports it ready. Only
+// an unpaired device or one waiting for the tunnel agent ends the wait early.
+func (s *Server) hIosReboot(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+	wait, timeout, err := rebootWaitOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	generation := s.attachGeneration(udid)
+	s.logger.Info("rebooting", zap.String("udid", udid))
+	if err := diagnostics.Reboot(device); err != nil {
+		s.logger.Error("failed to reboot", zap.String("udid", udid), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	if !wait {
+		c.JSON(http.StatusAccepted, GenericResponse{Message: "rebooting " + udid})
+		return
+	}
+
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	err = s.waitForReattach(ctx, udid, generation, timeout, func() (bool, error) {
+		state := s.deviceState(udid)
+		if state == nil {
+			return false, nil
+		}
+		if state.State == stateReady {
+			return true, nil
+		}
+		// 仍在慢速重试的阶段（如刚开机时的 WDA）继续等到超时
+		if state.RetryAt == nil && (state.State == stateUnpaired || state.State == stateTunnelRequired) {
+			return false, fmt.Errorf("device is back but %s", state.State)
+		}
+		return false, nil
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errRebootTimeout) {
+			status = http.StatusGatewayTimeout
+		}
+		c.JSON(status, gin.H{"error": err.Error(), "readiness": s.deviceState(udid)})
+		return
+	}
+	c.JSON(http.StatusOK, GenericResponse{Message: "rebooted " + udid})
+}
+
+func (s *Server) hIosShutdown(c *gin.Context) {
+	s.diagnosticsRelayAction(c, "Shutdown")
+}
+
+func (s *Server) hIosSleep(c *gin.Context) {
+	s.diagnosticsRelayAction(c, "Sleep")
+}
+
+func (s *Server) diagnosticsRelayAction(c *gin.Context, request string) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+	s.logger.Info("diagnostics relay", zap.String("udid", udid), zap.String("request", request))
+	if err := diagnosticsRelay(device, request); err != nil {
+		s.logger.Error("diagnostics relay failed", zap.String("udid", udid), zap.String("request", request), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, GenericResponse{Message: request + " " + udid})
+}
+
+// diagnosticsRelay sends a power request (Restart, Shutdown, Sleep) to the
+// diagnostics relay, go-ios only ships Restart.
+func diagnosticsRelay(device ios.DeviceEntry, request string) error {
+	conn, err := ios.ConnectToService(device, diagnosticsRelayService)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	plistRw := ios.NewPlistCodecReadWriter(conn.Reader(), conn.Writer())
+	err = plistRw.Write(map[string]interface{}{
+		"Request":           request,
+		"WaitForDisconnect": true,
+		"DisplayPass":       true,
+		"DisplayFail":       true,
+	})
+	if err != nil {
+		return err
+	}
+	var resp map[string]interface{}
+	if err := plistRw.Read(&resp); err != nil {
+		return err
+	}
+	if status, _ := resp["Status"].(string); status != "Success" {
+		return fmt.Errorf("%s failed, response: %+v", request, resp)
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/blacklee123/go-ios-android/pkg/api/iosvo"
+	"github.com/blacklee123/go-ios-android/pkg/utils"
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/imagemounter"
+	"github.com/danielpaulus/go-ios/ios/tunnel"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// 就绪流程的阶段，按顺序执行
+const (
+	stagePairing = "pairing"
+	stageTunnel  = "tunnel"
+	stageImage   = "image"
+	stageWda     = "wda"
+)
+
+// 设备整体状态
+const (
+	statePreparing      = "preparing"
+	stateReady          = "ready"
+	stateUnpaired       = "unpaired"
+	stateTrustPending   = "trust_pending"
+	stateTunnelRequired = "tunnel_required"
+	stateFailed         = "failed"
+)
+
+// 单个阶段的状态
+const (
+	stageStatusPending = "pending"
+	stageStatusRunning = "running"
+	stageStatusOK      = "ok"
+	stageStatusFailed  = "failed"
+)
+
+const (
+	readinessBackoff    = time.Second
+	readinessMaxBackoff = 10 * time.Second
+	// readinessSlowRetry 是阶段用完重试次数后再次尝试的间隔
+	readinessSlowRetry = time.Minute
+	wdaStatusTimeout   = 2 * time.Second
+)
+
+var (
+	errTunnelRequired    = errors.New("device requires the iOS tunnel")
+	errImageNotMounted   = errors.New("developer disk image is not mounted")
+	errWdaNotForwarded   = errors.New("WDA port is not forwarded")
+	errDeviceNotAttached = errors.New("device is not attached")
+)
+
+// deviceSetup carries what earlier stages found out to later ones.
+type deviceSetup struct {
+	udid       string
+	device     ios.DeviceEntry
+	wdaStarted bool
+}
+
+type readinessStage struct {
+	name     string
+	attempts int
+	run      func(ctx context.Context, setup *deviceSetup) error
+}
+
+func (s *Server) readinessStages() []readinessStage {
+	return []readinessStage{
+		{name: stagePairing, attempts: 5, run: s.checkPairing},
+		{name: stageTunnel, attempts: 5, run: s.checkTunnel},
+		{name: stageImage, attempts: 3, run: s.checkImage},
+		{name: stageWda, attempts: 10, run: s.checkWda},
+	}
+}
+
+func newDeviceState() *iosvo.DeviceState {
+	stages := make([]iosvo.StageState, 0, 4)
+	for _, stage := range []string{stagePairing, stageTunnel, stageImage, stageWda} {
+		stages = append(stages, iosvo.StageState{Name: stage, Status: stageStatusPending})
+	}
+	return &iosvo.DeviceState{
+		State:     statePreparing,
+		Stages:    stages,
+		UpdatedAt: time.Now(),
+	}
+}
+
+// startReadiness (re)starts the readiness pipeline of the device in the
+// background, a pipeline that is still running for it is cancelled.
+func (s *Server) startReadiness(udid string) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.readinessMu.Lock()
+	if prev, ok := s.readinessCancels[udid]; ok {
+		prev()
+	}
+	s.readinessCancels[udid] = cancel
+	s.readiness[udid] = newDeviceState()
+	s.readinessMu.Unlock()
+
+	go s.prepareDevice(ctx, udid)
+}
+
+// stopReadiness cancels the pipeline of the device and forgets its state.
+func (s *Server) stopReadiness(udid string) {
+	s.readinessMu.Lock()
+	cancel, ok := s.readinessCancels[udid]
+	delete(s.readinessCancels, udid)
+	delete(s.readiness, udid)
+	s.readinessMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// updateState applies fn to the state of the device unless the pipeline
+// owning ctx has been replaced or cancelled in the meantime.
+func (s *Server) updateState(ctx context.Context, udid string, fn func(state *iosvo.DeviceState)) {
+	s.readinessMu.Lock()
+	defer s.readinessMu.Unlock()
+	state, ok := s.readiness[udid]
+	if !ok || ctx.Err() != nil {
+		return
+	}
+	fn(state)
+	state.UpdatedAt = time.Now()
+}
+
+// deviceState returns a copy of the readiness state, nil if there is none.
+func (s *Server) deviceState(udid string) *iosvo.DeviceState {
+	s.readinessMu.Lock()
+	defer s.readinessMu.Unlock()
+	state, ok := s.readiness[udid]
+	if !ok {
+		return nil
+	}
+	cp := *state
+	cp.Stages = append([]iosvo.StageState(nil), state.Stages...)
+	if state.RetryAt != nil {
+		retryAt := *state.RetryAt
+		cp.RetryAt = &retryAt
+	}
+	return &cp
+}
+
+// prepareDevice runs the stages in order. A stage that fails for a reason
+// nothing else recovers from is tried again after readinessSlowRetry, until
+// it succeeds or the pipeline is cancelled. This includes a missing tunnel
+// while the tunnel agent is running.
+func (s *Server) prepareDevice(ctx context.Context, udid string) {
+	setup := &deviceSetup{udid: udid}
+	stages := s.readinessStages()
+	for i := 0; i < len(stages); i++ {
+		stage := stages[i]
+		s.updateState(ctx, udid, func(state *iosvo.DeviceState) {
+			state.Stage = stage.name
+			state.Stages[i].Status = stageStatusRunning
+		})
+		err := utils.Retry(ctx, stage.attempts, readinessBackoff, readinessMaxBackoff, func(attempt int) error {
+			err := stage.run(ctx, setup)
+			s.updateState(ctx, udid, func(state *iosvo.DeviceState) {
+				state.Stages[i].Attempts = attempt
+				state.Stages[i].Error = ""
+				if err != nil {
+					state.Stages[i].Error = err.Error()
+				}
+			})
+			return err
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger.Warn("device not ready",
+				zap.String("udid", udid),
+				zap.String("stage", stage.name),
+				zap.Error(err))
+			// 未配对时由 /pair 重新开始，隧道服务未启动时由 watchIosTunnel
+			// 重新开始；隧道服务已启动时设备的隧道可能只是还没建立好
+			waitForAgent := errors.Is(err, errTunnelRequired) && !tunnel.IsAgentRunning()
+			slowRetry := !errors.Is(err, errNotPaired) && !waitForAgent
+			retryAt := time.Now().Add(readinessSlowRetry)
+			s.updateState(ctx, udid, func(state *iosvo.DeviceState) {
+				state.Stages[i].Status = stageStatusFailed
+				switch {
+				case errors.Is(err, errNotPaired):
+					state.State = stateUnpaired
+				case errors.Is(err, errTunnelRequired):
+					state.State = stateTunnelRequired
+				default:
+					state.State = stateFailed
+				}
+				if slowRetry {
+					state.RetryAt = &retryAt
+				}
+			})
+			if !slowRetry {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(readinessSlowRetry):
+			}
+			s.updateState(ctx, udid, func(state *iosvo.DeviceState) {
+				state.State = statePreparing
+				state.RetryAt = nil
+			})
+			// WDA 可能已经退出，重试时重新启动
+			setup.wdaStarted = false
+			i--
+			continue
+		}
+		s.updateState(ctx, udid, func(state *iosvo.DeviceState) {
+			state.Stages[i].Status = stageStatusOK
+		})
+	}
+	s.logger.Info("device ready", zap.String("udid", udid))
+	s.updateState(ctx, udid, func(state *iosvo.DeviceState) {
+		state.State = stateReady
+		state.Stage = ""
+	})
+}
+
+// checkPairing makes sure lockdown accepts the pair record of the host.
+func (s *Server) checkPairing(ctx context.Context, setup *deviceSetup) error {
+	device, err := ios.GetDevice(setup.udid)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDeviceNotAttached, err)
+	}
+	lockdown, err := startLockdownSession(device)
+	if err != nil {
+		if errors.Is(err, errNotPaired) {
+			// 需要在设备上信任或调用 /pair，重试没有意义
+			return utils.Permanent(err)
+		}
+		return fmt.Errorf("lockdown: %w", err)
+	}
+	lockdown.Close()
+	setup.device = device
+	s.setIosDevice(device)
+	return nil
+}
+
+// checkTunnel resolves the RSD services of the device, devices before iOS 17
+// pass without a tunnel.
+func (s *Server) checkTunnel(ctx context.Context, setup *deviceSetup) error {
+	device, err := s.retrieveDevice(setup.udid)
+	if err != nil {
+		return err
+	}
+	if s.tunnelRequired(setup.udid) {
+		if !tunnel.IsAgentRunning() {
+			// watchIosTunnel 会在隧道启动后重新执行
+			return utils.Permanent(errTunnelRequired)
+		}
+		return errTunnelRequired
+	}
+	setup.device = device
+	s.setIosDevice(device)
+	return nil
+}
+
+// checkImage makes sure a developer disk image is mounted, instruments and
+// testmanagerd are not available without one. An image found in ImageDir is
+// mounted automatically.
+func (s *Server) checkImage(ctx context.Context, setup *deviceSetup) error {
+	signatures, err := listImageSignatures(setup.device)
+	if err != nil {
+		return err
+	}
+	if len(signatures) > 0 {
+		return nil
+	}
+	version, err := ios.GetProductVersion(setup.device)
+	if err != nil {
+		return err
+	}
+	imagePath, err := findLocalImage(s.config.ImageDir, version)
+	if err != nil {
+		return utils.Permanent(fmt.Errorf("%w: %v", errImageNotMounted, err))
+	}
+	s.logger.Info("mounting developer disk image", zap.String("udid", setup.udid), zap.String("image", imagePath))
+	if err := imagemounter.MountImage(setup.device, imagePath); err != nil {
+		return fmt.Errorf("%w: %v", errImageNotMounted, err)
+	}
+	return nil
+}
+
+// checkWda starts WDA once and waits until its /status answers.
+func (s *Server) checkWda(ctx context.Context, setup *deviceSetup) error {
+	if !setup.wdaStarted {
+		s.startWda(setup.device)
+		setup.wdaStarted = true
+	}
+	hostPort, ok := s.forwardPort(setup.udid, wdaPort)
+	if !ok {
+		return errWdaNotForwarded
+	}
+	ctx, cancel := context.WithTimeout(ctx, wdaStatusTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://localhost:%d/status", hostPort), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("WDA not reachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("WDA status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *Server) hListReadiness(c *gin.Context) {
+	s.readinessMu.Lock()
+	udids := make([]string, 0, len(s.readiness))
+	for udid := range s.readiness {
+		udids = append(udids, udid)
+	}
+	s.readinessMu.Unlock()
+
+	states := make(map[string]*iosvo.DeviceState, len(udids))
+	for _, udid := range udids {
+		if state := s.deviceState(udid); state != nil {
+			states[udid] = state
+		}
+	}
+	c.JSON(http.StatusOK, states)
+}
+
+func (s *Server) hRetrieveReadiness(c *gin.Context) {
+	udid := c.Param("udid")
+	state := s.deviceState(udid)
+	if state == nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: "no readiness state for device"})
+		return
+	}
+	c.JSON(http.StatusOK, state)
+}
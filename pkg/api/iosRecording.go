@@ -0,0 +1,180 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blacklee123/go-ios-android/pkg/api/iosvo"
+	"github.com/blacklee123/go-ios-android/pkg/utils/mjpeg"
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	wdaMjpegPort  = 9100
+	mjpegFileName = "recording.mjpeg"
+)
+
+var errNoFrames = errors.New("recording has no frames")
+
+// mjpegCapture is the frame index of an iOS recording, the frames themselves
+// are appended to recording.mjpeg.
+type mjpegCapture struct {
+	mu            sync.Mutex
+	frames        []mjpeg.Frame
+	first, last   time.Time
+	width, height int
+}
+
+// fps is the average frame rate, WDA only sends frames when the screen changes
+// so the real rate varies.
+func (m *mjpegCapture) fps() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seconds := m.last.Sub(m.first).Seconds()
+	if len(m.frames) < 2 || seconds <= 0 {
+		return 1
+	}
+	return float64(len(m.frames)-1) / seconds
+}
+
+// hStartIosRecording records the WDA MJPEG stream of the device on the server.
+func (s *Server) hStartIosRecording(c *gin.Context) {
+	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+	udid := device.Properties.SerialNumber
+	options, maxDuration, err := parseRecordingOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	hostPort, ok := s.forwardPort(udid, wdaMjpegPort)
+	if !ok {
+		c.JSON(http.StatusConflict, GenericResponse{Error: "WDA MJPEG port is not forwarded, is WDA running?"})
+		return
+	}
+
+	formats := []string{"mjpeg", "avi"}
+	if s.config.FFmpeg != "" {
+		formats = append(formats, "mp4")
+	}
+	capture := &mjpegCapture{}
+	rec, err := s.startRecording(udid, "ios", formats, maxDuration,
+		func(ctx context.Context, rec *recording) error {
+			return s.captureMjpeg(ctx, rec, capture, hostPort, options.MaxSize)
+		},
+		func(rec *recording) func(ctx context.Context, format string) (string, error) {
+			return func(ctx context.Context, format string) (string, error) {
+				return s.exportMjpeg(ctx, rec, capture, format)
+			}
+		})
+	if err != nil {
+		c.JSON(http.StatusConflict, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, rec.snapshot())
+}
+
+func (s *Server) captureMjpeg(ctx context.Context, rec *recording, capture *mjpegCapture, hostPort int, maxSize int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://localhost:%d/", hostPort), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("MJPEG stream: %s", resp.Status)
+	}
+
+	f, err := os.Create(filepath.Join(rec.dir, mjpegFileName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := mjpeg.NewReader(resp.Body)
+	var offset int64
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if offset+int64(len(frame)) > maxSize {
+			return errRecordingMaxSize
+		}
+		if _, err := f.Write(frame); err != nil {
+			return err
+		}
+		now := time.Now()
+		capture.mu.Lock()
+		if len(capture.frames) == 0 {
+			capture.first = now
+			if config, err := jpeg.DecodeConfig(bytes.NewReader(frame)); err == nil {
+				capture.width, capture.height = config.Width, config.Height
+			}
+		}
+		capture.last = now
+		capture.frames = append(capture.frames, mjpeg.Frame{Offset: offset, Size: len(frame)})
+		frames := len(capture.frames)
+		duration := now.Sub(capture.first).Seconds()
+		capture.mu.Unlock()
+		offset += int64(len(frame))
+
+		rec.update(func(info *iosvo.Recording) {
+			info.Frames = frames
+			info.Size = offset
+			info.Duration = duration
+		})
+	}
+}
+
+func (s *Server) exportMjpeg(ctx context.Context, rec *recording, capture *mjpegCapture, format string) (string, error) {
+	source := filepath.Join(rec.dir, mjpegFileName)
+	capture.mu.Lock()
+	frames := append([]mjpeg.Frame(nil), capture.frames...)
+	width, height := capture.width, capture.height
+	capture.mu.Unlock()
+	if len(frames) == 0 {
+		return "", errNoFrames
+	}
+
+	switch format {
+	case "avi":
+		return exportOnce(filepath.Join(rec.dir, "recording.avi"), func(tmp string) error {
+			src, err := os.Open(source)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			out, err := os.Create(tmp)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+			return mjpeg.WriteAVI(out, src, frames, width, height, capture.fps())
+		})
+	case "mp4":
+		return exportOnce(filepath.Join(rec.dir, "recording.mp4"), func(tmp string) error {
+			// 宽高需为偶数，libx264 才能编码
+			return s.ffmpeg(ctx,
+				"-f", "mjpeg", "-framerate", strconv.FormatFloat(capture.fps(), 'f', 3, 64), "-i", source,
+				"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2", "-c:v", "libx264", "-pix_fmt", "yuv420p",
+				"-f", "mp4", tmp)
+		})
+	}
+	return source, nil
+}
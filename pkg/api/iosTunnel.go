@@ -2,10 +2,20 @@ package api
 
 import (
 	"errors"
+	"net/http"
+	"time"
 
+	"github.com/blacklee123/go-ios-android/pkg/api/iosvo"
+	"github.com/danielpaulus/go-ios/ios"
 	"github.com/danielpaulus/go-ios/ios/tunnel"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 )
 
+// tunnelCheckInterval is how often a server started without the tunnel agent
+// checks whether the agent has come up.
+const tunnelCheckInterval = 5 * time.Second
+
 func (s *Server) StartIosTunnel() error {
 	if tunnel.IsAgentRunning() {
 		s.logger.Info("iOS tunnel is already running")
@@ -13,3 +23,172 @@ func (s *Server) StartIosTunnel() error {
 	}
 	return errors.New("iOS tunnel is not running")
 }
+
+// watchIosTunnel checks the tunnel agent for the lifetime of the server.
+// Every time the agent comes up the devices waiting for it are resolved,
+// devices marked while it is up are tried once more.
+func (s *Server) watchIosTunnel(running bool) {
+	ticker := time.NewTicker(tunnelCheckInterval)
+	defer ticker.Stop()
+	// 本次隧道可用期间已重试过的设备
+	attempted := make(map[string]bool)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !tunnel.IsAgentRunning() {
+			if running {
+				s.logger.Warn("iOS tunnel agent stopped, iOS 17+ devices are unavailable until it is back")
+				running = false
+			}
+			continue
+		}
+		if !running {
+			s.logger.Info("iOS tunnel agent detected, resolving waiting devices")
+			running = true
+			clear(attempted)
+		}
+		s.resolveTunnelRequired(attempted)
+	}
+}
+
+// resolveTunnelRequired restarts the readiness pipeline of every device that
+// was marked as needing the tunnel.
+func (s *Server) resolveTunnelRequired(attempted map[string]bool) {
+	s.tunnelMu.Lock()
+	// 不再需要隧道的设备下次被标记时重新尝试
+	for udid := range attempted {
+		if !s.iosTunnelRequired[udid] {
+			delete(attempted, udid)
+		}
+	}
+	udids := make([]string, 0, len(s.iosTunnelRequired))
+	for udid := range s.iosTunnelRequired {
+		if !attempted[udid] {
+			attempted[udid] = true
+			udids = append(udids, udid)
+		}
+	}
+	s.tunnelMu.Unlock()
+
+	for _, udid := range udids {
+		s.startReadiness(udid)
+	}
+}
+
+// needsTunnel reports whether the device only offers developer services over
+// RSD, which is the case from iOS 17 on.
+func needsTunnel(device ios.DeviceEntry) bool {
+	version, err := ios.GetProductVersion(device)
+	if err != nil {
+		return false
+	}
+	return version.Major() >= 17
+}
+
+func (s *Server) setTunnelRequired(udid string, required bool) {
+	s.tunnelMu.Lock()
+	defer s.tunnelMu.Unlock()
+	if required {
+		s.iosTunnelRequired[udid] = true
+	} else {
+		delete(s.iosTunnelRequired, udid)
+	}
+}
+
+func (s *Server) tunnelRequired(udid string) bool {
+	s.tunnelMu.Lock()
+	defer s.tunnelMu.Unlock()
+	return s.iosTunnelRequired[udid]
+}
+
+// TunnelMiddleware rejects requests to services that need RSD with 503 while
+// the device is waiting for the tunnel. Must run after DeviceMiddleware.
+func (s *Server) TunnelMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
+		if s.tunnelRequired(device.Properties.SerialNumber) {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, GenericResponse{
+				Error: "tunnel required, please use `sudo go-ios-android tunnel start` to start",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+func (s *Server) setTunnelInfo(udid string, info iosvo.TunnelInfo) {
+	s.tunnelMu.Lock()
+	defer s.tunnelMu.Unlock()
+	s.iosTunnels[udid] = info
+}
+
+func (s *Server) deleteTunnelInfo(udid string) {
+	s.tunnelMu.Lock()
+	defer s.tunnelMu.Unlock()
+	delete(s.iosTunnels, udid)
+}
+
+// tunnelInfo returns the tunnel of the device, nil if it was never looked up.
+func (s *Server) tunnelInfo(udid string) *iosvo.TunnelInfo {
+	s.tunnelMu.Lock()
+	defer s.tunnelMu.Unlock()
+	info, ok := s.iosTunnels[udid]
+	if !ok {
+		return nil
+	}
+	return &info
+}
+
+func (s *Server) hTunnel(c *gin.Context) {
+	running := tunnel.IsAgentRunning()
+	tunnels := []tunnel.Tunnel{}
+	if running {
+		list, err := tunnel.ListRunningTunnels(ios.HttpApiHost(), ios.HttpApiPort())
+		if err != nil {
+			s.logger.Warn("failed to list tunnels", zap.Error(err))
+		} else {
+			tunnels = list
+		}
+	}
+
+	s.tunnelMu.Lock()
+	devices := make(map[string]iosvo.TunnelInfo, len(s.iosTunnels))
+	for udid, info := range s.iosTunnels {
+		devices[udid] = info
+	}
+	s.tunnelMu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"running": running,
+		"host":    ios.HttpApiHost(),
+		"port":    ios.HttpApiPort(),
+		"tunnels": tunnels,
+		"devices": devices,
+	})
+}
+
+// hRefreshTunnel looks up the tunnel of the device again and redoes the RSD
+// handshake, the readiness pipeline then restarts WDA on the new connection.
+func (s *Server) hRefreshTunnel(c *gin.Context) {
+	udid := c.Param("udid")
+	device, err := s.retrieveDevice(udid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":  err.Error(),
+			"code":   errorCode(err),
+			"tunnel": s.tunnelInfo(udid),
+		})
+		return
+	}
+	s.setIosDevice(device)
+	if !s.tunnelRequired(udid) {
+		s.startReadiness(udid)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"tunnel_required": s.tunnelRequired(udid),
+		"tunnel":          s.tunnelInfo(udid),
+	})
+}
@@ -1,25 +1,76 @@
 package iosvo
 
+import "time"
+
 type DeviceInfo struct {
-	CPUArchitecture string `json:"cpu_architecture"`
-	DeviceName      string `json:"device_name"`
-	DevicePlatform  string `json:"device_platform"`
-	DeviceSerialNo  string `json:"device_serialno"`
-	WdaPort         int    `json:"wda_port"`
-	Version         string `json:"version"`
+	CPUArchitecture string       `json:"cpu_architecture"`
+	DeviceName      string       `json:"device_name"`
+	DevicePlatform  string       `json:"device_platform"`
+	DeviceSerialNo  string       `json:"device_serialno"`
+	WdaPort         int          `json:"wda_port"`
+	Version         string       `json:"version"`
+	TunnelRequired  bool         `json:"tunnel_required"` // iOS 17+ 设备缺少隧道
+	Tunnel          *TunnelInfo  `json:"tunnel,omitempty"`
+	Readiness       *DeviceState `json:"readiness,omitempty"`
+}
+
+// TunnelInfo 设备的隧道及最近一次 RSD 握手结果
+type TunnelInfo struct {
+	Address          string     `json:"address"`
+	RsdPort          int        `json:"rsd_port"`
+	UserspaceTUN     bool       `json:"userspace_tun"`
+	UserspaceTUNPort int        `json:"userspace_tun_port"`
+	LastHandshake    *time.Time `json:"last_handshake,omitempty"`
+	Error            string     `json:"error,omitempty"`
 }
 
 type Device struct {
-	Temperature  float64 `json:"temperature"` // 温度可能含小数
-	Voltage      float64 `json:"voltage"`     // 电压可能含小数
-	Level        int     `json:"level"`
-	CPU          string  `json:"cpu"`
-	Manufacturer string  `json:"manufacturer"`
-	Model        string  `json:"model"`
-	Name         string  `json:"name"`
-	Platform     string  `json:"platform"`
-	IsHm         bool    `json:"isHm"`    // 是否鸿蒙系统
-	Size         string  `json:"size"`    // 屏幕尺寸
-	UdID         string  `json:"udId"`    // 唯一设备标识
-	Version      string  `json:"version"` // 系统版本
+	Temperature    float64 `json:"temperature"` // 温度可能含小数
+	Voltage        float64 `json:"voltage"`     // 电压可能含小数
+	Level          int     `json:"level"`
+	CPU            string  `json:"cpu"`
+	Manufacturer   string  `json:"manufacturer"`
+	Model          string  `json:"model"`
+	Name           string  `json:"name"`
+	Platform       string  `json:"platform"`
+	IsHm           bool    `json:"isHm"`           // 是否鸿蒙系统
+	Size           string  `json:"size"`           // 屏幕尺寸
+	UdID           string  `json:"udId"`           // 唯一设备标识
+	Version        string  `json:"version"`        // 系统版本
+	TunnelRequired bool    `json:"tunnelRequired"` // iOS 17+ 设备缺少隧道
+	State          string  `json:"state"`          // 就绪状态
+}
+
+// DeviceState 设备就绪流程的状态
+type DeviceState struct {
+	State     string       `json:"state"` // preparing | ready | tunnel_required | failed
+	Stage     string       `json:"stage"` // 当前所处阶段
+	Stages    []StageState `json:"stages"`
+	UpdatedAt time.Time    `json:"updated_at"`
+	RetryAt   *time.Time   `json:"retry_at,omitempty"` // failed 时下次重试的时间
+}
+
+// StageState 就绪流程中单个阶段的状态
+type StageState struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"` // pending | running | ok | failed
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Recording 屏幕录制，iOS 与 Android 共用
+type Recording struct {
+	ID         string     `json:"id"`
+	UdID       string     `json:"udid"`
+	Platform   string     `json:"platform"`
+	Status     string     `json:"status"` // recording | stopped | failed
+	StartedAt  time.Time  `json:"started_at"`
+	StoppedAt  *time.Time `json:"stopped_at,omitempty"`
+	Duration   float64    `json:"duration"` // 秒
+	Size       int64      `json:"size"`     // 字节
+	Frames     int        `json:"frames,omitempty"`
+	Segments   int        `json:"segments,omitempty"`
+	StopReason string     `json:"stop_reason,omitempty"` // stopped | max_duration | max_size | shutdown | error
+	Error      string     `json:"error,omitempty"`
+	Formats    []string   `json:"formats"` // 可下载的格式
 }
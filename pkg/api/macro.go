@@ -0,0 +1,581 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// 宏动作类型，tap 到 key 与 AndroidAction 相同
+const (
+	macroTap           = "tap"
+	macroLongPress     = "long_press"
+	macroSwipe         = "swipe"
+	macroGesture       = "gesture"
+	macroText          = "text"
+	macroKey           = "key"
+	macroLaunch        = "launch"
+	macroLocation      = "location"
+	macroLocationReset = "location_reset"
+
+	maxMacroActions = 10000
+	macroExt        = ".json"
+)
+
+var (
+	macroIDPattern    = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+	errMacroNotFound  = errors.New("macro not found")
+	errMacroRecording = errors.New("a macro is already being recorded on the device")
+	errNoMacro        = errors.New("no macro is being recorded on the device")
+)
+
+// MacroAction is one recorded input action. Time is the offset from the
+// start of the recording in milliseconds, coordinates are in the units of
+// the recording device (pixels on Android, points on iOS) unless Normalized
+// is set.
+type MacroAction struct {
+	Time       int64            `json:"time"`
+	Type       string           `json:"type"` // tap | long_press | swipe | gesture | text | key | launch | location | location_reset
+	X          float64          `json:"x,omitempty"`
+	Y          float64          `json:"y,omitempty"`
+	ToX        float64          `json:"to_x,omitempty"`
+	ToY        float64          `json:"to_y,omitempty"`
+	Duration   int              `json:"duration,omitempty"` // 毫秒
+	Pointers   [][]GesturePoint `json:"pointers,omitempty"`
+	Text       string           `json:"text,omitempty"`
+	Key        string           `json:"key,omitempty"` // Android 的 keycode 或名称，iOS 的按键记为 HOME、VOLUME_UP、VOLUME_DOWN
+	Normalized bool             `json:"normalized,omitempty"`
+	App        string           `json:"app,omitempty"` // launch：bundle id 或包名
+	Lat        float64          `json:"lat,omitempty"`
+	Lon        float64          `json:"lon,omitempty"`
+}
+
+// Macro is a recorded script. Width and Height are the screen size of the
+// recording device in the units of its coordinates, replays scale them to
+// the screen of the target.
+type Macro struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name,omitempty"`
+	Platform    string        `json:"platform"`
+	UDID        string        `json:"udid"`
+	Width       float64       `json:"width"`
+	Height      float64       `json:"height"`
+	CreatedAt   time.Time     `json:"created_at"`
+	Duration    int64         `json:"duration"` // 毫秒
+	ActionCount int           `json:"action_count"`
+	Actions     []MacroAction `json:"actions,omitempty"`
+}
+
+type MacroStartRequest struct {
+	Name string `json:"name"`
+}
+
+type macroRecorder struct {
+	mu      sync.Mutex
+	macro   Macro
+	started time.Time
+}
+
+func (r *macroRecorder) snapshot() Macro {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	macro := r.macro
+	macro.Actions = append([]MacroAction(nil), r.macro.Actions...)
+	macro.ActionCount = len(macro.Actions)
+	macro.Duration = time.Since(r.started).Milliseconds()
+	return macro
+}
+
+// hStartMacro starts recording the input sent through the server to the
+// device.
+func (s *Server) hStartMacro(c *gin.Context) {
+	udid := c.Param("udid")
+	var req MacroStartRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+			return
+		}
+	}
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	platform, width, height, err := s.deviceScreenSize(ctx, udid)
+	if err != nil {
+		c.JSON(macroDeviceErrorStatus(err), GenericResponse{Error: err.Error()})
+		return
+	}
+
+	s.macroMu.Lock()
+	defer s.macroMu.Unlock()
+	if _, ok := s.macroRecorders[udid]; ok {
+		c.JSON(http.StatusConflict, GenericResponse{Error: errMacroRecording.Error()})
+		return
+	}
+	rec := &macroRecorder{
+		started: time.Now(),
+		macro: Macro{
+			ID:        uuid.NewString(),
+			Name:      req.Name,
+			Platform:  platform,
+			UDID:      udid,
+			Width:     width,
+			Height:    height,
+			CreatedAt: time.Now(),
+		},
+	}
+	s.macroRecorders[udid] = rec
+	s.logger.Info("macro recording started", zap.String("udid", udid), zap.String("id", rec.macro.ID))
+	c.JSON(http.StatusCreated, rec.snapshot())
+}
+
+// hRetrieveMacroRecording returns the macro being recorded on the device.
+func (s *Server) hRetrieveMacroRecording(c *gin.Context) {
+	rec := s.macroRecorder(c.Param("udid"))
+	if rec == nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: errNoMacro.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rec.snapshot())
+}
+
+// hStopMacro stops the recording and saves the macro.
+func (s *Server) hStopMacro(c *gin.Context) {
+	udid := c.Param("udid")
+	s.macroMu.Lock()
+	rec, ok := s.macroRecorders[udid]
+	delete(s.macroRecorders, udid)
+	s.macroMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: errNoMacro.Error()})
+		return
+	}
+	macro := rec.snapshot()
+	if err := s.saveMacro(&macro); err != nil {
+		s.logger.Error("failed to save macro", zap.String("udid", udid), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	s.logger.Info("macro recording stopped", zap.String("udid", udid), zap.String("id", macro.ID), zap.Int("actions", macro.ActionCount))
+	c.JSON(http.StatusOK, macro)
+}
+
+func (s *Server) hListMacros(c *gin.Context) {
+	entries, _ := os.ReadDir(s.macroDir())
+	macros := make([]Macro, 0, len(entries))
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), macroExt)
+		if !ok {
+			continue
+		}
+		macro, err := s.loadMacro(id)
+		if err != nil {
+			continue
+		}
+		macro.Actions = nil
+		macros = append(macros, *macro)
+	}
+	sort.Slice(macros, func(i, j int) bool { return macros[i].CreatedAt.After(macros[j].CreatedAt) })
+	c.JSON(http.StatusOK, macros)
+}
+
+// hRetrieveMacro returns the macro as JSON script, download=true as file.
+func (s *Server) hRetrieveMacro(c *gin.Context) {
+	id := c.Param("id")
+	macro, err := s.loadMacro(id)
+	if err != nil {
+		macroError(c, err)
+		return
+	}
+	if c.Query("download") == "true" {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="macro-%s%s"`, id, macroExt))
+	}
+	c.JSON(http.StatusOK, macro)
+}
+
+// hUploadMacro saves a macro script, e.g. one recorded on another server or
+// edited by hand. It gets a new id unless it has a valid one.
+func (s *Server) hUploadMacro(c *gin.Context) {
+	var macro Macro
+	if err := c.ShouldBindJSON(&macro); err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if err := validateMacro(&macro); err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if !macroIDPattern.MatchString(macro.ID) {
+		macro.ID = uuid.NewString()
+	}
+	if macro.CreatedAt.IsZero() {
+		macro.CreatedAt = time.Now()
+	}
+	if err := s.saveMacro(&macro); err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	macro.Actions = nil
+	c.JSON(http.StatusCreated, macro)
+}
+
+func (s *Server) hDeleteMacro(c *gin.Context) {
+	id := c.Param("id")
+	if !macroIDPattern.MatchString(id) {
+		macroError(c, errMacroNotFound)
+		return
+	}
+	if err := os.Remove(s.macroPath(id)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = errMacroNotFound
+		}
+		macroError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, GenericResponse{Message: "deleted"})
+}
+
+func macroError(c *gin.Context, err error) {
+	if errors.Is(err, errMacroNotFound) {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+}
+
+// macroDeviceErrorStatus returns the status for errors looking up the device.
+func macroDeviceErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errDeviceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errTunnelRequired):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// macroHasTouches reports whether the macro has actions with coordinates.
+func macroHasTouches(macro *Macro) bool {
+	for _, action := range macro.Actions {
+		switch action.Type {
+		case macroTap, macroLongPress, macroSwipe, macroGesture:
+			return true
+		}
+	}
+	return false
+}
+
+func validateMacro(macro *Macro) error {
+	if macro.Platform != "ios" && macro.Platform != "android" {
+		return errors.New("platform must be ios or android")
+	}
+	if len(macro.Actions) == 0 {
+		return errors.New("macro has no actions")
+	}
+	if len(macro.Actions) > maxMacroActions {
+		return fmt.Errorf("at most %d actions per macro", maxMacroActions)
+	}
+	needsScreen := false
+	for i, action := range macro.Actions {
+		switch action.Type {
+		case macroTap, macroLongPress, macroSwipe, macroGesture:
+			needsScreen = needsScreen || !action.Normalized
+		case macroText, macroKey, macroLaunch, macroLocation, macroLocationReset:
+		default:
+			return fmt.Errorf("action %d: unknown type %q", i, action.Type)
+		}
+		if action.Time < 0 {
+			return fmt.Errorf("action %d: time must not be negative", i)
+		}
+	}
+	if needsScreen && (macro.Width <= 0 || macro.Height <= 0) {
+		return errors.New("width and height are required for coordinates that are not normalized")
+	}
+	macro.ActionCount = len(macro.Actions)
+	macro.Duration = macro.Actions[len(macro.Actions)-1].Time
+	return nil
+}
+
+func (s *Server) macroDir() string {
+	if s.config.MacroDir != "" {
+		return s.config.MacroDir
+	}
+	return filepath.Join(s.config.TmpDir, "macros")
+}
+
+func (s *Server) macroPath(id string) string {
+	return filepath.Join(s.macroDir(), id+macroExt)
+}
+
+func (s *Server) saveMacro(macro *Macro) error {
+	if err := os.MkdirAll(s.macroDir(), os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(macro, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.macroPath(macro.ID), data, 0o644)
+}
+
+func (s *Server) loadMacro(id string) (*Macro, error) {
+	if !macroIDPattern.MatchString(id) {
+		return nil, errMacroNotFound
+	}
+	data, err := os.ReadFile(s.macroPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errMacroNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var macro Macro
+	if err := json.Unmarshal(data, &macro); err != nil {
+		return nil, fmt.Errorf("macro %s is corrupt: %w", id, err)
+	}
+	macro.ActionCount = len(macro.Actions)
+	return &macro, nil
+}
+
+func (s *Server) macroRecorder(udid string) *macroRecorder {
+	s.macroMu.Lock()
+	defer s.macroMu.Unlock()
+	return s.macroRecorders[udid]
+}
+
+// recordMacroAction appends the action to the macro being recorded on the
+// device, if any.
+func (s *Server) recordMacroAction(udid string, action MacroAction) {
+	rec := s.macroRecorder(udid)
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.macro.Actions) >= maxMacroActions {
+		return
+	}
+	action.Time = time.Since(rec.started).Milliseconds()
+	rec.macro.Actions = append(rec.macro.Actions, action)
+}
+
+// deviceScreenSize returns the platform of the device and its screen size in
+// the units of its input, pixels on Android and points on iOS.
+func (s *Server) deviceScreenSize(ctx context.Context, udid string) (string, float64, float64, error) {
+	if _, ok := s.iosDevice(udid); ok {
+		if s.tunnelRequired(udid) {
+			return "ios", 0, 0, errTunnelRequired
+		}
+		width, height, err := s.wdaWindowSize(ctx, udid)
+		return "ios", width, height, err
+	}
+	if device, ok := s.androidDeviceBySerial(udid); ok {
+		screen, err := androidScreenInfo(device)
+		return "android", float64(screen.width), float64(screen.height), err
+	}
+	return "", 0, 0, errDeviceNotFound
+}
+
+// macroActionFromAndroid converts an input action, waits are left out as
+// the recording keeps the time of every action.
+func macroActionFromAndroid(action AndroidAction) (MacroAction, bool) {
+	if action.Type == "wait" {
+		return MacroAction{}, false
+	}
+	return MacroAction{
+		Type:       action.Type,
+		X:          action.X,
+		Y:          action.Y,
+		ToX:        action.ToX,
+		ToY:        action.ToY,
+		Duration:   action.Duration,
+		Pointers:   action.Pointers,
+		Text:       action.Text,
+		Key:        action.Key,
+		Normalized: action.Normalized,
+	}, true
+}
+
+// touchMacroAction returns a tap, long press or swipe for a single touch,
+// with the thresholds of the stream.
+func touchMacroAction(x, y, toX, toY float64, duration time.Duration, normalized bool) MacroAction {
+	action := MacroAction{X: x, Y: y, Duration: int(duration.Milliseconds()), Normalized: normalized}
+	moved := x != toX || y != toY
+	if normalized {
+		moved = math.Hypot(toX-x, toY-y) >= tapMaxDistance
+	}
+	switch {
+	case moved:
+		action.Type = macroSwipe
+		action.ToX, action.ToY = toX, toY
+	case duration >= tapMaxDuration:
+		action.Type = macroLongPress
+	default:
+		action.Type = macroTap
+		action.Duration = 0
+	}
+	return action
+}
+
+// iOS 的硬件按键与 Android 按键名的对应
+var iosButtonKeys = map[string]string{
+	"home":       "HOME",
+	"volumeUp":   "VOLUME_UP",
+	"volumeDown": "VOLUME_DOWN",
+}
+
+var wdaSessionPrefix = regexp.MustCompile(`^/session/[^/]+`)
+
+// wdaMacroActions returns the input actions of a successful WDA call, the
+// path is the one of the WDA proxy.
+func wdaMacroActions(path string, body []byte) []MacroAction {
+	path = strings.TrimSuffix(wdaSessionPrefix.ReplaceAllString(path, ""), "/")
+	var req struct {
+		X        float64  `json:"x"`
+		Y        float64  `json:"y"`
+		FromX    float64  `json:"fromX"`
+		FromY    float64  `json:"fromY"`
+		ToX      float64  `json:"toX"`
+		ToY      float64  `json:"toY"`
+		Duration float64  `json:"duration"` // 秒
+		Value    []string `json:"value"`
+		Text     string   `json:"text"`
+		Name     string   `json:"name"`
+		BundleID string   `json:"bundleId"`
+	}
+	json.Unmarshal(body, &req)
+	switch {
+	case path == "/actions":
+		return w3cMacroActions(body)
+	case path == "/wda/tap" || path == "/wda/tap/0":
+		return []MacroAction{{Type: macroTap, X: req.X, Y: req.Y}}
+	case path == "/wda/doubleTap":
+		return []MacroAction{{Type: macroTap, X: req.X, Y: req.Y}, {Type: macroTap, X: req.X, Y: req.Y}}
+	case path == "/wda/touchAndHold":
+		return []MacroAction{{Type: macroLongPress, X: req.X, Y: req.Y, Duration: int(req.Duration * 1000)}}
+	case path == "/wda/dragfromtoforduration":
+		return []MacroAction{{Type: macroSwipe, X: req.FromX, Y: req.FromY, ToX: req.ToX, ToY: req.ToY, Duration: int(req.Duration * 1000)}}
+	case path == "/wda/keys" || strings.HasPrefix(path, "/element/") && strings.HasSuffix(path, "/value"):
+		text := req.Text
+		if text == "" {
+			text = strings.Join(req.Value, "")
+		}
+		if text == "" {
+			return nil
+		}
+		return []MacroAction{{Type: macroText, Text: text}}
+	case path == "/wda/pressButton":
+		if key, ok := iosButtonKeys[req.Name]; ok {
+			return []MacroAction{{Type: macroKey, Key: key}}
+		}
+	case path == "/wda/apps/launch":
+		if req.BundleID != "" {
+			return []MacroAction{{Type: macroLaunch, App: req.BundleID}}
+		}
+	}
+	return nil
+}
+
+// w3cMacroActions converts W3C pointer actions: a single finger becomes a
+// tap, long press or swipe, several fingers a gesture.
+func w3cMacroActions(body []byte) []MacroAction {
+	var req struct {
+		Actions []struct {
+			Type    string `json:"type"`
+			Actions []struct {
+				Type     string      `json:"type"`
+				X        float64     `json:"x"`
+				Y        float64     `json:"y"`
+				Duration float64     `json:"duration"` // 毫秒
+				Origin   interface{} `json:"origin"`
+			} `json:"actions"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil
+	}
+	var paths [][]GesturePoint
+	var duration time.Duration
+	for _, source := range req.Actions {
+		if source.Type != "pointer" {
+			continue
+		}
+		var x, y float64
+		var path []GesturePoint
+		var held time.Duration
+		down := false
+		for _, step := range source.Actions {
+			switch step.Type {
+			case "pointerMove":
+				if step.Origin == "pointer" {
+					x, y = x+step.X, y+step.Y
+				} else {
+					x, y = step.X, step.Y
+				}
+				if down {
+					path = append(path, GesturePoint{X: x, Y: y})
+					held += time.Duration(step.Duration) * time.Millisecond
+				}
+			case "pause":
+				if down {
+					held += time.Duration(step.Duration) * time.Millisecond
+				}
+			case "pointerDown":
+				down = true
+				path = []GesturePoint{{X: x, Y: y}}
+				held = 0
+			case "pointerUp":
+				if down {
+					paths = append(paths, path)
+					duration = max(duration, held)
+				}
+				down = false
+			}
+		}
+	}
+	switch {
+	case len(paths) == 0:
+		return nil
+	case len(paths) == 1:
+		path := paths[0]
+		first, last := path[0], path[len(path)-1]
+		if len(path) <= 2 {
+			return []MacroAction{touchMacroAction(first.X, first.Y, last.X, last.Y, duration, false)}
+		}
+	}
+	return []MacroAction{{Type: macroGesture, Pointers: paths, Duration: int(duration.Milliseconds())}}
+}
+
+// androidControlMacroAction returns the action of a stream control message
+// for macros, touches are recorded on up from their down position.
+func androidControlMacroAction(msg streamControl, start touchStart) (MacroAction, bool) {
+	switch msg.Type {
+	case "touch":
+		if msg.Action != "up" {
+			return MacroAction{}, false
+		}
+		return touchMacroAction(start.x, start.y, msg.X, msg.Y, time.Since(start.at), true), true
+	case "key":
+		if msg.Action == "down" {
+			return MacroAction{}, false
+		}
+		return MacroAction{Type: macroKey, Key: strconv.Itoa(msg.Keycode)}, true
+	case "text":
+		return MacroAction{Type: macroText, Text: msg.Text}, true
+	}
+	return MacroAction{}, false
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/simlocation"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMacroLongPress = 1000 * time.Millisecond
+	defaultMacroSwipe     = 300 * time.Millisecond
+)
+
+// Android 按键对应的 iOS 硬件按键，数字为 keycode
+var androidKeyButtons = map[string]string{
+	"HOME":        "home",
+	"3":           "home",
+	"VOLUME_UP":   "volumeUp",
+	"24":          "volumeUp",
+	"VOLUME_DOWN": "volumeDown",
+	"25":          "volumeDown",
+}
+
+// MacroReplayRequest sets how a macro is replayed. Speed scales the time
+// between actions, Apps maps app ids of the macro to the ones of the target,
+// e.g. a bundle id to a package when replaying on the other platform.
+type MacroReplayRequest struct {
+	Speed           float64           `json:"speed"`
+	Apps            map[string]string `json:"apps"`
+	ContinueOnError bool              `json:"continue_on_error"`
+}
+
+type MacroActionResult struct {
+	Index    int    `json:"index"`
+	Type     string `json:"type"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration"` // 毫秒
+}
+
+type MacroReplayResponse struct {
+	ID       string              `json:"id"`
+	UDID     string              `json:"udid"`
+	Platform string              `json:"platform"`
+	Passed   bool                `json:"passed"`
+	Elapsed  int64               `json:"elapsed"` // 毫秒
+	Results  []MacroActionResult `json:"results"`
+}
+
+// macroPlayer runs actions whose coordinates are already in the units of
+// the target device.
+type macroPlayer func(ctx context.Context, action MacroAction) error
+
+// hReplayMacro replays the macro on the device with the timing it was
+// recorded with.
+func (s *Server) hReplayMacro(c *gin.Context) {
+	udid := c.Param("udid")
+	req := MacroReplayRequest{Speed: 1}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+			return
+		}
+	}
+	if req.Speed <= 0 {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "speed must be positive"})
+		return
+	}
+	macro, err := s.loadMacro(c.Param("id"))
+	if err != nil {
+		macroError(c, err)
+		return
+	}
+
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	resp, err := s.replayMacro(ctx, udid, macro, req)
+	if err != nil {
+		c.JSON(macroDeviceErrorStatus(err), GenericResponse{Error: err.Error()})
+		return
+	}
+	status := http.StatusOK
+	if !resp.Passed {
+		status = http.StatusInternalServerError
+	}
+	c.JSON(status, resp)
+}
+
+func (s *Server) replayMacro(ctx context.Context, udid string, macro *Macro, req MacroReplayRequest) (*MacroReplayResponse, error) {
+	var platform string
+	var play macroPlayer
+	if device, ok := s.iosDevice(udid); ok {
+		if s.tunnelRequired(udid) {
+			return nil, errTunnelRequired
+		}
+		platform, play = "ios", s.iosMacroPlayer(device)
+	} else if device, ok := s.androidDeviceBySerial(udid); ok {
+		platform, play = "android", s.androidMacroPlayer(device)
+	} else {
+		return nil, errDeviceNotFound
+	}
+	// 只有触摸动作需要屏幕尺寸，iOS 上要经过 WDA
+	var width, height float64
+	if macroHasTouches(macro) {
+		var err error
+		if _, width, height, err = s.deviceScreenSize(ctx, udid); err != nil {
+			return nil, err
+		}
+	}
+	s.logger.Info("replaying macro", zap.String("udid", udid), zap.String("id", macro.ID), zap.Int("actions", len(macro.Actions)))
+
+	resp := &MacroReplayResponse{ID: macro.ID, UDID: udid, Platform: platform, Passed: true}
+	started := time.Now()
+	for i, action := range macro.Actions {
+		at := started.Add(time.Duration(float64(action.Time)/req.Speed) * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Until(at)):
+		}
+
+		actionStarted := time.Now()
+		action = scaleMacroAction(action, macro, width, height)
+		if app, ok := req.Apps[action.App]; ok {
+			action.App = app
+		}
+		err := play(ctx, action)
+		result := MacroActionResult{Index: i, Type: action.Type, OK: err == nil, Duration: time.Since(actionStarted).Milliseconds()}
+		if err != nil {
+			s.logger.Warn("macro action failed", zap.String("udid", udid), zap.Int("index", i), zap.String("type", action.Type), zap.Error(err))
+			result.Error = err.Error()
+			resp.Passed = false
+		}
+		resp.Results = append(resp.Results, result)
+		if err != nil && !req.ContinueOnError {
+			break
+		}
+	}
+	resp.Elapsed = time.Since(started).Milliseconds()
+	return resp, nil
+}
+
+// scaleMacroAction converts the coordinates to a screen of width x height,
+// normalized ones are resolved and others scaled from the screen of the
+// recording.
+func scaleMacroAction(action MacroAction, macro *Macro, width, height float64) MacroAction {
+	sx, sy := width, height
+	if !action.Normalized {
+		if macro.Width <= 0 || macro.Height <= 0 {
+			return action
+		}
+		sx, sy = width/macro.Width, height/macro.Height
+	}
+	action.Normalized = false
+	action.X, action.Y = action.X*sx, action.Y*sy
+	action.ToX, action.ToY = action.ToX*sx, action.ToY*sy
+	pointers := make([][]GesturePoint, len(action.Pointers))
+	for i, pointer := range action.Pointers {
+		for _, p := range pointer {
+			pointers[i] = append(pointers[i], GesturePoint{X: p.X * sx, Y: p.Y * sy})
+		}
+	}
+	action.Pointers = pointers
+	return action
+}
+
+func (s *Server) androidMacroPlayer(device adb.Device) macroPlayer {
+	return func(ctx context.Context, action MacroAction) error {
+		switch action.Type {
+		case macroLaunch:
+			return androidLaunchApp(device, action.App)
+		case macroLocation, macroLocationReset:
+			return errors.New("setting the location is not supported on Android")
+		}
+		return s.runAndroidAction(ctx, device, AndroidAction{
+			Type:     action.Type,
+			X:        action.X,
+			Y:        action.Y,
+			ToX:      action.ToX,
+			ToY:      action.ToY,
+			Duration: action.Duration,
+			Pointers: action.Pointers,
+			Text:     action.Text,
+			Key:      action.Key,
+		})
+	}
+}
+
+func (s *Server) iosMacroPlayer(device ios.DeviceEntry) macroPlayer {
+	udid := device.Properties.SerialNumber
+	return func(ctx context.Context, action MacroAction) error {
+		duration := time.Duration(action.Duration) * time.Millisecond
+		switch action.Type {
+		case macroTap:
+			return s.wdaTap(ctx, udid, action.X, action.Y, 0)
+		case macroLongPress:
+			if duration <= 0 {
+				duration = defaultMacroLongPress
+			}
+			return s.wdaTap(ctx, udid, action.X, action.Y, duration)
+		case macroSwipe:
+			if duration <= 0 {
+				duration = defaultMacroSwipe
+			}
+			path := []GesturePoint{{X: action.X, Y: action.Y}, {X: action.ToX, Y: action.ToY}}
+			return s.wdaGesture(ctx, udid, [][]GesturePoint{path}, duration)
+		case macroGesture:
+			if len(action.Pointers) == 0 {
+				return errors.New("gesture needs pointers")
+			}
+			return s.wdaGesture(ctx, udid, action.Pointers, duration)
+		case macroText:
+			return s.wdaKeys(ctx, udid, action.Text)
+		case macroKey:
+			button, ok := androidKeyButtons[strings.TrimPrefix(strings.ToUpper(action.Key), "KEYCODE_")]
+			if !ok {
+				return fmt.Errorf("key %s has no iOS button", action.Key)
+			}
+			return s.wdaPressButton(ctx, udid, button)
+		case macroLaunch:
+			return launchIosApp(device, action.App)
+		case macroLocation:
+			return s.setIosLocation(device, action.Lat, action.Lon)
+		case macroLocationReset:
+			return simlocation.ResetLocation(device)
+		}
+		return fmt.Errorf("unknown action type %q", action.Type)
+	}
+}
@@ -21,10 +21,17 @@ func (s *Server) DeviceMiddleware() gin.HandlerFunc {
 			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"message": "udid is missing"})
 			return
 		}
-		device, ok := s.iosDevices[udid]
+		device, ok := s.iosDevice(udid)
 		if ok {
 			c.Set(IOS_KEY, device)
 			c.Next()
+		} else if state := s.deviceState(udid); state != nil && (state.State == stateUnpaired || state.State == stateTrustPending) {
+			code := codeNotPaired
+			if state.State == stateTrustPending {
+				code = codeTrustPending
+			}
+			c.AbortWithStatusJSON(http.StatusConflict, GenericResponse{Error: errNotPaired.Error(), Code: code})
+			return
 		} else {
 			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "device not found on the host"})
 			return
@@ -39,7 +46,7 @@ func (s *Server) AndroidDeviceMiddleware() gin.HandlerFunc {
 			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"message": "udid is missing"})
 			return
 		}
-		device, ok := s.androidDevice[udid]
+		device, ok := s.androidDeviceBySerial(udid)
 		if ok {
 			c.Set(ANDROID_KEY, device)
 			c.Next()
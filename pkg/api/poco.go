@@ -0,0 +1,271 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+	"github.com/blacklee123/go-ios-android/pkg/utils/validator"
+	"github.com/gin-gonic/gin"
+)
+
+// POCO_KEY holds the *poco.PocoClient set by the Poco middleware of the
+// platform, the handlers below work for every platform.
+const POCO_KEY = "go_poco_client"
+
+const (
+	codePocoRPC         = "poco_rpc_error"
+	codePocoUnavailable = "poco_unavailable"
+	codePocoTimeout     = "poco_timeout"
+)
+
+// 各引擎 Poco SDK 的默认端口，路由中的端口也可以写引擎名
+var pocoEnginePorts = map[string]int{
+	"unity":   5001,
+	"ue4":     5001,
+	"cocos":   15004,
+	"cocosjs": 5003,
+}
+
+// PocoPoint is a position in coordinates normalized to the screen.
+type PocoPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type PocoSwipeRequest struct {
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	ToX      float64 `json:"to_x"`
+	ToY      float64 `json:"to_y"`
+	Duration float64 `json:"duration"` // 秒
+}
+
+type PocoLongClickRequest struct {
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Duration float64 `json:"duration"` // 秒
+}
+
+// PocoSelectQuery selects nodes of the dump with a Poco selector, the
+// coordinates are scaled to width and height, the screen size reported by
+// the SDK by default.
+type PocoSelectQuery struct {
+	Selector string `form:"selector" binding:"required"`
+	Visible  *bool  `form:"visible"` // 默认只匹配可见节点
+	Width    int    `form:"width"`
+	Height   int    `form:"height"`
+}
+
+type PocoElement struct {
+	Node   *poco.Node `json:"node"`
+	Pos    []float64  `json:"pos,omitempty"`    // 中心点，归一化坐标
+	Center []int      `json:"center,omitempty"` // 中心点，屏幕像素
+	Rect   *poco.Rect `json:"rect,omitempty"`   // 屏幕像素
+}
+
+type PocoSelectResponse struct {
+	Count    int           `json:"count"`
+	Width    float64       `json:"width"`
+	Height   float64       `json:"height"`
+	Elements []PocoElement `json:"elements"`
+}
+
+type PocoSetTextRequest struct {
+	ID   interface{} `json:"id" binding:"required"` // dump 中节点的 _instanceId
+	Text string      `json:"text"`
+}
+
+// registerPocoHandlers registers the Poco calls on a group whose middleware
+// sets POCO_KEY.
+func (s *Server) registerPocoHandlers(group *gin.RouterGroup) {
+	group.GET("/dump", s.hPocoDump)
+	group.GET("/version", s.hPocoVersion)
+	group.GET("/screen_size", s.hPocoScreenSize)
+	group.GET("/profiling", s.hPocoProfiling)
+	group.GET("/select", s.hPocoSelect)
+	group.POST("/click", s.hPocoClick)
+	group.POST("/swipe", s.hPocoSwipe)
+	group.POST("/long_click", s.hPocoLongClick)
+	group.POST("/text", s.hPocoSetText)
+}
+
+// hPocoDump returns the hierarchy, visible=false includes invisible nodes.
+func (s *Server) hPocoDump(c *gin.Context) {
+	client := c.MustGet(POCO_KEY).(*poco.PocoClient)
+	dump, err := client.Dump(c.DefaultQuery("visible", "true") == "true")
+	if err != nil {
+		pocoError(c, err)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", dump)
+}
+
+// hPocoSelect returns the nodes matching the selector with their screen
+// coordinates, so that clients can tap them through WDA or adb.
+func (s *Server) hPocoSelect(c *gin.Context) {
+	client := c.MustGet(POCO_KEY).(*poco.PocoClient)
+	var query PocoSelectQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	selector, err := poco.ParseSelector(query.Selector)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	onlyVisible := query.Visible == nil || *query.Visible
+
+	width, height := float64(query.Width), float64(query.Height)
+	if width <= 0 || height <= 0 {
+		if width, height, err = client.GetScreenSize(); err != nil {
+			pocoError(c, err)
+			return
+		}
+	}
+	root, err := client.DumpTree(onlyVisible)
+	if err != nil {
+		pocoError(c, err)
+		return
+	}
+	nodes := selector.Select(root, onlyVisible)
+	elements := make([]PocoElement, 0, len(nodes))
+	for _, node := range nodes {
+		elements = append(elements, pocoElement(node, width, height))
+	}
+	c.JSON(http.StatusOK, PocoSelectResponse{Count: len(elements), Width: width, Height: height, Elements: elements})
+}
+
+// pocoElement returns the node without its children and its coordinates on
+// a screen of the given size.
+func pocoElement(node *poco.Node, width, height float64) PocoElement {
+	element := PocoElement{Node: node.Leaf()}
+	frame, ok := node.Frame()
+	if !ok {
+		return element
+	}
+	x, y := frame.Center()
+	rect := frame.Scale(width, height)
+	element.Pos = []float64{x, y}
+	element.Center = []int{int(math.Round(x * width)), int(math.Round(y * height))}
+	element.Rect = &rect
+	return element
+}
+
+func (s *Server) hPocoVersion(c *gin.Context) {
+	client := c.MustGet(POCO_KEY).(*poco.PocoClient)
+	version, err := client.GetSDKVersion()
+	if err != nil {
+		pocoError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"version": version})
+}
+
+func (s *Server) hPocoScreenSize(c *gin.Context) {
+	client := c.MustGet(POCO_KEY).(*poco.PocoClient)
+	width, height, err := client.GetScreenSize()
+	if err != nil {
+		pocoError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"width": width, "height": height})
+}
+
+func (s *Server) hPocoProfiling(c *gin.Context) {
+	client := c.MustGet(POCO_KEY).(*poco.PocoClient)
+	data, err := client.GetDebugProfilingData()
+	if err != nil {
+		pocoError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+func (s *Server) hPocoClick(c *gin.Context) {
+	client := c.MustGet(POCO_KEY).(*poco.PocoClient)
+	var req PocoPoint
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if err := client.Click(req.X, req.Y); err != nil {
+		pocoError(c, err)
+		return
+	}
+	s.recordMacroAction(c.Param("udid"), MacroAction{Type: macroTap, X: req.X, Y: req.Y, Normalized: true})
+	c.JSON(http.StatusOK, GenericResponse{Message: "clicked"})
+}
+
+func (s *Server) hPocoSwipe(c *gin.Context) {
+	client := c.MustGet(POCO_KEY).(*poco.PocoClient)
+	req := PocoSwipeRequest{Duration: 1}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if err := client.Swipe(req.X, req.Y, req.ToX, req.ToY, req.Duration); err != nil {
+		pocoError(c, err)
+		return
+	}
+	s.recordMacroAction(c.Param("udid"), MacroAction{Type: macroSwipe, X: req.X, Y: req.Y, ToX: req.ToX, ToY: req.ToY, Duration: int(req.Duration * 1000), Normalized: true})
+	c.JSON(http.StatusOK, GenericResponse{Message: "swiped"})
+}
+
+func (s *Server) hPocoLongClick(c *gin.Context) {
+	client := c.MustGet(POCO_KEY).(*poco.PocoClient)
+	req := PocoLongClickRequest{Duration: 2}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if err := client.LongClick(req.X, req.Y, req.Duration); err != nil {
+		pocoError(c, err)
+		return
+	}
+	s.recordMacroAction(c.Param("udid"), MacroAction{Type: macroLongPress, X: req.X, Y: req.Y, Duration: int(req.Duration * 1000), Normalized: true})
+	c.JSON(http.StatusOK, GenericResponse{Message: "long clicked"})
+}
+
+func (s *Server) hPocoSetText(c *gin.Context) {
+	client := c.MustGet(POCO_KEY).(*poco.PocoClient)
+	var req PocoSetTextRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if err := client.SetText(req.ID, req.Text); err != nil {
+		pocoError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, GenericResponse{Message: "text set"})
+}
+
+// pocoPort returns the port of the route, either a number or an engine name.
+func pocoPort(param string) (int, error) {
+	if port, ok := pocoEnginePorts[strings.ToLower(param)]; ok {
+		return port, nil
+	}
+	return validator.Port(param)
+}
+
+// pocoError answers errors of the SDK with 502, an unreachable SDK with 503
+// and calls the SDK did not answer in time with 504.
+func pocoError(c *gin.Context, err error) {
+	var rpcErr *poco.RPCError
+	switch {
+	case errors.As(err, &rpcErr):
+		c.JSON(http.StatusBadGateway, GenericResponse{Error: rpcErr.Error(), Code: codePocoRPC})
+		return
+	case errors.Is(err, poco.ErrConnectFailed):
+		c.JSON(http.StatusServiceUnavailable, GenericResponse{Error: err.Error(), Code: codePocoUnavailable})
+		return
+	case errors.Is(err, poco.ErrTimeout):
+		c.JSON(http.StatusGatewayTimeout, GenericResponse{Error: err.Error(), Code: codePocoTimeout})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultRebootTimeout = 3 * time.Minute
+	rebootPollInterval   = time.Second
+)
+
+var errRebootTimeout = errors.New("device did not come back in time")
+
+// markAttached records an attach event of the device.
+func (s *Server) markAttached(udid string) {
+	s.attachMu.Lock()
+	defer s.attachMu.Unlock()
+	s.attachCount[udid]++
+}
+
+// attachGeneration returns how often the device has been attached so far.
+func (s *Server) attachGeneration(udid string) int {
+	s.attachMu.Lock()
+	defer s.attachMu.Unlock()
+	return s.attachCount[udid]
+}
+
+// rebootWaitOptions reads wait=true and timeout (seconds) from the query.
+func rebootWaitOptions(c *gin.Context) (bool, time.Duration, error) {
+	wait := c.Query("wait") == "true"
+	timeout := defaultRebootTimeout
+	if value := c.Query("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return false, 0, fmt.Errorf("invalid timeout: %s", value)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	return wait, timeout, nil
+}
+
+// waitForReattach blocks until the device has been attached again since
+// generation and ready reports it usable. An error of ready means the device
+// came back but will not become usable and stops waiting.
+func (s *Server) waitForReattach(ctx context.Context, udid string, generation int, timeout time.Duration, ready func() (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(rebootPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return errRebootTimeout
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if s.attachGeneration(udid) <= generation {
+			continue
+		}
+		ok, err := ready()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+}
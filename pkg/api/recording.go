@@ -0,0 +1,306 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blacklee123/go-ios-android/pkg/api/iosvo"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	recordingStatusRecording = "recording"
+	recordingStatusStopped   = "stopped"
+	recordingStatusFailed    = "failed"
+
+	defaultRecordingMaxDuration = 10 * time.Minute
+	maxRecordingMaxDuration     = time.Hour
+	defaultRecordingMaxSize     = 500 << 20
+	// maxRecordingMaxSize 留出余量，AVI 不能超过 4 GiB
+	maxRecordingMaxSize = 2 << 30
+)
+
+var (
+	errRecordingStopped     = errors.New("stopped")
+	errRecordingMaxDuration = errors.New("max_duration")
+	errRecordingMaxSize     = errors.New("max_size")
+	errRecordingNotFound    = errors.New("recording not found")
+	errRecordingActive      = errors.New("recording is still running")
+)
+
+var recordingContentTypes = map[string]string{
+	"mjpeg": "video/x-motion-jpeg",
+	"avi":   "video/x-msvideo",
+	"mp4":   "video/mp4",
+	"zip":   "application/zip", // 没有 ffmpeg 时 Android 的多个分段
+}
+
+// RecordingOptions 录制参数，bit_rate 和 size 只对 Android 生效
+type RecordingOptions struct {
+	MaxDuration int    `json:"max_duration"` // 秒
+	MaxSize     int64  `json:"max_size"`     // 字节，最大 2 GiB
+	BitRate     int    `json:"bit_rate"`
+	Size        string `json:"size"` // 如 720x1280
+}
+
+type recording struct {
+	mu     sync.Mutex
+	info   iosvo.Recording
+	dir    string
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+	// exportMu serializes exports, concurrent downloads share one file
+	exportMu sync.Mutex
+	// export produces the file of the recording in format and returns its path
+	export func(ctx context.Context, format string) (string, error)
+}
+
+func (r *recording) snapshot() iosvo.Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := r.info
+	info.Formats = append([]string(nil), r.info.Formats...)
+	return info
+}
+
+func (r *recording) update(fn func(info *iosvo.Recording)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.info)
+}
+
+func parseRecordingOptions(c *gin.Context) (RecordingOptions, time.Duration, error) {
+	var options RecordingOptions
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&options); err != nil {
+			return options, 0, err
+		}
+	}
+	maxDuration := defaultRecordingMaxDuration
+	if options.MaxDuration > 0 {
+		maxDuration = time.Duration(options.MaxDuration) * time.Second
+	}
+	if maxDuration > maxRecordingMaxDuration {
+		return options, 0, fmt.Errorf("max_duration must not exceed %d seconds", int(maxRecordingMaxDuration.Seconds()))
+	}
+	if options.MaxSize <= 0 {
+		options.MaxSize = defaultRecordingMaxSize
+	}
+	options.MaxSize = min(options.MaxSize, maxRecordingMaxSize)
+	return options, maxDuration, nil
+}
+
+// startRecording registers a recording of the device and runs capture in the
+// background until it returns, is stopped or hits maxDuration. capture writes
+// into the dir of the recording and returns errRecordingMaxSize when it hits
+// the size limit.
+func (s *Server) startRecording(udid, platform string, formats []string, maxDuration time.Duration,
+	capture func(ctx context.Context, rec *recording) error,
+	export func(rec *recording) func(ctx context.Context, format string) (string, error)) (*recording, error) {
+
+	s.recordingsMu.Lock()
+	for _, rec := range s.recordings {
+		if rec.info.UdID == udid && rec.snapshot().Status == recordingStatusRecording {
+			s.recordingsMu.Unlock()
+			return nil, fmt.Errorf("device is already recording: %s", rec.info.ID)
+		}
+	}
+	id := uuid.New().String()
+	dir := filepath.Join(s.config.TmpDir, "recordings", id)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		s.recordingsMu.Unlock()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	rec := &recording{
+		info: iosvo.Recording{
+			ID:        id,
+			UdID:      udid,
+			Platform:  platform,
+			Status:    recordingStatusRecording,
+			StartedAt: time.Now(),
+			Formats:   formats,
+		},
+		dir:    dir,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	rec.export = export(rec)
+	s.recordings[id] = rec
+	s.recordingsMu.Unlock()
+
+	s.logger.Info("recording started", zap.String("udid", udid), zap.String("id", id))
+	go func() {
+		defer close(rec.done)
+		defer cancel(nil)
+		captureCtx, stop := context.WithTimeoutCause(ctx, maxDuration, errRecordingMaxDuration)
+		defer stop()
+		err := capture(captureCtx, rec)
+
+		now := time.Now()
+		reason, status := recordingStopReason(captureCtx, err)
+		rec.update(func(info *iosvo.Recording) {
+			info.Status = status
+			info.StoppedAt = &now
+			info.StopReason = reason
+			if status == recordingStatusFailed {
+				info.Error = err.Error()
+			}
+		})
+		if status == recordingStatusFailed {
+			s.logger.Error("recording failed", zap.String("udid", udid), zap.String("id", id), zap.Error(err))
+		} else {
+			s.logger.Info("recording stopped", zap.String("udid", udid), zap.String("id", id), zap.String("reason", reason))
+		}
+	}()
+	return rec, nil
+}
+
+// recordingStopReason tells why capture returned with err.
+func recordingStopReason(ctx context.Context, err error) (string, string) {
+	if errors.Is(err, errRecordingMaxSize) {
+		return errRecordingMaxSize.Error(), recordingStatusStopped
+	}
+	if ctx.Err() != nil {
+		switch cause := context.Cause(ctx); {
+		case errors.Is(cause, errRecordingStopped), errors.Is(cause, errRecordingMaxDuration):
+			return cause.Error(), recordingStatusStopped
+		default:
+			return "shutdown", recordingStatusStopped
+		}
+	}
+	if err != nil {
+		return "error", recordingStatusFailed
+	}
+	return errRecordingStopped.Error(), recordingStatusStopped
+}
+
+func (s *Server) deviceRecording(c *gin.Context) (*recording, error) {
+	s.recordingsMu.Lock()
+	defer s.recordingsMu.Unlock()
+	rec, ok := s.recordings[c.Param("id")]
+	if !ok || rec.info.UdID != c.Param("udid") {
+		return nil, errRecordingNotFound
+	}
+	return rec, nil
+}
+
+func (s *Server) hListRecordings(c *gin.Context) {
+	udid := c.Param("udid")
+	s.recordingsMu.Lock()
+	recordings := make([]iosvo.Recording, 0)
+	for _, rec := range s.recordings {
+		if rec.info.UdID == udid {
+			recordings = append(recordings, rec.snapshot())
+		}
+	}
+	s.recordingsMu.Unlock()
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].StartedAt.Before(recordings[j].StartedAt)
+	})
+	c.JSON(http.StatusOK, recordings)
+}
+
+func (s *Server) hRetrieveRecording(c *gin.Context) {
+	rec, err := s.deviceRecording(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rec.snapshot())
+}
+
+// hStopRecording stops the recording and returns once its files are complete.
+func (s *Server) hStopRecording(c *gin.Context) {
+	rec, err := s.deviceRecording(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: err.Error()})
+		return
+	}
+	rec.cancel(errRecordingStopped)
+	select {
+	case <-rec.done:
+	case <-c.Request.Context().Done():
+		return
+	}
+	c.JSON(http.StatusOK, rec.snapshot())
+}
+
+// hDownloadRecording sends the recording in the requested format, the first
+// format of the recording by default.
+func (s *Server) hDownloadRecording(c *gin.Context) {
+	rec, err := s.deviceRecording(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: err.Error()})
+		return
+	}
+	info := rec.snapshot()
+	if info.Status == recordingStatusRecording {
+		c.JSON(http.StatusConflict, GenericResponse{Error: errRecordingActive.Error()})
+		return
+	}
+	format := c.DefaultQuery("format", info.Formats[0])
+	supported := false
+	for _, f := range info.Formats {
+		supported = supported || f == format
+	}
+	if !supported {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: fmt.Sprintf("format %s is not available, use one of %v", format, info.Formats)})
+		return
+	}
+
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	rec.exportMu.Lock()
+	path, err := rec.export(ctx, format)
+	rec.exportMu.Unlock()
+	if err != nil {
+		s.logger.Error("failed to export recording", zap.String("id", info.ID), zap.String("format", format), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.Header("Content-Type", recordingContentTypes[format])
+	c.FileAttachment(path, fmt.Sprintf("%s-%s.%s", info.UdID, info.StartedAt.Format("20060102-150405"), format))
+}
+
+func (s *Server) hDeleteRecording(c *gin.Context) {
+	rec, err := s.deviceRecording(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: err.Error()})
+		return
+	}
+	rec.cancel(errRecordingStopped)
+	select {
+	case <-rec.done:
+	case <-c.Request.Context().Done():
+		return
+	}
+	s.recordingsMu.Lock()
+	delete(s.recordings, rec.info.ID)
+	s.recordingsMu.Unlock()
+	os.RemoveAll(rec.dir)
+	c.JSON(http.StatusOK, GenericResponse{Message: "deleted " + rec.info.ID})
+}
+
+// exportOnce runs produce unless path already exists, partially written files
+// are removed.
+func exportOnce(path string, produce func(tmp string) error) (string, error) {
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	tmp := path + ".part"
+	if err := produce(tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
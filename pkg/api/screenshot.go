@@ -0,0 +1,211 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/blacklee123/go-ios-android/pkg/utils/imageutil"
+	"github.com/gin-gonic/gin"
+)
+
+var errDeviceNotFound = errors.New("device not found on the host")
+
+const (
+	defaultJpegQuality = 80
+	defaultPngQuality  = 25
+	rotateAuto         = "auto"
+)
+
+var screenshotMimeTypes = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+}
+
+// ScreenshotOptions are the query parameters shared by the screenshot
+// endpoints of both platforms.
+type ScreenshotOptions struct {
+	Format  string  `form:"format"`  // png | jpeg | webp
+	Quality int     `form:"quality"` // jpeg/webp 质量，png 时决定压缩级别
+	Width   int     `form:"width"`   // 最大宽度
+	Height  int     `form:"height"`  // 最大高度
+	Scale   float64 `form:"scale"`   // 缩放比例，先于 width/height 生效
+	Rotate  string  `form:"rotate"`  // 0 | 90 | 180 | 270 | auto
+	Base64  bool    `form:"base64"`  // 返回 base64 JSON
+}
+
+// ScreenshotResponse is returned for base64=true.
+type ScreenshotResponse struct {
+	Format string `json:"format"`
+	Mime   string `json:"mime"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Data   string `json:"data"`
+}
+
+func parseScreenshotOptions(c *gin.Context) (ScreenshotOptions, error) {
+	var options ScreenshotOptions
+	if err := c.ShouldBindQuery(&options); err != nil {
+		return options, err
+	}
+	// 兼容旧的拼写错误参数
+	if options.Quality == 0 {
+		options.Quality, _ = strconv.Atoi(c.Query("qulaity"))
+	}
+	switch options.Format {
+	case "":
+		options.Format = "png"
+	case "jpg":
+		options.Format = "jpeg"
+	}
+	if _, ok := screenshotMimeTypes[options.Format]; !ok {
+		return options, fmt.Errorf("unsupported format %s", options.Format)
+	}
+	if options.Quality < 1 || options.Quality > 100 {
+		options.Quality = defaultJpegQuality
+		if options.Format == "png" {
+			options.Quality = defaultPngQuality
+		}
+	}
+	if options.Scale < 0 || options.Scale > 1 {
+		return options, errors.New("scale must be between 0 and 1")
+	}
+	switch options.Rotate {
+	case "", "0", "90", "180", "270", rotateAuto:
+	default:
+		return options, errors.New("rotate must be 0, 90, 180, 270 or auto")
+	}
+	return options, nil
+}
+
+// untouched reports whether png bytes from the device can be sent as they are.
+func (o ScreenshotOptions) untouched() bool {
+	return o.Format == "png" && o.Width == 0 && o.Height == 0 && o.Scale == 0 && (o.Rotate == "" || o.Rotate == "0")
+}
+
+// transformScreenshot scales and rotates img. orientation is only called for
+// rotate=auto and returns the clockwise rotation of the device screen.
+func transformScreenshot(img image.Image, options ScreenshotOptions, orientation func() int) image.Image {
+	degrees := 0
+	if options.Rotate == rotateAuto {
+		if orientation != nil {
+			degrees = uprightRotation(img.Bounds(), orientation())
+		}
+	} else {
+		degrees, _ = strconv.Atoi(options.Rotate)
+	}
+	img = imageutil.Rotate(img, degrees)
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if options.Scale > 0 {
+		w, h = max(1, int(float64(w)*options.Scale)), max(1, int(float64(h)*options.Scale))
+	}
+	w, h = imageutil.FitSize(w, h, options.Width, options.Height)
+	if w != b.Dx() || h != b.Dy() {
+		img = imageutil.Resize(img, w, h)
+	}
+	return img
+}
+
+// encodeScreenshot encodes img in the requested format, webp goes through
+// ffmpeg because Go has no webp encoder.
+func (s *Server) encodeScreenshot(ctx context.Context, img image.Image, options ScreenshotOptions) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if options.Format != "webp" {
+		if err := imageutil.Encode(buf, img, options.Format, options.Quality); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	if err := imageutil.Encode(buf, img, "png", 0); err != nil {
+		return nil, err
+	}
+	return s.ffmpegPipe(ctx, buf.Bytes(), "-f", "png_pipe", "-i", "pipe:0",
+		"-c:v", "libwebp", "-quality", strconv.Itoa(options.Quality), "-f", "webp", "pipe:1")
+}
+
+// renderScreenshot applies options to a screenshot. pngBytes is the encoded
+// screenshot if the device delivered png, img the decoded one otherwise.
+func (s *Server) renderScreenshot(ctx context.Context, pngBytes []byte, img image.Image, options ScreenshotOptions, orientation func() int) ([]byte, image.Rectangle, error) {
+	if pngBytes != nil && options.untouched() {
+		config, _, err := image.DecodeConfig(bytes.NewReader(pngBytes))
+		if err != nil {
+			return nil, image.Rectangle{}, err
+		}
+		return pngBytes, image.Rect(0, 0, config.Width, config.Height), nil
+	}
+	if img == nil {
+		var err error
+		if img, _, err = image.Decode(bytes.NewReader(pngBytes)); err != nil {
+			return nil, image.Rectangle{}, err
+		}
+	}
+	img = transformScreenshot(img, options, orientation)
+	data, err := s.encodeScreenshot(ctx, img, options)
+	return data, img.Bounds(), err
+}
+
+func (s *Server) writeScreenshot(c *gin.Context, pngBytes []byte, img image.Image, options ScreenshotOptions, orientation func() int) {
+	data, bounds, err := s.renderScreenshot(c.Request.Context(), pngBytes, img, options, orientation)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errFFmpegNotConfigured) {
+			status = http.StatusNotImplemented
+		}
+		c.JSON(status, GenericResponse{Error: err.Error()})
+		return
+	}
+	mime := screenshotMimeTypes[options.Format]
+	if options.Base64 {
+		c.JSON(http.StatusOK, ScreenshotResponse{
+			Format: options.Format,
+			Mime:   mime,
+			Width:  bounds.Dx(),
+			Height: bounds.Dy(),
+			Data:   base64.StdEncoding.EncodeToString(data),
+		})
+		return
+	}
+	c.Data(http.StatusOK, mime, data)
+}
+
+// uprightRotation returns the rotation that turns the screenshot of a device
+// held in landscape upright, 0 if the device already delivered it landscape.
+func uprightRotation(img image.Rectangle, degrees int) int {
+	if degrees == 90 || degrees == 270 {
+		if img.Dx() > img.Dy() {
+			return 0
+		}
+	}
+	return degrees
+}
+
+// captureScreen takes a screenshot of an iOS or Android device by udid and
+// returns it with the platform and the rotation callback for rotate=auto.
+func (s *Server) captureScreen(udid string) (image.Image, string, func() int, error) {
+	if device, ok := s.iosDevice(udid); ok {
+		if s.tunnelRequired(udid) {
+			return nil, "ios", nil, errTunnelRequired
+		}
+		data, err := captureIosScreenshot(device)
+		if err != nil {
+			return nil, "ios", nil, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		return img, "ios", func() int { return s.wdaOrientation(udid) }, err
+	}
+	if device, ok := s.androidDeviceBySerial(udid); ok {
+		img, err := captureAndroidScreen(device)
+		return img, "android", func() int { return androidOrientation(device) }, err
+	}
+	return nil, "", nil, errDeviceNotFound
+}
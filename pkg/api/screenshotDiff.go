@@ -0,0 +1,346 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blacklee123/go-ios-android/pkg/utils/imageutil"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDiffTolerance = 16
+	defaultDiffThreshold = 0.1
+	baselineExt          = ".png"
+)
+
+var (
+	baselineKeyPattern  = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+	errBaselineNotFound = errors.New("baseline not found")
+)
+
+// DiffRegion is an area left out of the comparison. Coordinates are pixels
+// of the baseline, or fractions of its size when Normalized is set.
+type DiffRegion struct {
+	X          float64 `json:"x"`
+	Y          float64 `json:"y"`
+	Width      float64 `json:"width"`
+	Height     float64 `json:"height"`
+	Normalized bool    `json:"normalized"`
+}
+
+// DiffResponse is the result of a screenshot comparison, Mismatch and
+// Threshold are percentages.
+type DiffResponse struct {
+	Key        string  `json:"key,omitempty"`
+	Passed     bool    `json:"passed"`
+	Mismatch   float64 `json:"mismatch"`
+	Threshold  float64 `json:"threshold"`
+	Mismatched int     `json:"mismatched_pixels"`
+	Total      int     `json:"total_pixels"`
+	Created    bool    `json:"created,omitempty"` // 基准图不存在，已用当前截图创建
+	Diff       string  `json:"diff,omitempty"`    // base64 png
+}
+
+// Baseline is a stored baseline image.
+type Baseline struct {
+	Key       string    `json:"key"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// formValue reads a multipart field and falls back to the query.
+func formValue(c *gin.Context, key string) string {
+	if value, ok := c.GetPostForm(key); ok {
+		return value
+	}
+	return c.Query(key)
+}
+
+// hCompareScreenshot compares a screenshot of the device with the uploaded
+// baseline file or the stored baseline of key. With save=true a missing
+// stored baseline is created from the screenshot.
+func (s *Server) hCompareScreenshot(c *gin.Context) {
+	udid := c.Param("udid")
+	key := formValue(c, "key")
+	if key != "" && !baselineKeyPattern.MatchString(key) {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "key may only contain letters, digits, '.', '_' and '-'"})
+		return
+	}
+	tolerance := defaultDiffTolerance
+	if value := formValue(c, "tolerance"); value != "" {
+		var err error
+		if tolerance, err = strconv.Atoi(value); err != nil || tolerance < 0 || tolerance > 255 {
+			c.JSON(http.StatusBadRequest, GenericResponse{Error: "tolerance must be between 0 and 255"})
+			return
+		}
+	}
+	threshold := defaultDiffThreshold
+	if value := formValue(c, "threshold"); value != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(value, 64); err != nil || threshold < 0 || threshold > 100 {
+			c.JSON(http.StatusBadRequest, GenericResponse{Error: "threshold must be a percentage between 0 and 100"})
+			return
+		}
+	}
+	var regions []DiffRegion
+	if value := formValue(c, "ignore"); value != "" {
+		if err := json.Unmarshal([]byte(value), &regions); err != nil {
+			c.JSON(http.StatusBadRequest, GenericResponse{Error: "ignore must be a JSON array of regions: " + err.Error()})
+			return
+		}
+	}
+
+	baseline, err := s.readBaselineUpload(c, "baseline")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if baseline == nil && key == "" {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "either a baseline file or a key is required"})
+		return
+	}
+
+	actual, _, orientation, err := s.captureScreen(udid)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errDeviceNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, GenericResponse{Error: err.Error()})
+		return
+	}
+	if c.Query("rotate") == rotateAuto {
+		actual = transformScreenshot(actual, ScreenshotOptions{Rotate: rotateAuto}, orientation)
+	}
+
+	if baseline == nil {
+		baseline, err = s.loadBaseline(key)
+		if errors.Is(err, errBaselineNotFound) && formValue(c, "save") == "true" {
+			if err := s.saveBaseline(key, actual); err != nil {
+				c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+				return
+			}
+			s.logger.Info("baseline created", zap.String("key", key), zap.String("udid", udid))
+			c.JSON(http.StatusOK, DiffResponse{Key: key, Passed: true, Threshold: threshold, Created: true})
+			return
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errBaselineNotFound) {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, GenericResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	size := baseline.Bounds().Size()
+	ignore := make([]image.Rectangle, 0, len(regions))
+	for _, region := range regions {
+		ignore = append(ignore, region.rect(size))
+	}
+	result, err := imageutil.Diff(baseline, actual, tolerance, ignore)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, GenericResponse{Error: err.Error()})
+		return
+	}
+
+	ret := DiffResponse{
+		Key:        key,
+		Passed:     result.Percent <= threshold,
+		Mismatch:   result.Percent,
+		Threshold:  threshold,
+		Mismatched: result.Mismatched,
+		Total:      result.Total,
+	}
+	if formValue(c, "diff") != "false" {
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, result.Diff); err != nil {
+			c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+			return
+		}
+		ret.Diff = base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+func (r DiffRegion) rect(size image.Point) image.Rectangle {
+	x, y, w, h := r.X, r.Y, r.Width, r.Height
+	if r.Normalized {
+		x, w = x*float64(size.X), w*float64(size.X)
+		y, h = y*float64(size.Y), h*float64(size.Y)
+	}
+	return image.Rect(int(x), int(y), int(x+w+0.5), int(y+h+0.5))
+}
+
+// readBaselineUpload decodes the uploaded image of field, nil if there is none.
+func (s *Server) readBaselineUpload(c *gin.Context, field string) (image.Image, error) {
+	file, err := c.FormFile(field)
+	if err != nil {
+		return nil, nil
+	}
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", field, err)
+	}
+	return img, nil
+}
+
+func (s *Server) baselinePath(key string) string {
+	return filepath.Join(s.config.TmpDir, "baselines", key+baselineExt)
+}
+
+func (s *Server) loadBaseline(key string) (image.Image, error) {
+	f, err := os.Open(s.baselinePath(key))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", errBaselineNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+func (s *Server) saveBaseline(key string, img image.Image) error {
+	path := s.baselinePath(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return err
+	}
+	// 先写临时文件再重命名，比较时不会读到一半的图片
+	tmp := path + ".part"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Server) baselineInfo(key string) (Baseline, error) {
+	path := s.baselinePath(key)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return Baseline{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return Baseline{}, err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return Baseline{}, err
+	}
+	return Baseline{Key: key, Width: config.Width, Height: config.Height, Size: stat.Size(), UpdatedAt: stat.ModTime()}, nil
+}
+
+func (s *Server) hListBaselines(c *gin.Context) {
+	entries, _ := os.ReadDir(filepath.Join(s.config.TmpDir, "baselines"))
+	baselines := make([]Baseline, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), baselineExt) {
+			continue
+		}
+		if baseline, err := s.baselineInfo(strings.TrimSuffix(entry.Name(), baselineExt)); err == nil {
+			baselines = append(baselines, baseline)
+		}
+	}
+	sort.Slice(baselines, func(i, j int) bool { return baselines[i].Key < baselines[j].Key })
+	c.JSON(http.StatusOK, baselines)
+}
+
+func (s *Server) hRetrieveBaseline(c *gin.Context) {
+	key := c.Param("key")
+	if !baselineKeyPattern.MatchString(key) {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "invalid key"})
+		return
+	}
+	f, err := os.Open(s.baselinePath(key))
+	if err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: errBaselineNotFound.Error()})
+		return
+	}
+	defer f.Close()
+	c.Header("Content-Type", "image/png")
+	io.Copy(c.Writer, f)
+}
+
+// hSaveBaseline stores the uploaded image file as baseline of key, or a
+// screenshot of the device given as udid.
+func (s *Server) hSaveBaseline(c *gin.Context) {
+	key := c.Param("key")
+	if !baselineKeyPattern.MatchString(key) {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "key may only contain letters, digits, '.', '_' and '-'"})
+		return
+	}
+	img, err := s.readBaselineUpload(c, "image")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	if img == nil {
+		udid := formValue(c, "udid")
+		if udid == "" {
+			c.JSON(http.StatusBadRequest, GenericResponse{Error: "either an image file or a udid is required"})
+			return
+		}
+		if img, _, _, err = s.captureScreen(udid); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errDeviceNotFound) {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, GenericResponse{Error: err.Error()})
+			return
+		}
+	}
+	if err := s.saveBaseline(key, img); err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	baseline, err := s.baselineInfo(key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, baseline)
+}
+
+func (s *Server) hDeleteBaseline(c *gin.Context) {
+	key := c.Param("key")
+	if !baselineKeyPattern.MatchString(key) {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: "invalid key"})
+		return
+	}
+	if err := os.Remove(s.baselinePath(key)); err != nil {
+		c.JSON(http.StatusNotFound, GenericResponse{Error: errBaselineNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, GenericResponse{Message: "deleted " + key})
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"image"
+	"testing"
+)
+
+func TestDiffRegionRect(t *testing.T) {
+	size := image.Pt(1080, 1920)
+	tests := []struct {
+		name   string
+		region DiffRegion
+		want   image.Rectangle
+	}{
+		{"pixels", DiffRegion{X: 10, Y: 20, Width: 100, Height: 50}, image.Rect(10, 20, 110, 70)},
+		{"fractional pixels round the size up", DiffRegion{X: 10.2, Y: 20.7, Width: 99.5, Height: 49.4}, image.Rect(10, 20, 110, 70)},
+		{"normalized", DiffRegion{X: 0, Y: 0, Width: 1, Height: 0.05, Normalized: true}, image.Rect(0, 0, 1080, 96)},
+		{"normalized center", DiffRegion{X: 0.25, Y: 0.5, Width: 0.5, Height: 0.25, Normalized: true}, image.Rect(270, 960, 810, 1440)},
+		{"normalized rounding", DiffRegion{X: 0.1, Y: 0.1, Width: 0.001, Height: 0.001, Normalized: true}, image.Rect(108, 192, 109, 194)},
+		{"empty", DiffRegion{X: 5, Y: 5}, image.Rect(5, 5, 5, 5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.region.rect(size); got != tt.want {
+				t.Errorf("rect = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
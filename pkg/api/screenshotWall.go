@@ -0,0 +1,289 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	defaultWallWidth   = 240
+	defaultWallTimeout = 10 * time.Second
+	maxWallTimeout     = time.Minute
+	// 同时截图的设备数，避免 usbmuxd 和 adb 过载
+	wallConcurrency = 16
+	wallLabelHeight = 18
+	wallPadding     = 4
+)
+
+var (
+	errScreenshotTimeout = errors.New("screenshot timed out")
+	errScreenshotBusy    = errors.New("previous screenshot still running")
+	wallBackground       = color.RGBA{0x20, 0x20, 0x20, 0xff}
+	wallCellBackground   = color.RGBA{0x40, 0x40, 0x40, 0xff}
+	wallLabelColor       = color.RGBA{0xee, 0xee, 0xee, 0xff}
+	wallErrorColor       = color.RGBA{0xff, 0x80, 0x80, 0xff}
+)
+
+// WallScreenshot is the thumbnail of one device, Error is set instead of the
+// image when the capture failed.
+type WallScreenshot struct {
+	Platform string `json:"platform,omitempty"`
+	Error    string `json:"error,omitempty"`
+	*ScreenshotResponse
+}
+
+type wallCapture struct {
+	udid     string
+	platform string
+	img      image.Image
+	err      error
+}
+
+// hScreenshots captures all requested devices (all known devices without
+// udids) concurrently. layout=grid returns one image with a labelled cell per
+// device, otherwise a JSON map of udid to base64 thumbnail.
+func (s *Server) hScreenshots(c *gin.Context) {
+	options, err := parseScreenshotOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, GenericResponse{Error: err.Error()})
+		return
+	}
+	// 缩略图默认使用 jpeg
+	if c.Query("format") == "" {
+		options.Format = "jpeg"
+		if c.Query("quality") == "" {
+			options.Quality = defaultJpegQuality
+		}
+	}
+	if options.Width == 0 && options.Height == 0 && options.Scale == 0 {
+		options.Width = defaultWallWidth
+	}
+	timeout := defaultWallTimeout
+	if value := c.Query("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxWallTimeout {
+			c.JSON(http.StatusBadRequest, GenericResponse{Error: "timeout must be between 1 and 60 seconds"})
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	var udids []string
+	seen := make(map[string]bool)
+	for _, udid := range strings.Split(c.Query("udids"), ",") {
+		if udid = strings.TrimSpace(udid); udid != "" && !seen[udid] {
+			seen[udid] = true
+			udids = append(udids, udid)
+		}
+	}
+	if len(udids) == 0 {
+		udids = s.allDeviceUdids()
+	}
+
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	captures := s.captureScreens(ctx, udids, options, timeout)
+
+	if c.Query("layout") == "grid" {
+		columns, _ := strconv.Atoi(c.Query("columns"))
+		grid := composeWall(captures, columns, c.Query("labels") != "false")
+		data, err := s.encodeScreenshot(ctx, grid, options)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, GenericResponse{Error: err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, screenshotMimeTypes[options.Format], data)
+		return
+	}
+
+	ret := make(map[string]WallScreenshot, len(captures))
+	for _, capture := range captures {
+		shot := WallScreenshot{Platform: capture.platform}
+		if capture.err != nil {
+			shot.Error = capture.err.Error()
+			ret[capture.udid] = shot
+			continue
+		}
+		data, err := s.encodeScreenshot(ctx, capture.img, options)
+		if err != nil {
+			shot.Error = err.Error()
+			ret[capture.udid] = shot
+			continue
+		}
+		bounds := capture.img.Bounds()
+		shot.ScreenshotResponse = &ScreenshotResponse{
+			Format: options.Format,
+			Mime:   screenshotMimeTypes[options.Format],
+			Width:  bounds.Dx(),
+			Height: bounds.Dy(),
+			Data:   base64.StdEncoding.EncodeToString(data),
+		}
+		ret[capture.udid] = shot
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+func (s *Server) allDeviceUdids() []string {
+	var udids []string
+	if s.config.IOS {
+		for _, device := range s.iosDeviceList() {
+			udids = append(udids, device.Properties.SerialNumber)
+		}
+	}
+	if s.config.Android {
+		for _, device := range s.androidDeviceList() {
+			udids = append(udids, device.Serial())
+		}
+	}
+	sort.Strings(udids)
+	return udids
+}
+
+// captureScreens takes and scales the screenshots in parallel, in the order
+// of udids. A device that does not answer within timeout is reported as
+// failed, its capture keeps running in the background until it returns and
+// holds its slot of wallSema until then. Devices with such a capture are
+// skipped.
+func (s *Server) captureScreens(ctx context.Context, udids []string, options ScreenshotOptions, timeout time.Duration) []wallCapture {
+	captures := make([]wallCapture, len(udids))
+	var wg sync.WaitGroup
+	for i, udid := range udids {
+		if !s.startWallCapture(udid) {
+			captures[i] = wallCapture{udid: udid, err: errScreenshotBusy}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, udid string) {
+			defer wg.Done()
+			select {
+			case s.wallSema <- struct{}{}:
+			case <-ctx.Done():
+				s.endWallCapture(udid)
+				captures[i] = wallCapture{udid: udid, err: ctx.Err()}
+				return
+			}
+
+			done := make(chan wallCapture, 1)
+			go func() {
+				defer s.endWallCapture(udid)
+				defer func() { <-s.wallSema }()
+				img, platform, orientation, err := s.captureScreen(udid)
+				if err == nil {
+					img = transformScreenshot(img, options, orientation)
+				}
+				done <- wallCapture{udid: udid, platform: platform, img: img, err: err}
+			}()
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case capture := <-done:
+				captures[i] = capture
+			case <-timer.C:
+				captures[i] = wallCapture{udid: udid, err: errScreenshotTimeout}
+			case <-ctx.Done():
+				captures[i] = wallCapture{udid: udid, err: ctx.Err()}
+			}
+		}(i, udid)
+	}
+	wg.Wait()
+	return captures
+}
+
+// startWallCapture marks the device as being captured, false if it already
+// is.
+func (s *Server) startWallCapture(udid string) bool {
+	s.wallMu.Lock()
+	defer s.wallMu.Unlock()
+	if s.wallCapturing[udid] {
+		return false
+	}
+	s.wallCapturing[udid] = true
+	return true
+}
+
+func (s *Server) endWallCapture(udid string) {
+	s.wallMu.Lock()
+	defer s.wallMu.Unlock()
+	delete(s.wallCapturing, udid)
+}
+
+// composeWall lays the captures out in a grid, columns <= 0 picks a square-ish
+// layout. Every cell is as large as the largest thumbnail.
+func composeWall(captures []wallCapture, columns int, labels bool) image.Image {
+	if len(captures) == 0 {
+		return image.NewRGBA(image.Rect(0, 0, 1, 1))
+	}
+	if columns <= 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(len(captures)))))
+	}
+	columns = min(columns, len(captures))
+	rows := (len(captures) + columns - 1) / columns
+
+	cellW, cellH := defaultWallWidth, 0
+	for _, capture := range captures {
+		if capture.img != nil {
+			b := capture.img.Bounds()
+			cellW, cellH = max(cellW, b.Dx()), max(cellH, b.Dy())
+		}
+	}
+	if cellH == 0 {
+		cellH = cellW * 2
+	}
+	labelH := 0
+	if labels {
+		labelH = wallLabelHeight
+	}
+
+	stepX, stepY := cellW+wallPadding, cellH+labelH+wallPadding
+	wall := image.NewRGBA(image.Rect(0, 0, columns*stepX+wallPadding, rows*stepY+wallPadding))
+	draw.Draw(wall, wall.Bounds(), &image.Uniform{wallBackground}, image.Point{}, draw.Src)
+	for i, capture := range captures {
+		x := wallPadding + (i%columns)*stepX
+		y := wallPadding + (i/columns)*stepY
+		cell := image.Rect(x, y+labelH, x+cellW, y+labelH+cellH)
+		draw.Draw(wall, cell, &image.Uniform{wallCellBackground}, image.Point{}, draw.Src)
+		if capture.img != nil {
+			b := capture.img.Bounds()
+			// 居中放置
+			offset := image.Pt(x+(cellW-b.Dx())/2, y+labelH+(cellH-b.Dy())/2)
+			draw.Draw(wall, b.Sub(b.Min).Add(offset), capture.img, b.Min, draw.Src)
+		} else if capture.err != nil {
+			drawLabel(wall, x+4, y+labelH+cellH/2, cellW-8, capture.err.Error(), wallErrorColor)
+		}
+		if labels {
+			drawLabel(wall, x+2, y+labelH-5, cellW-4, capture.udid, wallLabelColor)
+		}
+	}
+	return wall
+}
+
+// drawLabel draws text with its baseline at y, cut off to fit into width.
+func drawLabel(dst draw.Image, x, y, width int, text string, c color.Color) {
+	face := basicfont.Face7x13
+	if maxChars := width / face.Advance; len(text) > maxChars {
+		text = text[:max(0, maxChars)]
+	}
+	drawer := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	drawer.DrawString(text)
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
 	"log"
@@ -8,11 +9,15 @@ import (
 	"net/http/httputil"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/blacklee123/go-adb/adb"
+	"github.com/blacklee123/go-ios-android/pkg/api/iosvo"
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
 	"github.com/blacklee123/go-ios-android/pkg/web"
 	"github.com/danielpaulus/go-ios/ios"
+	"github.com/danielpaulus/go-ios/ios/forward"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
@@ -21,32 +26,120 @@ type Config struct {
 	Host   string `mapstructure:"host"`
 	Port   string `mapstructure:"port"`
 	TmpDir string `mapstructure:"tmpdir"`
+	// ImageDir holds developer disk images, laid out like go-ios downloads them
+	ImageDir string `mapstructure:"imagedir"`
+	IOS      bool   `mapstructure:"ios"`
+	Android  bool   `mapstructure:"android"`
+	// FFmpeg is the path of ffmpeg, iOS recordings and Android recordings of
+	// several segments can only be exported as MP4 when it is set
+	FFmpeg string `mapstructure:"ffmpeg"`
+	// ScrcpyServer is the path of scrcpy-server.jar for H.264 mirroring,
+	// ScrcpyVersion has to match it
+	ScrcpyServer  string `mapstructure:"scrcpyserver"`
+	ScrcpyVersion string `mapstructure:"scrcpyversion"`
+	// Poco 连接的超时，空闲超过 PocoIdleTimeout 的连接会被关闭
+	PocoConnectTimeout time.Duration `mapstructure:"pococonnecttimeout"`
+	PocoReadTimeout    time.Duration `mapstructure:"pocoreadtimeout"`
+	PocoIdleTimeout    time.Duration `mapstructure:"pocoidletimeout"`
+	// MacroDir holds the saved macros, macros of TmpDir by default
+	MacroDir string `mapstructure:"macrodir"`
+	// AllowedOrigins are the origins besides the server itself whose pages
+	// may open the control WebSocket of a stream, e.g. a frontend dev server
+	AllowedOrigins []string `mapstructure:"allowedorigins"`
 }
 
 type Server struct {
-	router         *gin.Engine
-	logger         *zap.Logger
-	config         *Config
-	iosForwards    map[string]map[int]int
-	iosDevices     map[string]ios.DeviceEntry
-	androidDevice  map[string]adb.Device
-	wdaProxys      map[string]*httputil.ReverseProxy
-	wdaVideoProxys map[string]*httputil.ReverseProxy
+	router          *gin.Engine
+	logger          *zap.Logger
+	config          *Config
+	httpServer      *http.Server
+	iosForwards     map[string]map[int]int
+	androidForwards map[string]map[int]int
+	iosDevices      map[string]ios.DeviceEntry
+	androidDevice   map[string]adb.Device
+	wdaProxys       map[string]*httputil.ReverseProxy
+	wdaVideoProxys  map[string]*httputil.ReverseProxy
+	pocoPool        *poco.Pool
+
+	// ctx is cancelled as soon as the server starts shutting down, every
+	// long running goroutine (WDA runs, listeners, streams) derives from it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	forwardsMu       sync.Mutex
+	forwardListeners map[string]map[int]*forward.ConnListener
+
+	macroMu        sync.Mutex
+	macroRecorders map[string]*macroRecorder
+
+	flowRunsMu sync.Mutex
+	flowRuns   map[string]*flowRun
+
+	wdaMu   sync.Mutex
+	wdaRuns map[string]*wdaRun
+	wdaWg   sync.WaitGroup
+
+	// iosTunnelRequired holds the devices that need RSD but have no tunnel,
+	// iosTunnels the tunnel and last handshake of every device
+	tunnelMu          sync.Mutex
+	iosTunnelRequired map[string]bool
+	iosTunnels        map[string]iosvo.TunnelInfo
+
+	devicesMu        sync.RWMutex
+	androidDevicesMu sync.RWMutex
+
+	// attachCount counts the attach events of every device, a reboot waits
+	// for it to change
+	attachMu    sync.Mutex
+	attachCount map[string]int
+
+	readinessMu      sync.Mutex
+	readiness        map[string]*iosvo.DeviceState
+	readinessCancels map[string]context.CancelFunc
+
+	recordingsMu sync.Mutex
+	recordings   map[string]*recording
+
+	// wallSema limits the screenshot wall captures of all requests,
+	// wallCapturing holds the devices whose capture is still running
+	wallSema      chan struct{}
+	wallMu        sync.Mutex
+	wallCapturing map[string]bool
 }
 
 func NewServer(config *Config, logger *zap.Logger) (*Server, error) {
 	logger.Info("confg", zap.String("confg", fmt.Sprintf("%v", config)))
 	config.TmpDir = path.Join(config.TmpDir, ".tmp")
 	os.MkdirAll(config.TmpDir, os.ModePerm)
+	ctx, cancel := context.WithCancel(context.Background())
 	srv := &Server{
-		router:         gin.Default(),
-		logger:         logger,
-		config:         config,
-		iosForwards:    make(map[string]map[int]int),
-		iosDevices:     make(map[string]ios.DeviceEntry),
-		androidDevice:  make(map[string]adb.Device),
-		wdaProxys:      make(map[string]*httputil.ReverseProxy),
-		wdaVideoProxys: make(map[string]*httputil.ReverseProxy),
+		router:          gin.Default(),
+		logger:          logger,
+		config:          config,
+		iosForwards:     make(map[string]map[int]int),
+		androidForwards: make(map[string]map[int]int),
+		iosDevices:      make(map[string]ios.DeviceEntry),
+		androidDevice:   make(map[string]adb.Device),
+		wdaProxys:       make(map[string]*httputil.ReverseProxy),
+		wdaVideoProxys:  make(map[string]*httputil.ReverseProxy),
+		pocoPool: poco.NewPool(poco.Options{
+			ConnectTimeout: config.PocoConnectTimeout,
+			ReadTimeout:    config.PocoReadTimeout,
+		}, config.PocoIdleTimeout),
+		ctx:               ctx,
+		cancel:            cancel,
+		forwardListeners:  make(map[string]map[int]*forward.ConnListener),
+		wdaRuns:           make(map[string]*wdaRun),
+		iosTunnelRequired: make(map[string]bool),
+		iosTunnels:        make(map[string]iosvo.TunnelInfo),
+		readiness:         make(map[string]*iosvo.DeviceState),
+		readinessCancels:  make(map[string]context.CancelFunc),
+		attachCount:       make(map[string]int),
+		recordings:        make(map[string]*recording),
+		wallSema:          make(chan struct{}, wallConcurrency),
+		wallCapturing:     make(map[string]bool),
+		macroRecorders:    make(map[string]*macroRecorder),
+		flowRuns:          make(map[string]*flowRun),
 	}
 	return srv, nil
 }
@@ -62,10 +155,54 @@ func (s *Server) registerHandlers() {
 		ctx.JSON(http.StatusOK, append(ios, android...))
 	})
 	api.GET("/ios", s.hListIOS)
+	api.GET("/screenshots", s.hScreenshots)
+
+	// 与平台无关的设备接口，按 udid 查找 iOS 或 Android 设备
+	devices := api.Group("/devices/:udid")
+	devices.POST("/screenshot/compare", s.hCompareScreenshot)
+	devices.POST("/element/tap", s.hTapElement)
+	devices.GET("/clipboard", s.hGetClipboard)
+	devices.POST("/clipboard", s.hSetClipboard)
+
+	// macros：记录经过服务的输入并回放
+	devices.POST("/macro/start", s.hStartMacro)
+	devices.GET("/macro", s.hRetrieveMacroRecording)
+	devices.POST("/macro/stop", s.hStopMacro)
+	devices.POST("/macros/:id/replay", s.hReplayMacro)
+	api.GET("/macros", s.hListMacros)
+	api.POST("/macros", s.hUploadMacro)
+	api.GET("/macros/:id", s.hRetrieveMacro)
+	api.DELETE("/macros/:id", s.hDeleteMacro)
+
+	// flows：上传的 YAML 脚本在一台或多台设备上执行
+	api.POST("/flows/validate", s.hValidateFlow)
+	api.POST("/flows/run", s.hRunFlow)
+	api.GET("/flows/runs", s.hListFlowRuns)
+	api.GET("/flows/runs/:id", s.hRetrieveFlowRun)
+	api.POST("/flows/runs/:id/stop", s.hStopFlowRun)
+	api.DELETE("/flows/runs/:id", s.hDeleteFlowRun)
+	api.GET("/flows/runs/:id/artifacts/*filepath", s.hRetrieveFlowArtifact)
+
+	// visual diff baselines
+	api.GET("/baselines", s.hListBaselines)
+	api.GET("/baselines/:key", s.hRetrieveBaseline)
+	api.PUT("/baselines/:key", s.hSaveBaseline)
+	api.DELETE("/baselines/:key", s.hDeleteBaseline)
+	if s.config.IOS {
+		api.GET("/tunnel", s.hTunnel)
+		api.GET("/readiness", s.hListReadiness)
+		// 未就绪的设备也要能查询状态，不经过 DeviceMiddleware
+		api.GET("/ios/:udid/readiness", s.hRetrieveReadiness)
+	}
 	api.GET("/android", s.hListAndroid)
 
-	s.registerIosHandlers(api)
-	s.registerAndroidHandlers(api)
+	if s.config.IOS {
+		s.registerIosHandlers(api)
+		s.registerIosPairingHandlers(api)
+	}
+	if s.config.Android {
+		s.registerAndroidHandlers(api)
+	}
 }
 
 func (s *Server) registerWebHandlers() {
@@ -89,13 +226,26 @@ func (s *Server) registerIosHandlers(api *gin.RouterGroup) {
 	iosDevice := api.Group("/ios/:udid")
 	iosDevice.Use(s.DeviceMiddleware())
 	iosDevice.GET("", s.hRetrieveIOS)
+	iosDevice.POST("/tunnel/refresh", s.hRefreshTunnel)
+
+	// power
+	iosDevice.POST("/reboot", s.hIosReboot)
+	iosDevice.POST("/shutdown", s.hIosShutdown)
+	iosDevice.POST("/sleep", s.hIosSleep)
+
+	// developer disk image
+	iosDevice.GET("/image", s.hRetrieveImage)
+	iosDevice.POST("/image/mount", s.hMountImage)
 
 	iosDevice.GET("/apps", s.hListApp)
 	iosDevice.GET("/apps_with_icon", s.hListAppWithIcon)
 	iosDevice.POST("/apps", s.hInstallApp)
 
-	iosDevice.GET("/processes", s.hListProcess)
-	iosDevice.GET("/screenshot", s.hScreenshot)
+	// 以下接口在 iOS 17+ 上依赖 RSD 隧道
+	tunnelMiddleware := s.TunnelMiddleware()
+
+	iosDevice.GET("/processes", tunnelMiddleware, s.hListProcess)
+	iosDevice.GET("/screenshot", tunnelMiddleware, s.hScreenshot)
 
 	// fsync
 	iosDevice.GET("fsync/list/*filepath", s.hListFiles)
@@ -109,33 +259,85 @@ func (s *Server) registerIosHandlers(api *gin.RouterGroup) {
 	iosDevice.POST("/forwards", s.hCreateForward)
 
 	// wda
-	iosDevice.Any("/wda/*path", s.hWda)
-	iosDevice.Any("/wdavideo/*path", s.hWdaVideo)
+	iosDevice.Any("/wda/*path", tunnelMiddleware, s.hWda)
+	iosDevice.Any("/wdavideo/*path", tunnelMiddleware, s.hWdaVideo)
 
 	// location
-	iosDevice.POST("/location", s.hSetLocation)
-	iosDevice.POST("/location/reset", s.hResetLocation)
+	iosDevice.POST("/location", tunnelMiddleware, s.hSetLocation)
+	iosDevice.POST("/location/reset", tunnelMiddleware, s.hResetLocation)
 
 	// perf
-	iosDevice.GET("/perf/attributes", s.hListAttributes)
-	iosDevice.GET("/perf/sse", streamingMiddleWare, s.hPerf)
+	iosDevice.GET("/perf/attributes", tunnelMiddleware, s.hListAttributes)
+	iosDevice.GET("/perf/sse", tunnelMiddleware, streamingMiddleWare, s.hPerf)
+
+	// inspector
+	iosDevice.GET("/hierarchy", tunnelMiddleware, s.hIosHierarchy)
+	iosDevice.GET("/hierarchy/find", tunnelMiddleware, s.hIosFindElements)
 
 	// poco
-	iosDevice.GET("/poco/:port/dump", s.hPocoDump)
+	iosPoco := iosDevice.Group("/poco/:port")
+	iosPoco.Use(s.IosPocoMiddleware())
+	s.registerPocoHandlers(iosPoco)
+
+	// recordings
+	iosDevice.POST("/recordings", tunnelMiddleware, s.hStartIosRecording)
+	s.registerRecordingHandlers(iosDevice)
 
 	// app
 	iosApp := iosDevice.Group("/apps/:bundleid")
-	iosApp.POST("/launch", s.hLaunchApp)
-	iosApp.POST("/kill", s.hKillApp)
+	iosApp.POST("/launch", tunnelMiddleware, s.hLaunchApp)
+	iosApp.POST("/kill", tunnelMiddleware, s.hKillApp)
 	iosApp.POST("/uninstall", s.hUninstallApp)
 	iosApp.GET("/fsync/list/*filepath", s.hListFiles)
 	iosApp.GET("/fsync/pull/*filepath", s.hPullFile)
 }
 
+func (s *Server) registerIosPairingHandlers(api *gin.RouterGroup) {
+	// 未配对的设备不在 iosDevices 中，直接从 usbmuxd 查找
+	iosAttached := api.Group("/ios/:udid")
+	iosAttached.Use(s.AttachedDeviceMiddleware())
+	iosAttached.GET("/pairing", s.hRetrievePairing)
+	iosAttached.POST("/pair", s.hPair)
+	iosAttached.POST("/unpair", s.hUnpair)
+}
+
+func (s *Server) registerRecordingHandlers(device *gin.RouterGroup) {
+	device.GET("/recordings", s.hListRecordings)
+	device.GET("/recordings/:id", s.hRetrieveRecording)
+	device.POST("/recordings/:id/stop", s.hStopRecording)
+	device.GET("/recordings/:id/download", s.hDownloadRecording)
+	device.DELETE("/recordings/:id", s.hDeleteRecording)
+}
+
 func (s *Server) registerAndroidHandlers(api *gin.RouterGroup) {
 	androidDevice := api.Group("/android/:udid")
 	androidDevice.Use(s.AndroidDeviceMiddleware())
 	androidDevice.GET("screenshot", s.hAndroidScreenshot)
+	androidDevice.POST("/reboot", s.hAndroidReboot)
+
+	// recordings
+	androidDevice.POST("/recordings", s.hStartAndroidRecording)
+	s.registerRecordingHandlers(androidDevice)
+
+	// mirroring
+	androidDevice.GET("/stream", s.hAndroidStream)
+
+	// input
+	androidDevice.POST("/input", s.hAndroidInput)
+
+	// app
+	androidApp := androidDevice.Group("/apps/:bundleid")
+	androidApp.POST("/launch", s.hAndroidLaunchApp)
+	androidApp.POST("/kill", s.hAndroidKillApp)
+
+	// inspector
+	androidDevice.GET("/hierarchy", s.hAndroidHierarchy)
+	androidDevice.GET("/hierarchy/find", s.hAndroidFindElements)
+
+	// poco
+	androidPoco := androidDevice.Group("/poco/:port")
+	androidPoco.Use(s.AndroidPocoMiddleware())
+	s.registerPocoHandlers(androidPoco)
 }
 
 func (s *Server) registerMiddlewares() {
@@ -146,12 +348,18 @@ func (s *Server) ListenAndServe() *http.Server {
 	s.registerMiddlewares()
 	s.registerHandlers()
 	srv := s.startServer()
-	err := s.StartIosTunnel()
-	if err != nil {
-		s.logger.Fatal("iOS tunnel is not running, please use `sudo go-ios-android tunnel start` to start")
+	if s.config.IOS {
+		err := s.StartIosTunnel()
+		if err != nil {
+			// 无隧道时继续运行，iOS 17 以下的设备不受影响
+			s.logger.Warn("iOS tunnel is not running, iOS 17+ devices are unavailable until `sudo go-ios-android tunnel start` is run")
+		}
+		go s.watchIosTunnel(err == nil)
+		go s.StartIosListening()
+	}
+	if s.config.Android {
+		go s.StartAdbListening()
 	}
-	go s.StartIosListening()
-	go s.StartAdbListening()
 	return srv
 }
 
@@ -169,6 +377,9 @@ func (s *Server) startServer() *http.Server {
 		IdleTimeout:  2 * 30 * time.Second,
 		Handler:      s.router,
 	}
+	// 关闭时先停止接收新请求，再通知所有流式接口和 WDA 退出
+	srv.RegisterOnShutdown(s.cancel)
+	s.httpServer = srv
 
 	// start the server in the background
 	go func() {
@@ -182,6 +393,24 @@ func (s *Server) startServer() *http.Server {
 	return srv
 }
 
+// persistentDirs are the directories of TmpDir that hold data kept across
+// restarts, the rest of TmpDir is removed by Clean.
+var persistentDirs = map[string]bool{
+	"baselines": true,
+	"macros":    true,
+}
+
+// Clean removes the temporary files of TmpDir, e.g. recordings and flow
+// runs whose state is only kept in memory, and keeps persistentDirs.
 func (s *Server) Clean() {
-	os.RemoveAll(s.config.TmpDir)
+	entries, err := os.ReadDir(s.config.TmpDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && persistentDirs[entry.Name()] {
+			continue
+		}
+		os.RemoveAll(path.Join(s.config.TmpDir, entry.Name()))
+	}
 }
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// closeStreamEvent is the SSE event sent to clients right before a stream is
+// ended because the server is shutting down.
+const closeStreamEvent = "close"
+
+// Shutdown stops the server in order: stop accepting requests, end SSE streams,
+// cancel WDA test runs, close port forwards, clean TmpDir and finally flush
+// the logger. The server has no audit trail or metrics of its own, the logs
+// are all that is buffered. Steps that are still running when ctx expires are
+// abandoned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	if s.httpServer != nil {
+		s.logger.Info("stopping http server")
+		// RegisterOnShutdown cancels s.ctx, which ends streams and WDA runs
+		err = s.httpServer.Shutdown(ctx)
+		if err != nil {
+			s.logger.Warn("http server did not stop in time", zap.Error(err))
+		}
+	}
+	s.cancel()
+
+	s.logger.Info("waiting for WDA sessions to stop")
+	done := make(chan struct{})
+	go func() {
+		s.wdaWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.logger.Warn("WDA sessions did not stop in time", zap.Error(ctx.Err()))
+	}
+
+	s.logger.Info("closing port forwards")
+	s.closeAllForwards()
+	s.closeAndroidForwards()
+	s.pocoPool.Close()
+
+	s.logger.Info("cleaning tmp dir", zap.String("tmpdir", s.config.TmpDir))
+	s.Clean()
+
+	// stdout 和 stderr 上的 Sync 在部分系统上会报错，忽略
+	s.logger.Sync()
+	return err
+}
+
+// requestContext returns a context that is done when either the client goes
+// away or the server starts shutting down.
+func (s *Server) requestContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	stop := context.AfterFunc(s.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// closeStream tells an SSE client that the stream ends because of shutdown.
+func (s *Server) closeStream(c *gin.Context) {
+	c.SSEvent(closeStreamEvent, "server shutting down")
+}
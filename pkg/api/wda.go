@@ -1,13 +1,32 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/danielpaulus/go-ios/ios"
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	wdaPort           = 8100
+	wdaRequestTimeout = 30 * time.Second
+)
+
 func (s *Server) hWda(c *gin.Context) {
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
-	proxy := s.wdaProxys[device.Properties.SerialNumber]
+	proxy, _ := s.wdaProxies(device.Properties.SerialNumber)
+	if proxy == nil {
+		c.JSON(http.StatusServiceUnavailable, GenericResponse{Error: errWdaNotForwarded.Error()})
+		return
+	}
 
 	// 获取路由参数中捕获的路径部分
 	path := c.Param("path")
@@ -24,12 +43,33 @@ func (s *Server) hWda(c *gin.Context) {
 	// 清除编码后的路径，避免冲突
 	c.Request.URL.RawPath = ""
 
-	proxy.ServeHTTP(c.Writer, c.Request)
+	// 录制宏时记下成功的输入请求
+	var body []byte
+	recording := c.Request.Method == http.MethodPost && s.macroRecorder(device.Properties.SerialNumber) != nil
+	if recording {
+		body, _ = io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// 服务关闭时结束代理中的请求（如 MJPEG 长连接）
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	proxy.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+
+	if recording && c.Writer.Status() < http.StatusBadRequest {
+		for _, action := range wdaMacroActions(path, body) {
+			s.recordMacroAction(device.Properties.SerialNumber, action)
+		}
+	}
 }
 
 func (s *Server) hWdaVideo(c *gin.Context) {
 	device := c.MustGet(IOS_KEY).(ios.DeviceEntry)
-	proxy := s.wdaVideoProxys[device.Properties.SerialNumber]
+	_, proxy := s.wdaProxies(device.Properties.SerialNumber)
+	if proxy == nil {
+		c.JSON(http.StatusServiceUnavailable, GenericResponse{Error: errWdaNotForwarded.Error()})
+		return
+	}
 
 	// 获取路由参数中捕获的路径部分
 	path := c.Param("path")
@@ -46,5 +86,201 @@ func (s *Server) hWdaVideo(c *gin.Context) {
 	// 清除编码后的路径，避免冲突
 	c.Request.URL.RawPath = ""
 
-	proxy.ServeHTTP(c.Writer, c.Request)
+	// 服务关闭时结束代理中的请求（如 MJPEG 长连接）
+	ctx, cancel := s.requestContext(c)
+	defer cancel()
+	proxy.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+}
+
+// wdaResponse is the envelope of every WDA response.
+type wdaResponse struct {
+	Value     json.RawMessage `json:"value"`
+	SessionID string          `json:"sessionId"`
+}
+
+// wdaError is the value of a failed WDA call.
+type wdaError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// wdaRequest calls WDA of the device through its forwarded port and decodes
+// the value of the response into out unless out is nil.
+func (s *Server) wdaRequest(ctx context.Context, udid, method, path string, body interface{}, out interface{}) error {
+	wdaResp, err := s.wdaCall(ctx, udid, method, path, body)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(wdaResp.Value, out)
+}
+
+// wdaCall calls WDA and returns the whole response, failed calls as error.
+func (s *Server) wdaCall(ctx context.Context, udid, method, path string, body interface{}) (*wdaResponse, error) {
+	hostPort, ok := s.forwardPort(udid, wdaPort)
+	if !ok {
+		return nil, errWdaNotForwarded
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	ctx, cancel := context.WithTimeout(ctx, wdaRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://localhost:%d%s", hostPort, path), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var wdaResp wdaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&wdaResp); err != nil {
+		return nil, fmt.Errorf("WDA %s %s: %s: %w", method, path, resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var wdaErr wdaError
+		json.Unmarshal(wdaResp.Value, &wdaErr)
+		return nil, fmt.Errorf("WDA %s %s: %s: %s", method, path, wdaErr.Error, strings.TrimSpace(wdaErr.Message))
+	}
+	return &wdaResp, nil
+}
+
+// wdaSessionID returns the id of the current WDA session and creates one if
+// there is none, most WDA commands need a session.
+func (s *Server) wdaSessionID(ctx context.Context, udid string) (string, error) {
+	status, err := s.wdaCall(ctx, udid, http.MethodGet, "/status", nil)
+	if err != nil {
+		return "", err
+	}
+	if status.SessionID != "" {
+		return status.SessionID, nil
+	}
+	created, err := s.wdaCall(ctx, udid, http.MethodPost, "/session", gin.H{"capabilities": gin.H{}})
+	if err != nil {
+		return "", err
+	}
+	if created.SessionID != "" {
+		return created.SessionID, nil
+	}
+	var value struct {
+		SessionID string `json:"sessionId"`
+	}
+	json.Unmarshal(created.Value, &value)
+	if value.SessionID == "" {
+		return "", errors.New("WDA did not return a session id")
+	}
+	return value.SessionID, nil
+}
+
+// wdaSessionRequest calls path in the current WDA session.
+func (s *Server) wdaSessionRequest(ctx context.Context, udid, method, path string, body interface{}, out interface{}) error {
+	sessionID, err := s.wdaSessionID(ctx, udid)
+	if err != nil {
+		return err
+	}
+	return s.wdaRequest(ctx, udid, method, "/session/"+sessionID+path, body, out)
+}
+
+// wdaWindowSize returns the size of the screen in points, the coordinates
+// of WDA actions.
+func (s *Server) wdaWindowSize(ctx context.Context, udid string) (width, height float64, err error) {
+	var size struct {
+		Width  float64 `json:"width"`
+		Height float64 `json:"height"`
+	}
+	if err := s.wdaSessionRequest(ctx, udid, http.MethodGet, "/window/size", nil, &size); err != nil {
+		return 0, 0, err
+	}
+	return size.Width, size.Height, nil
+}
+
+// wdaTap taps at a point with W3C actions, holding it for duration if it is
+// positive.
+func (s *Server) wdaTap(ctx context.Context, udid string, x, y float64, duration time.Duration) error {
+	steps := []gin.H{
+		{"type": "pointerMove", "x": x, "y": y},
+		{"type": "pointerDown"},
+	}
+	if duration > 0 {
+		steps = append(steps, gin.H{"type": "pause", "duration": duration.Milliseconds()})
+	}
+	steps = append(steps, gin.H{"type": "pointerUp"})
+	return s.wdaSessionRequest(ctx, udid, http.MethodPost, "/actions", gin.H{
+		"actions": []gin.H{{
+			"id":         "finger-0",
+			"type":       "pointer",
+			"parameters": gin.H{"pointerType": "touch"},
+			"actions":    steps,
+		}},
+	}, nil)
+}
+
+// wdaGesture moves one finger along each path in duration, the points of a
+// path are spread evenly over it.
+func (s *Server) wdaGesture(ctx context.Context, udid string, paths [][]GesturePoint, duration time.Duration) error {
+	actions := make([]gin.H, 0, len(paths))
+	for i, path := range paths {
+		if len(path) == 0 {
+			return fmt.Errorf("pointer %d has no points", i)
+		}
+		steps := []gin.H{
+			{"type": "pointerMove", "x": path[0].X, "y": path[0].Y},
+			{"type": "pointerDown"},
+		}
+		if len(path) == 1 {
+			steps = append(steps, gin.H{"type": "pause", "duration": duration.Milliseconds()})
+		}
+		for _, p := range path[1:] {
+			steps = append(steps, gin.H{"type": "pointerMove", "x": p.X, "y": p.Y, "duration": duration.Milliseconds() / int64(len(path)-1)})
+		}
+		steps = append(steps, gin.H{"type": "pointerUp"})
+		actions = append(actions, gin.H{
+			"id":         fmt.Sprintf("finger-%d", i),
+			"type":       "pointer",
+			"parameters": gin.H{"pointerType": "touch"},
+			"actions":    steps,
+		})
+	}
+	return s.wdaSessionRequest(ctx, udid, http.MethodPost, "/actions", gin.H{"actions": actions}, nil)
+}
+
+// wdaKeys types text into the focused element.
+func (s *Server) wdaKeys(ctx context.Context, udid, text string) error {
+	return s.wdaSessionRequest(ctx, udid, http.MethodPost, "/wda/keys", gin.H{"value": []string{text}}, nil)
+}
+
+// wdaPressButton presses a hardware button: home, volumeUp or volumeDown.
+func (s *Server) wdaPressButton(ctx context.Context, udid, name string) error {
+	return s.wdaSessionRequest(ctx, udid, http.MethodPost, "/wda/pressButton", gin.H{"name": name}, nil)
+}
+
+// wdaOrientation returns the clockwise rotation WDA screenshots of the device
+// need to be upright, 0 if it is unknown.
+func (s *Server) wdaOrientation(udid string) int {
+	var orientation string
+	if err := s.wdaRequest(context.Background(), udid, http.MethodGet, "/orientation", nil, &orientation); err != nil {
+		return 0
+	}
+	switch orientation {
+	case "LANDSCAPE":
+		return 270
+	case "UIA_DEVICE_ORIENTATION_LANDSCAPERIGHT":
+		return 90
+	case "UIA_DEVICE_ORIENTATION_PORTRAIT_UPSIDEDOWN":
+		return 180
+	}
+	return 0
 }
@@ -0,0 +1,95 @@
+// Package adbhost speaks the adb host protocol for services go-adb does not
+// expose.
+package adbhost
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const defaultAdbPort = 5037
+
+// DialDevice opens a stream to a service on the device, e.g.
+// "localabstract:scrcpy", through the adb server. go-adb only forwards tcp
+// ports, abstract sockets need the raw host protocol.
+func DialDevice(serial, service string) (net.Conn, error) {
+	conn, err := dialTransport(serial)
+	if err != nil {
+		return nil, err
+	}
+	if err := request(conn, service); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Reboot reboots the device with adbd's reboot service, mode is empty,
+// bootloader or recovery. adbd may drop the connection before it answers,
+// which counts as success.
+func Reboot(serial, mode string) error {
+	conn, err := dialTransport(serial)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := request(conn, "reboot:"+mode); err != nil {
+		if disconnected(err) {
+			return nil
+		}
+		return err
+	}
+	// adbd 在重启时关闭连接
+	if _, err := io.Copy(io.Discard, conn); err != nil && !disconnected(err) {
+		return err
+	}
+	return nil
+}
+
+func dialTransport(serial string) (net.Conn, error) {
+	port := defaultAdbPort
+	if value, err := strconv.Atoi(os.Getenv("ANDROID_ADB_SERVER_PORT")); err == nil {
+		port = value
+	}
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if err := request(conn, "host:transport:"+serial); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func disconnected(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// request sends a length prefixed request and reads OKAY or FAIL.
+func request(conn net.Conn, request string) error {
+	if _, err := fmt.Fprintf(conn, "%04x%s", len(request), request); err != nil {
+		return err
+	}
+	status := make([]byte, 4)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return err
+	}
+	if string(status) == "OKAY" {
+		return nil
+	}
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return fmt.Errorf("adb: %s", status)
+	}
+	n, _ := strconv.ParseUint(string(length), 16, 32)
+	msg := make([]byte, n)
+	io.ReadFull(conn, msg)
+	return fmt.Errorf("adb: %s %s", status, msg)
+}
@@ -0,0 +1,82 @@
+package imageutil
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// DiffResult is the outcome of comparing two images, ignored pixels count
+// neither as mismatched nor towards Total.
+type DiffResult struct {
+	Mismatched int
+	Total      int
+	Percent    float64
+	Diff       *image.RGBA
+}
+
+// Diff compares actual against baseline pixel by pixel. A pixel mismatches
+// when one of its channels differs by more than tolerance (0-255). actual is
+// scaled to the size of baseline when both have the same aspect ratio, e.g.
+// when the baseline was taken as a thumbnail. The diff image shows the
+// baseline faded, mismatches in red and ignored regions in blue.
+func Diff(baseline, actual image.Image, tolerance int, ignore []image.Rectangle) (DiffResult, error) {
+	base := toRGBA(baseline)
+	bw, bh := base.Rect.Dx(), base.Rect.Dy()
+	ab := actual.Bounds()
+	if ab.Dx() != bw || ab.Dy() != bh {
+		if math.Abs(float64(ab.Dx())/float64(ab.Dy())-float64(bw)/float64(bh)) > 0.01 {
+			return DiffResult{}, fmt.Errorf("image size %dx%d does not match baseline %dx%d", ab.Dx(), ab.Dy(), bw, bh)
+		}
+		actual = Resize(actual, bw, bh)
+	}
+	act := toRGBA(actual)
+
+	ignored := make([]bool, bw*bh)
+	for _, rect := range ignore {
+		rect = rect.Intersect(base.Rect)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				ignored[y*bw+x] = true
+			}
+		}
+	}
+
+	result := DiffResult{Diff: image.NewRGBA(base.Rect)}
+	for y := 0; y < bh; y++ {
+		for x := 0; x < bw; x++ {
+			i := y*base.Stride + x*4
+			j := y*act.Stride + x*4
+			d := y*result.Diff.Stride + x*4
+			px := result.Diff.Pix[d : d+4]
+			if ignored[y*bw+x] {
+				px[0], px[1], px[2], px[3] = 0x40, 0x60, 0xc0, 0xff
+				continue
+			}
+			result.Total++
+			delta := 0
+			for c := 0; c < 3; c++ {
+				delta = max(delta, absDiff(base.Pix[i+c], act.Pix[j+c]))
+			}
+			if delta > tolerance {
+				result.Mismatched++
+				px[0], px[1], px[2], px[3] = 0xff, 0, 0, 0xff
+				continue
+			}
+			// 未变化的像素淡化为灰度
+			gray := uint8((int(base.Pix[i])*299+int(base.Pix[i+1])*587+int(base.Pix[i+2])*114)/1000/4 + 0xbf)
+			px[0], px[1], px[2], px[3] = gray, gray, gray, 0xff
+		}
+	}
+	if result.Total > 0 {
+		result.Percent = float64(result.Mismatched) * 100 / float64(result.Total)
+	}
+	return result, nil
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
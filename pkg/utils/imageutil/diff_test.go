@@ -0,0 +1,93 @@
+package imageutil
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// testImage 返回 w x h 的灰色图片，marks 中的像素为白色
+func testImage(w, h int, marks ...image.Point) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{0x80, 0x80, 0x80, 0xff})
+		}
+	}
+	for _, p := range marks {
+		img.Set(p.X, p.Y, color.White)
+	}
+	return img
+}
+
+func TestDiff(t *testing.T) {
+	tinted := testImage(10, 10)
+	tinted.Set(5, 5, color.RGBA{0x80, 0x80, 0x90, 0xff})
+	tests := []struct {
+		name       string
+		actual     image.Image
+		tolerance  int
+		ignore     []image.Rectangle
+		mismatched int
+		total      int
+		percent    float64
+	}{
+		{"identical", testImage(10, 10), 0, nil, 0, 100, 0},
+		{"mismatches", testImage(10, 10, image.Pt(1, 1), image.Pt(9, 9)), 16, nil, 2, 100, 2},
+		{"within tolerance", tinted, 16, nil, 0, 100, 0},
+		{"tolerance is exclusive", tinted, 15, nil, 1, 100, 1},
+		{"one channel is enough", tinted, 0, nil, 1, 100, 1},
+		{"ignored region", testImage(10, 10, image.Pt(1, 1), image.Pt(9, 9)), 0, []image.Rectangle{image.Rect(0, 0, 5, 2)}, 1, 90, 1.0 / 90 * 100},
+		{"overlapping regions", testImage(10, 10), 0, []image.Rectangle{image.Rect(0, 0, 5, 5), image.Rect(2, 2, 7, 7)}, 0, 59, 0},
+		{"region clipped to the image", testImage(10, 10, image.Pt(9, 9)), 0, []image.Rectangle{image.Rect(8, 8, 20, 20)}, 0, 96, 0},
+		{"region outside the image", testImage(10, 10, image.Pt(9, 9)), 0, []image.Rectangle{image.Rect(-5, -5, 0, 0)}, 1, 100, 1},
+		{"everything ignored", testImage(10, 10, image.Pt(9, 9)), 0, []image.Rectangle{image.Rect(0, 0, 10, 10)}, 0, 0, 0},
+		{"actual scaled to the baseline", testImage(20, 20), 0, nil, 0, 100, 0},
+		{"actual not at the origin", testImage(12, 12, image.Pt(0, 0)).SubImage(image.Rect(1, 1, 11, 11)), 0, nil, 0, 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Diff(testImage(10, 10), tt.actual, tt.tolerance, tt.ignore)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Mismatched != tt.mismatched || result.Total != tt.total || result.Percent != tt.percent {
+				t.Errorf("Diff = %d of %d (%v%%), want %d of %d (%v%%)",
+					result.Mismatched, result.Total, result.Percent, tt.mismatched, tt.total, tt.percent)
+			}
+			if result.Diff.Bounds() != image.Rect(0, 0, 10, 10) {
+				t.Errorf("diff image has bounds %v", result.Diff.Bounds())
+			}
+		})
+	}
+}
+
+func TestDiffImage(t *testing.T) {
+	actual := testImage(4, 4, image.Pt(1, 1), image.Pt(3, 3))
+	result, err := Diff(testImage(4, 4), actual, 0, []image.Rectangle{image.Rect(3, 3, 4, 4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		x, y int
+		want color.RGBA
+	}{
+		{"mismatch in red", 1, 1, color.RGBA{0xff, 0, 0, 0xff}},
+		{"ignored in blue", 3, 3, color.RGBA{0x40, 0x60, 0xc0, 0xff}},
+		{"unchanged faded", 0, 0, color.RGBA{0xdf, 0xdf, 0xdf, 0xff}},
+	}
+	for _, tt := range tests {
+		if got := result.Diff.RGBAAt(tt.x, tt.y); got != tt.want {
+			t.Errorf("%s: pixel %d,%d = %v, want %v", tt.name, tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestDiffSizeMismatch(t *testing.T) {
+	_, err := Diff(testImage(10, 10), testImage(10, 20), 0, nil)
+	if err == nil || !strings.Contains(err.Error(), "does not match baseline") {
+		t.Errorf("Diff of different aspect ratios = %v", err)
+	}
+}
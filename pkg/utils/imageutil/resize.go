@@ -0,0 +1,79 @@
+package imageutil
+
+import (
+	"image"
+	"image/draw"
+)
+
+// FitSize returns the size of a w x h image scaled down to fit into
+// maxWidth x maxHeight keeping the aspect ratio, 0 means no limit. Images are
+// never scaled up.
+func FitSize(w, h, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && w > maxWidth {
+		scale = float64(maxWidth) / float64(w)
+	}
+	if maxHeight > 0 && h > maxHeight && float64(maxHeight)/float64(h) < scale {
+		scale = float64(maxHeight) / float64(h)
+	}
+	if scale >= 1 {
+		return w, h
+	}
+	return max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))
+}
+
+// Fit scales img down so that its longer side is at most maxSize.
+func Fit(img image.Image, maxSize int) image.Image {
+	b := img.Bounds()
+	w, h := FitSize(b.Dx(), b.Dy(), maxSize, maxSize)
+	if w == b.Dx() && h == b.Dy() {
+		return img
+	}
+	return Resize(img, w, h)
+}
+
+// Resize scales img to w x h by averaging the source pixels covered by every
+// target pixel, which is good enough for screenshots and fast in pure Go.
+func Resize(img image.Image, w, h int) *image.RGBA {
+	src := toRGBA(img)
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := max(y0+1, (y+1)*sh/h)
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := max(x0+1, (x+1)*sw/w)
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := sy*src.Stride + x0*4
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					b += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			j := y*dst.Stride + x*4
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// toRGBA returns img as *image.RGBA with its origin at 0,0.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
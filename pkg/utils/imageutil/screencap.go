@@ -0,0 +1,45 @@
+package imageutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+)
+
+// Android PixelFormat values written by screencap
+const (
+	pixelFormatRGBA8888 = 1
+	pixelFormatRGBX8888 = 2
+)
+
+// DecodeScreencap decodes the raw output of `screencap` without -p, which is
+// much faster to produce than PNG. The header is width, height and format,
+// followed by a color space field since Android 9.
+func DecodeScreencap(raw []byte) (*image.RGBA, error) {
+	if len(raw) < 12 {
+		return nil, fmt.Errorf("screencap: short output of %d bytes", len(raw))
+	}
+	w := int(binary.LittleEndian.Uint32(raw[0:4]))
+	h := int(binary.LittleEndian.Uint32(raw[4:8]))
+	format := binary.LittleEndian.Uint32(raw[8:12])
+	if format != pixelFormatRGBA8888 && format != pixelFormatRGBX8888 {
+		return nil, fmt.Errorf("screencap: unsupported pixel format %d", format)
+	}
+	size := w * h * 4
+	var pix []byte
+	switch {
+	case len(raw) >= 16+size && len(raw)-size == 16:
+		pix = raw[16 : 16+size]
+	case len(raw) >= 12+size:
+		pix = raw[12 : 12+size]
+	default:
+		return nil, fmt.Errorf("screencap: expected %d pixel bytes, got %d", size, len(raw)-12)
+	}
+	img := &image.RGBA{Pix: pix, Stride: w * 4, Rect: image.Rect(0, 0, w, h)}
+	if format == pixelFormatRGBX8888 {
+		for i := 3; i < len(pix); i += 4 {
+			pix[i] = 0xff
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,59 @@
+package imageutil
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// Rotate turns img clockwise by degrees, which must be a multiple of 90.
+func Rotate(img image.Image, degrees int) image.Image {
+	degrees = ((degrees % 360) + 360) % 360
+	if degrees == 0 {
+		return img
+	}
+	src := toRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := h, w
+	if degrees == 180 {
+		dw, dh = w, h
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch degrees {
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			case 270:
+				dx, dy = y, w-1-x
+			}
+			si := y*src.Stride + x*4
+			di := dy*dst.Stride + dx*4
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// Encode writes img as png or jpeg. For png quality picks the compression
+// level: below 30 favours speed, above 80 size.
+func Encode(w io.Writer, img image.Image, format string, quality int) error {
+	switch format {
+	case "jpeg", "jpg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "png":
+		encoder := png.Encoder{CompressionLevel: png.DefaultCompression}
+		if quality < 30 {
+			encoder.CompressionLevel = png.BestSpeed
+		} else if quality > 80 {
+			encoder.CompressionLevel = png.BestCompression
+		}
+		return encoder.Encode(w, img)
+	}
+	return fmt.Errorf("unsupported image format %s", format)
+}
@@ -0,0 +1,187 @@
+package mjpeg
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Frame locates a JPEG frame inside a file of concatenated frames.
+type Frame struct {
+	Offset int64
+	Size   int
+}
+
+const (
+	avifHasIndex   = 0x10
+	aviifKeyframe  = 0x10
+	avihSize       = 56
+	strhSize       = 56
+	strfSize       = 40
+	idxEntrySize   = 16
+	chunkHeaderLen = 8
+)
+
+// ErrAVITooLarge is returned for frames that do not fit into an AVI of 4 GiB,
+// the limit of the 32 bit RIFF sizes without OpenDML extensions.
+var ErrAVITooLarge = errors.New("mjpeg: frames exceed the 4 GiB limit of AVI")
+
+// WriteAVI writes the frames read from src as an MJPEG AVI. All sizes are
+// known in advance, so the container is written in one pass without seeking.
+func WriteAVI(w io.Writer, src io.ReaderAt, frames []Frame, width, height int, fps float64) error {
+	if len(frames) == 0 {
+		return errors.New("mjpeg: no frames")
+	}
+	if fps <= 0 {
+		fps = 1
+	}
+
+	var moviSize int64 = 4
+	maxFrame := 0
+	for _, frame := range frames {
+		moviSize += chunkHeaderLen + int64(padded(frame.Size))
+		if frame.Size > maxFrame {
+			maxFrame = frame.Size
+		}
+	}
+	strlSize := 4 + chunkHeaderLen + strhSize + chunkHeaderLen + strfSize
+	hdrlSize := 4 + chunkHeaderLen + avihSize + chunkHeaderLen + strlSize
+	idxSize := int64(idxEntrySize * len(frames))
+	riffSize := 4 + chunkHeaderLen + int64(hdrlSize) + chunkHeaderLen + moviSize + chunkHeaderLen + idxSize
+	// 索引中的偏移量同样是 32 位，整个文件都要小于 4 GiB
+	if chunkHeaderLen+riffSize > math.MaxUint32 {
+		return ErrAVITooLarge
+	}
+
+	usPerFrame := uint32(math.Round(1e6 / fps))
+	rate := uint32(math.Round(fps * 1000))
+	e := &encoder{w: w}
+
+	e.fourcc("RIFF")
+	e.u32(uint32(riffSize))
+	e.fourcc("AVI ")
+
+	e.fourcc("LIST")
+	e.u32(uint32(hdrlSize))
+	e.fourcc("hdrl")
+
+	e.fourcc("avih")
+	e.u32(avihSize)
+	e.u32(usPerFrame)
+	e.u32(uint32(float64(maxFrame) * fps))
+	e.u32(0)
+	e.u32(avifHasIndex)
+	e.u32(uint32(len(frames)))
+	e.u32(0)
+	e.u32(1)
+	e.u32(uint32(maxFrame))
+	e.u32(uint32(width))
+	e.u32(uint32(height))
+	e.u32(0)
+	e.u32(0)
+	e.u32(0)
+	e.u32(0)
+
+	e.fourcc("LIST")
+	e.u32(uint32(strlSize))
+	e.fourcc("strl")
+
+	e.fourcc("strh")
+	e.u32(strhSize)
+	e.fourcc("vids")
+	e.fourcc("MJPG")
+	e.u32(0)
+	e.u16(0)
+	e.u16(0)
+	e.u32(0)
+	e.u32(1000)
+	e.u32(rate)
+	e.u32(0)
+	e.u32(uint32(len(frames)))
+	e.u32(uint32(maxFrame))
+	e.u32(math.MaxUint32)
+	e.u32(0)
+	e.u16(0)
+	e.u16(0)
+	e.u16(uint16(width))
+	e.u16(uint16(height))
+
+	e.fourcc("strf")
+	e.u32(strfSize)
+	e.u32(strfSize)
+	e.u32(uint32(width))
+	e.u32(uint32(height))
+	e.u16(1)
+	e.u16(24)
+	e.fourcc("MJPG")
+	e.u32(uint32(width * height * 3))
+	e.u32(0)
+	e.u32(0)
+	e.u32(0)
+	e.u32(0)
+
+	e.fourcc("LIST")
+	e.u32(uint32(moviSize))
+	e.fourcc("movi")
+	buf := make([]byte, maxFrame+1)
+	for _, frame := range frames {
+		data := buf[:padded(frame.Size)]
+		if e.err == nil {
+			if _, err := src.ReadAt(data[:frame.Size], frame.Offset); err != nil {
+				return err
+			}
+		}
+		if len(data) > frame.Size {
+			data[frame.Size] = 0
+		}
+		e.fourcc("00dc")
+		e.u32(uint32(frame.Size))
+		e.write(data)
+	}
+
+	// idx1 中的偏移量相对于 movi 标记
+	e.fourcc("idx1")
+	e.u32(uint32(idxSize))
+	offset := 4
+	for _, frame := range frames {
+		e.fourcc("00dc")
+		e.u32(aviifKeyframe)
+		e.u32(uint32(offset))
+		e.u32(uint32(frame.Size))
+		offset += chunkHeaderLen + padded(frame.Size)
+	}
+	return e.err
+}
+
+// padded rounds size up to the 2 byte alignment of RIFF chunks.
+func padded(size int) int {
+	return size + size%2
+}
+
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *encoder) fourcc(s string) {
+	e.write([]byte(s))
+}
+
+func (e *encoder) u32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.write(b[:])
+}
+
+func (e *encoder) u16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	e.write(b[:])
+}
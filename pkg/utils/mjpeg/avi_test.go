@@ -0,0 +1,151 @@
+package mjpeg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// chunk is a RIFF chunk, list is the form type of RIFF and LIST chunks.
+type chunk struct {
+	id     string
+	list   string
+	offset int // 数据在文件中的位置
+	data   []byte
+}
+
+// chunks splits data into RIFF chunks, starting at offset in the file.
+func chunks(t *testing.T, data []byte, offset int) []chunk {
+	t.Helper()
+	var result []chunk
+	for pos := 0; pos < len(data); {
+		if pos+chunkHeaderLen > len(data) {
+			t.Fatalf("truncated chunk header at %d", offset+pos)
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		start := pos + chunkHeaderLen
+		if start+size > len(data) {
+			t.Fatalf("chunk %q at %d overflows its parent", data[pos:pos+4], offset+pos)
+		}
+		c := chunk{id: string(data[pos : pos+4]), offset: offset + start, data: data[start : start+size]}
+		if c.id == "RIFF" || c.id == "LIST" {
+			c.list = string(c.data[:4])
+		}
+		result = append(result, c)
+		pos = start + padded(size)
+	}
+	return result
+}
+
+func find(t *testing.T, list []chunk, id string) chunk {
+	t.Helper()
+	for _, c := range list {
+		if c.id == id || (c.list != "" && c.list == id) {
+			return c
+		}
+	}
+	t.Fatalf("no %s chunk", id)
+	return chunk{}
+}
+
+func TestWriteAVI(t *testing.T) {
+	tests := []struct {
+		name       string
+		sizes      []int
+		fps        float64
+		usPerFrame uint32
+	}{
+		{"single frame", []int{4}, 10, 100000},
+		{"odd sizes are padded", []int{3, 6, 5, 1}, 25, 40000},
+		{"fps defaults to 1", []int{2, 2}, 0, 1000000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var src []byte
+			var frames []Frame
+			for i, size := range tt.sizes {
+				frames = append(frames, Frame{Offset: int64(len(src)), Size: size})
+				src = append(src, bytes.Repeat([]byte{byte('a' + i)}, size)...)
+			}
+			var out bytes.Buffer
+			if err := WriteAVI(&out, bytes.NewReader(src), frames, 390, 844, tt.fps); err != nil {
+				t.Fatal(err)
+			}
+			file := out.Bytes()
+
+			top := chunks(t, file, 0)
+			if len(top) != 1 || top[0].id != "RIFF" || top[0].list != "AVI " {
+				t.Fatalf("file is not a single RIFF AVI chunk: %+v", top)
+			}
+			if got := len(top[0].data) + chunkHeaderLen; got != len(file) {
+				t.Fatalf("RIFF size covers %d bytes, the file has %d", got, len(file))
+			}
+			riff := chunks(t, top[0].data[4:], top[0].offset+4)
+
+			hdrl := find(t, riff, "hdrl")
+			avih := find(t, chunks(t, hdrl.data[4:], hdrl.offset+4), "avih").data
+			if got := binary.LittleEndian.Uint32(avih[0:]); got != tt.usPerFrame {
+				t.Errorf("microseconds per frame = %d, want %d", got, tt.usPerFrame)
+			}
+			if got := binary.LittleEndian.Uint32(avih[16:]); got != uint32(len(frames)) {
+				t.Errorf("total frames = %d, want %d", got, len(frames))
+			}
+			if w, h := binary.LittleEndian.Uint32(avih[32:]), binary.LittleEndian.Uint32(avih[36:]); w != 390 || h != 844 {
+				t.Errorf("size = %dx%d, want 390x844", w, h)
+			}
+
+			movi := find(t, riff, "movi")
+			data := chunks(t, movi.data[4:], movi.offset+4)
+			if len(data) != len(frames) {
+				t.Fatalf("movi has %d chunks, want %d", len(data), len(frames))
+			}
+			for i, c := range data {
+				want := src[frames[i].Offset : frames[i].Offset+int64(frames[i].Size)]
+				if c.id != "00dc" || !bytes.Equal(c.data, want) {
+					t.Errorf("frame %d = %s %q, want 00dc %q", i, c.id, c.data, want)
+				}
+			}
+
+			idx := find(t, riff, "idx1").data
+			if len(idx) != idxEntrySize*len(frames) {
+				t.Fatalf("idx1 has %d bytes, want %d", len(idx), idxEntrySize*len(frames))
+			}
+			for i := range frames {
+				entry := idx[i*idxEntrySize:]
+				offset := int(binary.LittleEndian.Uint32(entry[8:]))
+				size := int(binary.LittleEndian.Uint32(entry[12:]))
+				// 偏移量从 movi 标记算起，指向块的头部
+				if pos := movi.offset + offset; pos != data[i].offset-chunkHeaderLen {
+					t.Errorf("index %d points to %d, frame chunk is at %d", i, pos, data[i].offset-chunkHeaderLen)
+				}
+				if size != frames[i].Size || binary.LittleEndian.Uint32(entry[4:]) != aviifKeyframe {
+					t.Errorf("index %d = size %d flags %x, want size %d keyframe", i, size, entry[4:8], frames[i].Size)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteAVIErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []Frame
+		want   error
+	}{
+		{"no frames", nil, nil},
+		{"too large", []Frame{{Size: 2 << 30}, {Offset: 2 << 30, Size: 2 << 30}}, ErrAVITooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := WriteAVI(&out, bytes.NewReader(nil), tt.frames, 390, 844, 10)
+			if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+				t.Fatalf("WriteAVI = %v, want %v", err, tt.want)
+			}
+			if out.Len() != 0 {
+				t.Errorf("WriteAVI wrote %d bytes before failing", out.Len())
+			}
+		})
+	}
+}
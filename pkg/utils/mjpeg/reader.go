@@ -0,0 +1,81 @@
+package mjpeg
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxFrameSize guards against a broken Content-Length header
+const maxFrameSize = 32 << 20
+
+var errFrameTooLarge = errors.New("mjpeg: frame too large")
+
+// Reader reads JPEG frames from a multipart/x-mixed-replace stream. It does not
+// rely on the boundary declared in the Content-Type header because WDA
+// declares "--BoundaryString" but separates parts with that same string.
+type Reader struct {
+	br *bufio.Reader
+	tp *textproto.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	br := bufio.NewReaderSize(r, 64<<10)
+	return &Reader{br: br, tp: textproto.NewReader(br)}
+}
+
+// ReadFrame returns the next JPEG frame of the stream.
+func (r *Reader) ReadFrame() ([]byte, error) {
+	// 跳过空行，直到遇到分隔线
+	for {
+		line, err := r.br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "--") {
+			break
+		}
+	}
+	header, err := r.tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return r.readUntilEOI()
+	}
+	if length > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r.br, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// readUntilEOI reads a frame without Content-Length up to the JPEG end marker.
+func (r *Reader) readUntilEOI() ([]byte, error) {
+	var frame bytes.Buffer
+	for {
+		chunk, err := r.br.ReadSlice(0xD9)
+		frame.Write(chunk)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if frame.Len() > maxFrameSize {
+			return nil, errFrameTooLarge
+		}
+		if b := frame.Bytes(); err == nil && len(b) >= 2 && b[len(b)-2] == 0xFF {
+			return b, nil
+		}
+	}
+}
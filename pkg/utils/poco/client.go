@@ -1,28 +1,146 @@
 package poco
 
-import "github.com/google/uuid"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
 
 type PocoClient struct {
 	conn PocoConnection
 	port int
 }
 
-func NewPocoClient(port int) *PocoClient {
+func NewPocoClient(port int, options Options) *PocoClient {
 	return &PocoClient{
-		conn: NewSocketClient(port),
+		conn: NewSocketClient(port, options),
 		port: port,
 	}
 }
 
-func (p *PocoClient) Dump() (string, error) {
-	if !p.conn.Connected() {
-		p.conn.Connect()
+// Call invokes the method of the SDK and decodes its result into result
+// unless that is nil. Errors sent by the SDK are returned as *RPCError.
+func (p *PocoClient) Call(method string, result interface{}, params ...interface{}) error {
+	resp, err := p.send(NewRequest(method, params...))
+	if err != nil {
+		return err
 	}
-	jsonObject := map[string]interface{}{
-		"jsonrpc": "2.0",
-		"params":  []interface{}{true},
-		"id":      uuid.New().String(),
-		"method":  "Dump",
+	if resp.Error != nil {
+		return resp.Error
 	}
-	return p.conn.SendAndReceive(jsonObject)
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("poco %s: unexpected result %s: %w", method, resp.Result, err)
+	}
+	return nil
+}
+
+// send connects if needed and sends the request. A broken connection, e.g.
+// after the game restarted, is reconnected and the request sent once more,
+// timeouts are not retried as the SDK is likely hung.
+func (p *PocoClient) send(req *Request) (*Response, error) {
+	if err := p.conn.Connect(); err != nil {
+		return nil, err
+	}
+	resp, err := p.conn.SendAndReceive(req)
+	if err != nil && isBrokenConnection(err) {
+		p.conn.Disconnect()
+		if err := p.conn.Connect(); err != nil {
+			return nil, err
+		}
+		resp, err = p.conn.SendAndReceive(req)
+	}
+	return resp, err
+}
+
+// Dump returns the UI hierarchy, with onlyVisible invisible nodes are left out.
+func (p *PocoClient) Dump(onlyVisible bool) (json.RawMessage, error) {
+	var dump json.RawMessage
+	if err := p.Call("Dump", &dump, onlyVisible); err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// DumpTree returns the UI hierarchy as nodes.
+func (p *PocoClient) DumpTree(onlyVisible bool) (*Node, error) {
+	dump, err := p.Dump(onlyVisible)
+	if err != nil {
+		return nil, err
+	}
+	var root Node
+	if err := json.Unmarshal(dump, &root); err != nil {
+		return nil, fmt.Errorf("poco Dump: unexpected result: %w", err)
+	}
+	return &root, nil
+}
+
+// GetSDKVersion returns the version of the SDK, a number or a string
+// depending on the engine.
+func (p *PocoClient) GetSDKVersion() (string, error) {
+	var version json.RawMessage
+	if err := p.Call("GetSDKVersion", &version); err != nil {
+		return "", err
+	}
+	var s string
+	if err := json.Unmarshal(version, &s); err == nil {
+		return s, nil
+	}
+	return strings.TrimSpace(string(version)), nil
+}
+
+// GetScreenSize returns the size of the game screen in pixels.
+func (p *PocoClient) GetScreenSize() (width, height float64, err error) {
+	var size []float64
+	if err := p.Call("GetScreenSize", &size); err != nil {
+		return 0, 0, err
+	}
+	if len(size) < 2 {
+		return 0, 0, fmt.Errorf("poco GetScreenSize: unexpected result %v", size)
+	}
+	return size[0], size[1], nil
+}
+
+// Click taps at normalized coordinates.
+func (p *PocoClient) Click(x, y float64) error {
+	return p.Call("Click", nil, x, y)
+}
+
+// Swipe swipes between normalized coordinates, duration is in seconds.
+func (p *PocoClient) Swipe(x1, y1, x2, y2, duration float64) error {
+	return p.Call("Swipe", nil, x1, y1, x2, y2, duration)
+}
+
+// LongClick presses at normalized coordinates for duration seconds.
+func (p *PocoClient) LongClick(x, y, duration float64) error {
+	return p.Call("LongClick", nil, x, y, duration)
+}
+
+// SetText sets the text of the input node with the instance id of the dump.
+func (p *PocoClient) SetText(instanceID interface{}, text string) error {
+	var ok interface{}
+	if err := p.Call("SetText", &ok, instanceID, text); err != nil {
+		return err
+	}
+	if ok == false {
+		return fmt.Errorf("poco SetText: node %v does not take text", instanceID)
+	}
+	return nil
+}
+
+// GetDebugProfilingData returns the time the SDK spent on dumping and
+// serializing the last hierarchy.
+func (p *PocoClient) GetDebugProfilingData() (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if err := p.Call("GetDebugProfilingData", &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Close closes the connection to the SDK.
+func (p *PocoClient) Close() {
+	p.conn.Disconnect()
 }
@@ -0,0 +1,150 @@
+package poco
+
+import (
+	"image"
+	"math"
+)
+
+// Payload 中所有来源都有的字段，其余字段取决于层级的来源
+const (
+	AttrName        = "name"
+	AttrType        = "type"
+	AttrVisible     = "visible"
+	AttrText        = "text"
+	AttrPos         = "pos"
+	AttrSize        = "size"
+	AttrAnchorPoint = "anchorPoint"
+	AttrZOrders     = "zOrders"
+	AttrRect        = "rect"
+)
+
+// Node is an element of a UI hierarchy in the layout of Poco's Dump, the
+// hierarchies of uiautomator and WDA are converted to it so clients can
+// handle all of them alike.
+type Node struct {
+	Name     string                 `json:"name"`
+	Payload  map[string]interface{} `json:"payload"`
+	Children []*Node                `json:"children,omitempty"`
+}
+
+// Rect is the bounding box of a node in screen pixels.
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Frame is the bounding box of a node normalized to the screen.
+type Frame struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// Center returns the normalized center of the frame.
+func (f Frame) Center() (x, y float64) {
+	return f.X + f.Width/2, f.Y + f.Height/2
+}
+
+// Scale returns the frame in pixels of a screen of the given size.
+func (f Frame) Scale(width, height float64) Rect {
+	return Rect{
+		X:      int(math.Round(f.X * width)),
+		Y:      int(math.Round(f.Y * height)),
+		Width:  int(math.Round(f.Width * width)),
+		Height: int(math.Round(f.Height * height)),
+	}
+}
+
+// NewNode returns a visible node covering bounds of a screen of the given
+// size in pixels.
+func NewNode(name, typ string, bounds image.Rectangle, screen image.Point) *Node {
+	node := &Node{
+		Name: name,
+		Payload: map[string]interface{}{
+			AttrName:    name,
+			AttrType:    typ,
+			AttrVisible: true,
+		},
+	}
+	node.SetBounds(bounds, screen)
+	return node
+}
+
+// SetBounds sets the pixel rect and, normalized to the screen like in Poco
+// dumps, pos (the center), size and anchorPoint of the node.
+func (n *Node) SetBounds(bounds image.Rectangle, screen image.Point) {
+	w, h := float64(max(screen.X, 1)), float64(max(screen.Y, 1))
+	n.Payload[AttrPos] = []float64{
+		(float64(bounds.Min.X) + float64(bounds.Dx())/2) / w,
+		(float64(bounds.Min.Y) + float64(bounds.Dy())/2) / h,
+	}
+	n.Payload[AttrSize] = []float64{float64(bounds.Dx()) / w, float64(bounds.Dy()) / h}
+	n.Payload[AttrAnchorPoint] = []float64{0.5, 0.5}
+	n.Payload[AttrRect] = Rect{X: bounds.Min.X, Y: bounds.Min.Y, Width: bounds.Dx(), Height: bounds.Dy()}
+}
+
+// Type returns the type of the node, its name if the payload has none.
+func (n *Node) Type() string {
+	if typ, ok := n.Payload[AttrType].(string); ok && typ != "" {
+		return typ
+	}
+	return n.Name
+}
+
+// Frame returns the normalized bounding box from pos, size and anchorPoint,
+// ok is false if the node has no position. Engines such as Unity anchor
+// nodes elsewhere than at their center.
+func (n *Node) Frame() (frame Frame, ok bool) {
+	pos, ok := floatPair(n.Payload[AttrPos])
+	if !ok {
+		return Frame{}, false
+	}
+	size, _ := floatPair(n.Payload[AttrSize])
+	anchor, ok := floatPair(n.Payload[AttrAnchorPoint])
+	if !ok {
+		anchor = [2]float64{0.5, 0.5}
+	}
+	return Frame{
+		X:      pos[0] - size[0]*anchor[0],
+		Y:      pos[1] - size[1]*anchor[1],
+		Width:  size[0],
+		Height: size[1],
+	}, true
+}
+
+// Walk calls fn for the node and its descendants in document order, the
+// descendants of a node are skipped when fn returns false for it.
+func (n *Node) Walk(fn func(node *Node) bool) {
+	if !fn(n) {
+		return
+	}
+	for _, child := range n.Children {
+		child.Walk(fn)
+	}
+}
+
+// Leaf returns a copy of the node without its children.
+func (n *Node) Leaf() *Node {
+	return &Node{Name: n.Name, Payload: n.Payload}
+}
+
+// floatPair reads a [x, y] payload value, decoded from JSON or set by
+// SetBounds.
+func floatPair(value interface{}) ([2]float64, bool) {
+	switch v := value.(type) {
+	case []float64:
+		if len(v) >= 2 {
+			return [2]float64{v[0], v[1]}, true
+		}
+	case []interface{}:
+		if len(v) >= 2 {
+			x, okX := v[0].(float64)
+			y, okY := v[1].(float64)
+			return [2]float64{x, y}, okX && okY
+		}
+	}
+	return [2]float64{}, false
+}
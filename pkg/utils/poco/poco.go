@@ -1,115 +1,175 @@
 package poco
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 )
 
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultReadTimeout    = 30 * time.Second
+
+	connectRetryInterval = 500 * time.Millisecond
+	dialTimeout          = 2 * time.Second
+	minDialTimeout       = 100 * time.Millisecond
+	// maxFrameSize 限制响应大小，大的层级树也远小于它
+	maxFrameSize = 64 << 20
+)
+
+var (
+	ErrNotConnected  = errors.New("poco socket is not connected")
+	ErrConnectFailed = errors.New("could not connect to the poco sdk")
+	ErrTimeout       = errors.New("poco sdk did not answer in time")
+	// ErrFrameTooLarge means the length header is garbage, the stream is out
+	// of sync and the connection has to be re-established.
+	ErrFrameTooLarge = errors.New("poco response is too large")
+)
+
+// Options 连接参数，零值使用默认值
+type Options struct {
+	// ConnectTimeout 是建立连接的总时长，期间不断重试
+	ConnectTimeout time.Duration
+	// ReadTimeout 是一次调用等待响应的时长
+	ReadTimeout time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.ConnectTimeout <= 0 {
+		o.ConnectTimeout = DefaultConnectTimeout
+	}
+	if o.ReadTimeout <= 0 {
+		o.ReadTimeout = DefaultReadTimeout
+	}
+	return o
+}
+
 // PocoConnection 定义 Poco 连接接口
 type PocoConnection interface {
-	Connect()
+	Connect() error
 	Connected() bool
 	Disconnect()
-	SendAndReceive(jsonObject map[string]interface{}) (string, error)
+	SendAndReceive(req *Request) (*Response, error)
 }
 
 // SocketClientImpl 实现 PocoConnection 接口
 type SocketClientImpl struct {
 	port        int
+	options     Options
 	conn        net.Conn
 	isConnected bool
 	mutex       sync.Mutex
 }
 
 // NewSocketClient 创建新的 Socket 客户端
-func NewSocketClient(port int) *SocketClientImpl {
+func NewSocketClient(port int, options Options) *SocketClientImpl {
 	return &SocketClientImpl{
-		port: port,
+		port:    port,
+		options: options.withDefaults(),
 	}
 }
 
-// SendAndReceive 发送并接收数据
-func (s *SocketClientImpl) SendAndReceive(jsonObject map[string]interface{}) (string, error) {
+// SendAndReceive 发送请求并返回 id 相同的响应，之前超时请求迟到的响应会被丢弃。
+// 读写出错或超时后连接状态未知，连接会被断开
+func (s *SocketClientImpl) SendAndReceive(req *Request) (*Response, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	if !s.isConnected {
-		return "", fmt.Errorf("socket is not connected")
+		return nil, ErrNotConnected
 	}
 
-	// 将 JSON 对象转换为字节数组
-	data, err := json.Marshal(jsonObject)
+	data, err := json.Marshal(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	// 创建头部（4字节长度）
-	header := make([]byte, 4)
-	binary.LittleEndian.PutUint32(header, uint32(len(data)))
-
-	// 发送数据
-	_, err = s.conn.Write(header)
+	resp, err := s.roundTrip(req.ID, data)
 	if err != nil {
-		return "", err
-	}
-	_, err = s.conn.Write(data)
-	if err != nil {
-		return "", err
+		s.conn.Close()
+		s.isConnected = false
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%w: %s after %s", ErrTimeout, req.Method, s.options.ReadTimeout)
+		}
+		return nil, err
 	}
+	return resp, nil
+}
 
-	// 读取响应头部
-	head := make([]byte, 4)
-	_, err = io.ReadFull(s.conn, head)
-	if err != nil {
-		return "", err
+func (s *SocketClientImpl) roundTrip(id string, data []byte) (*Response, error) {
+	if err := s.conn.SetDeadline(time.Now().Add(s.options.ReadTimeout)); err != nil {
+		return nil, err
 	}
 
-	// 解析响应长度
-	headLen := binary.LittleEndian.Uint32(head)
-
-	// 读取响应数据
-	rData := make([]byte, headLen)
-	_, err = io.ReadFull(s.conn, rData)
-	if err != nil {
-		return "", err
+	// 头部为 4 字节小端长度，和数据一起写入
+	frame := make([]byte, 4+len(data))
+	binary.LittleEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	if _, err := s.conn.Write(frame); err != nil {
+		return nil, err
 	}
 
-	// 处理响应
-	pocoResult := string(rData)
-	subStartIndex := bytes.Index(rData, []byte(`"result"`))
-	if subStartIndex == -1 {
-		return "", fmt.Errorf("result field not found in response")
+	for {
+		rData, err := s.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		var resp Response
+		if err := json.Unmarshal(rData, &resp); err != nil {
+			return nil, fmt.Errorf("invalid poco response: %w", err)
+		}
+		// 无法解析请求时 SDK 返回的 id 为空
+		if resp.ID == id || (resp.ID == "" && resp.Error != nil) {
+			return &resp, nil
+		}
 	}
+}
 
-	return "{" + pocoResult[subStartIndex:], nil
+// readFrame 读取一个带长度头部的响应
+func (s *SocketClientImpl) readFrame() ([]byte, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(s.conn, head); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(head)
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(s.conn, data); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
-// Connect 连接到 Poco 服务器
-func (s *SocketClientImpl) Connect() {
-	maxAttempts := 20
-	attempt := 0
+// Connect 连接到 Poco 服务器，游戏可能还在启动，ConnectTimeout 内不断重试
+func (s *SocketClientImpl) Connect() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isConnected {
+		return nil
+	}
 
-	for attempt < maxAttempts {
-		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", s.port))
+	deadline := time.Now().Add(s.options.ConnectTimeout)
+	for {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", s.port), max(min(dialTimeout, time.Until(deadline)), minDialTimeout))
 		if err == nil {
 			s.conn = conn
 			s.isConnected = true
-			// s.logger.Info("poco socket connected.")
-			return
+			return nil
 		}
-
-		// s.logger.Info(fmt.Sprintf("Connection attempt %d failed: %v", attempt+1, err))
-		time.Sleep(500 * time.Millisecond)
-		attempt++
+		if time.Until(deadline) < connectRetryInterval {
+			return fmt.Errorf("%w on port %d: %v", ErrConnectFailed, s.port, err)
+		}
+		time.Sleep(connectRetryInterval)
 	}
-
-	// s.logger.Info("poco socket connection failed after multiple attempts.")
 }
 
 func (s *SocketClientImpl) Connected() bool {
@@ -125,7 +185,18 @@ func (s *SocketClientImpl) Disconnect() {
 
 	if s.conn != nil {
 		s.conn.Close()
-		// s.logger.Info("poco socket closed.")
 		s.isConnected = false
 	}
 }
+
+// isBrokenConnection reports whether the error means the connection went
+// away, e.g. because the game restarted, so that a new one may succeed.
+func isBrokenConnection(err error) bool {
+	return errors.Is(err, ErrNotConnected) ||
+		errors.Is(err, ErrFrameTooLarge) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
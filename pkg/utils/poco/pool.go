@@ -0,0 +1,134 @@
+package poco
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultIdleTimeout = 5 * time.Minute
+
+// Pool keeps one client per device and SDK port so that calls reuse the
+// connection. Clients unused for longer than the idle timeout are closed.
+type Pool struct {
+	options     Options
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	clients map[poolKey]*pooledClient
+	stop    chan struct{}
+	stopped bool
+}
+
+type poolKey struct {
+	device string
+	port   int
+}
+
+type pooledClient struct {
+	client   *PocoClient
+	hostPort int
+	inUse    int
+	lastUsed time.Time
+}
+
+// NewPool returns a pool whose clients use options, idleTimeout <= 0 keeps
+// clients until their device goes away.
+func NewPool(options Options, idleTimeout time.Duration) *Pool {
+	p := &Pool{
+		options:     options,
+		idleTimeout: idleTimeout,
+		clients:     make(map[poolKey]*pooledClient),
+		stop:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go p.evictIdle()
+	}
+	return p
+}
+
+// Get returns the client for the SDK port of the device, reached through
+// hostPort on the host. The client must be given back by calling release
+// once the call is done, clients in use are never evicted.
+func (p *Pool) Get(device string, port, hostPort int) (client *PocoClient, release func()) {
+	key := poolKey{device, port}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc, ok := p.clients[key]
+	// 端口转发重建后本地端口会变，旧连接不再可用
+	if ok && pc.hostPort != hostPort && pc.inUse == 0 {
+		pc.client.Close()
+		ok = false
+	}
+	if !ok || pc.hostPort != hostPort {
+		pc = &pooledClient{client: NewPocoClient(hostPort, p.options), hostPort: hostPort}
+		p.clients[key] = pc
+	}
+	pc.inUse++
+	pc.lastUsed = time.Now()
+
+	released := false
+	return pc.client, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if released {
+			return
+		}
+		released = true
+		pc.inUse--
+		pc.lastUsed = time.Now()
+		// 已被替换或设备已断开的客户端在最后一次使用后关闭
+		if p.clients[key] != pc && pc.inUse == 0 {
+			pc.client.Close()
+		}
+	}
+}
+
+// CloseDevice closes the idle clients of the device and drops all of them,
+// clients still in use are closed when they are released.
+func (p *Pool) CloseDevice(device string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, pc := range p.clients {
+		if key.device != device {
+			continue
+		}
+		delete(p.clients, key)
+		if pc.inUse == 0 {
+			pc.client.Close()
+		}
+	}
+}
+
+// Close stops the eviction and closes every client.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.stop)
+	}
+	for key, pc := range p.clients {
+		delete(p.clients, key)
+		pc.client.Close()
+	}
+}
+
+func (p *Pool) evictIdle() {
+	ticker := time.NewTicker(max(p.idleTimeout/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			for key, pc := range p.clients {
+				if pc.inUse == 0 && now.Sub(pc.lastUsed) > p.idleTimeout {
+					delete(p.clients, key)
+					pc.client.Close()
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package poco
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Request 是 Poco SDK 的 JSON-RPC 2.0 请求
+type Request struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	ID      string        `json:"id"`
+}
+
+// NewRequest 创建带唯一 id 的请求
+func NewRequest(method string, params ...interface{}) *Request {
+	if params == nil {
+		params = []interface{}{}
+	}
+	return &Request{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+		ID:      uuid.New().String(),
+	}
+}
+
+// Response 是 Poco SDK 的 JSON-RPC 2.0 响应，Result 和 Error 只有一个
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      string          `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// RPCError is the error of a failed call. SDKs differ in what they send, an
+// object with code and message or only a string, the object is kept in Data.
+type RPCError struct {
+	Code    int             `json:"code,omitempty"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("poco rpc error %d: %s", e.Code, e.Message)
+	}
+	return "poco rpc error: " + e.Message
+}
+
+func (e *RPCError) UnmarshalJSON(data []byte) error {
+	var message string
+	if err := json.Unmarshal(data, &message); err == nil {
+		e.Message = message
+		return nil
+	}
+	var obj struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	e.Code = obj.Code
+	e.Message = obj.Message
+	if e.Message == "" {
+		e.Message = string(data)
+	}
+	e.Data = append(json.RawMessage(nil), data...)
+	return nil
+}
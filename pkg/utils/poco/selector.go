@@ -0,0 +1,438 @@
+package poco
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Selector is a compiled Poco selector written like in the Python client,
+// e.g. poco("Panel").child("Button", text="OK")[0].offspring(textMatches="^\d+$").
+// The calls child, children, offspring, sibling and parent are supported,
+// keyword arguments match payload attributes exactly and with the Matches
+// suffix by regular expression (anchored at the start like Python's
+// re.match), a positional argument matches the name. An index picks from
+// the matches sorted top-down, left-right like Poco does, negative indexes
+// count from the end.
+type Selector struct {
+	expr  string
+	steps []selectorStep
+}
+
+type axis int
+
+const (
+	axisRoot axis = iota // poco(...)：根节点及其所有后代
+	axisChild
+	axisOffspring
+	axisSibling
+	axisParent
+)
+
+var selectorMethods = map[string]axis{
+	"child":     axisChild,
+	"children":  axisChild,
+	"offspring": axisOffspring,
+	"sibling":   axisSibling,
+	"parent":    axisParent,
+}
+
+type selectorStep struct {
+	axis       axis
+	conditions []condition
+	indexes    []int // 依次取第几个，poco("a")[1][0] 和 poco("a")[1] 相同
+}
+
+// condition matches one payload attribute, either equal to value or, if
+// pattern is set, a string matching it.
+type condition struct {
+	attr    string
+	value   interface{}
+	pattern *regexp.Regexp
+}
+
+// ParseSelector compiles the selector.
+func ParseSelector(expr string) (*Selector, error) {
+	p := &selectorParser{src: expr}
+	steps, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %w", expr, err)
+	}
+	return &Selector{expr: expr, steps: steps}, nil
+}
+
+func (s *Selector) String() string {
+	return s.expr
+}
+
+// Select returns the nodes of the tree matching the selector. With
+// onlyVisible invisible nodes and their descendants are left out, like the
+// Poco SDK does by default.
+func (s *Selector) Select(root *Node, onlyVisible bool) []*Node {
+	parents := make(map[*Node]*Node)
+	root.Walk(func(node *Node) bool {
+		for _, child := range node.Children {
+			parents[child] = node
+		}
+		return true
+	})
+	visible := func(node *Node) bool {
+		return !onlyVisible || node.Payload[AttrVisible] != false
+	}
+
+	nodes := []*Node{root}
+	for _, step := range s.steps {
+		var candidates []*Node
+		for _, node := range nodes {
+			switch step.axis {
+			case axisRoot, axisOffspring:
+				node.Walk(func(n *Node) bool {
+					if !visible(n) {
+						return false
+					}
+					if n != node || step.axis == axisRoot {
+						candidates = append(candidates, n)
+					}
+					return true
+				})
+			case axisChild:
+				candidates = append(candidates, node.Children...)
+			case axisSibling:
+				if parent := parents[node]; parent != nil {
+					for _, sibling := range parent.Children {
+						if sibling != node {
+							candidates = append(candidates, sibling)
+						}
+					}
+				}
+			case axisParent:
+				if parent := parents[node]; parent != nil {
+					candidates = append(candidates, parent)
+				}
+			}
+		}
+
+		nodes = nil
+		seen := make(map[*Node]bool)
+		for _, node := range candidates {
+			if !seen[node] && visible(node) && step.match(node) {
+				seen[node] = true
+				nodes = append(nodes, node)
+			}
+		}
+		for _, index := range step.indexes {
+			nodes = pick(nodes, index)
+		}
+	}
+	return nodes
+}
+
+// QuerySelector returns the nodes of the tree matching the selector.
+func QuerySelector(root *Node, expr string, onlyVisible bool) ([]*Node, error) {
+	selector, err := ParseSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	return selector.Select(root, onlyVisible), nil
+}
+
+func (step selectorStep) match(node *Node) bool {
+	for _, cond := range step.conditions {
+		if !cond.match(node) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c condition) match(node *Node) bool {
+	value := node.Payload[c.attr]
+	if c.attr == AttrName && value == nil {
+		value = node.Name
+	}
+	if c.pattern != nil {
+		s, ok := value.(string)
+		return ok && c.pattern.MatchString(s)
+	}
+	switch want := c.value.(type) {
+	case nil:
+		return value == nil
+	case float64:
+		got, ok := value.(float64)
+		if i, isInt := value.(int); isInt {
+			got, ok = float64(i), true
+		}
+		return ok && got == want
+	default:
+		return value == want
+	}
+}
+
+// pick returns the node at index of the nodes sorted by position, nodes
+// without one keep their order at the end.
+func pick(nodes []*Node, index int) []*Node {
+	if index < 0 {
+		index += len(nodes)
+	}
+	if index < 0 || index >= len(nodes) {
+		return nil
+	}
+	sorted := append([]*Node(nil), nodes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		fi, oki := sorted[i].Frame()
+		fj, okj := sorted[j].Frame()
+		if !oki || !okj {
+			return oki && !okj
+		}
+		xi, yi := fi.Center()
+		xj, yj := fj.Center()
+		if yi != yj {
+			return yi < yj
+		}
+		return xi < xj
+	})
+	return sorted[index : index+1]
+}
+
+type selectorParser struct {
+	src string
+	pos int
+}
+
+func (p *selectorParser) parse() ([]selectorStep, error) {
+	if p.ident() != "poco" {
+		return nil, fmt.Errorf("must start with poco(")
+	}
+	first, err := p.call(axisRoot)
+	if err != nil {
+		return nil, err
+	}
+	steps := []selectorStep{first}
+	for {
+		p.skipSpace()
+		if p.pos == len(p.src) {
+			return steps, nil
+		}
+		switch p.src[p.pos] {
+		case '.':
+			p.pos++
+			name := p.ident()
+			method, ok := selectorMethods[name]
+			if !ok {
+				return nil, fmt.Errorf("unsupported call %q at %d", name, p.pos)
+			}
+			step, err := p.call(method)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+		case '[':
+			p.pos++
+			p.skipSpace()
+			start := p.pos
+			if p.pos < len(p.src) && p.src[p.pos] == '-' {
+				p.pos++
+			}
+			for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+				p.pos++
+			}
+			index, err := strconv.Atoi(p.src[start:p.pos])
+			if err != nil {
+				return nil, fmt.Errorf("invalid index at %d", start)
+			}
+			if err := p.expect(']'); err != nil {
+				return nil, err
+			}
+			last := &steps[len(steps)-1]
+			last.indexes = append(last.indexes, index)
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", p.src[p.pos], p.pos)
+		}
+	}
+}
+
+// call parses the arguments of a call.
+func (p *selectorParser) call(axis axis) (selectorStep, error) {
+	step := selectorStep{axis: axis}
+	if err := p.expect('('); err != nil {
+		return step, err
+	}
+	p.skipSpace()
+	if p.peek(')') {
+		p.pos++
+		return step, nil
+	}
+	for {
+		p.skipSpace()
+		start := p.pos
+		name := p.ident()
+		p.skipSpace()
+		if name != "" && p.peek('=') {
+			p.pos++
+			value, err := p.value()
+			if err != nil {
+				return step, err
+			}
+			cond, err := newCondition(name, value)
+			if err != nil {
+				return step, err
+			}
+			step.conditions = append(step.conditions, cond)
+		} else {
+			// 位置参数是节点名
+			p.pos = start
+			value, err := p.value()
+			if err != nil {
+				return step, err
+			}
+			if _, ok := value.(string); !ok {
+				return step, fmt.Errorf("name at %d must be a string", start)
+			}
+			step.conditions = append(step.conditions, condition{attr: AttrName, value: value})
+		}
+		p.skipSpace()
+		if p.peek(')') {
+			p.pos++
+			break
+		}
+		if err := p.expect(','); err != nil {
+			return step, err
+		}
+	}
+	if axis == axisParent && len(step.conditions) > 0 {
+		return step, fmt.Errorf("parent() takes no arguments")
+	}
+	return step, nil
+}
+
+func newCondition(name string, value interface{}) (condition, error) {
+	attr, isPattern := strings.CutSuffix(name, "Matches")
+	if !isPattern || attr == "" {
+		return condition{attr: name, value: value}, nil
+	}
+	pattern, ok := value.(string)
+	if !ok {
+		return condition{}, fmt.Errorf("%s must be a string", name)
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")")
+	if err != nil {
+		return condition{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return condition{attr: attr, pattern: re}, nil
+}
+
+// value parses a string, number, True, False or None.
+func (p *selectorParser) value() (interface{}, error) {
+	p.skipSpace()
+	if p.pos == len(p.src) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '"' || c == '\'':
+		return p.str(false)
+	case (c == 'r' || c == 'R') && p.pos+1 < len(p.src) && (p.src[p.pos+1] == '"' || p.src[p.pos+1] == '\''):
+		p.pos++
+		return p.str(true)
+	case c == '-' || c == '.' || isDigit(c):
+		p.pos++
+		for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || strings.IndexByte(".eE+-", p.src[p.pos]) >= 0) {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number at %d", start)
+		}
+		return f, nil
+	}
+	switch word := p.ident(); word {
+	case "True", "true":
+		return true, nil
+	case "False", "false":
+		return false, nil
+	case "None", "null":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at %d", p.src[start:max(p.pos, start+1)], start)
+	}
+}
+
+// str parses a quoted string, unknown escapes are kept like Python does so
+// that patterns such as "\d+" work without a raw string.
+func (p *selectorParser) str(raw bool) (string, error) {
+	quote := p.src[p.pos]
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && p.pos < len(p.src):
+			next := p.src[p.pos]
+			p.pos++
+			switch {
+			case raw:
+				b.WriteByte(c)
+				b.WriteByte(next)
+			case next == 'n':
+				b.WriteByte('\n')
+			case next == 't':
+				b.WriteByte('\t')
+			case next == '\\' || next == '\'' || next == '"':
+				b.WriteByte(next)
+			default:
+				b.WriteByte(c)
+				b.WriteByte(next)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string at %d", start)
+}
+
+func (p *selectorParser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := rune(p.src[p.pos])
+		if c != '_' && !unicode.IsLetter(c) && !(p.pos > start && unicode.IsDigit(c)) {
+			break
+		}
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *selectorParser) peek(c byte) bool {
+	return p.pos < len(p.src) && p.src[p.pos] == c
+}
+
+func (p *selectorParser) expect(c byte) error {
+	p.skipSpace()
+	if !p.peek(c) {
+		if p.pos == len(p.src) {
+			return fmt.Errorf("expected %q at the end", c)
+		}
+		return fmt.Errorf("expected %q at %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *selectorParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
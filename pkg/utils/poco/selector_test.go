@@ -0,0 +1,142 @@
+package poco
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+// testTree 的屏幕为 1000x1000，Hidden 及其后代不可见，Floating 没有位置
+func testTree() *Node {
+	screen := image.Pt(1000, 1000)
+	node := func(name, typ, text string, bounds image.Rectangle, children ...*Node) *Node {
+		n := NewNode(name, typ, bounds, screen)
+		if text != "" {
+			n.Payload[AttrText] = text
+		}
+		n.Children = children
+		return n
+	}
+	ok := node("Button", "Button", "OK", image.Rect(600, 100, 700, 150))
+	ok.Payload["count"] = 3
+	cancel := node("Button", "Button", "Cancel", image.Rect(100, 100, 200, 150))
+	cancel.Payload["enabled"] = false
+	hidden := node("Hidden", "Node", "", image.Rect(0, 500, 1000, 900),
+		node("Button", "Button", "Secret", image.Rect(100, 600, 200, 650)))
+	hidden.Payload[AttrVisible] = false
+	floating := &Node{Name: "Floating", Payload: map[string]interface{}{AttrType: "Node"}}
+
+	return node("Root", "Layer", "", image.Rect(0, 0, 1000, 1000),
+		node("Panel", "Node", "", image.Rect(0, 0, 1000, 500),
+			ok,
+			cancel,
+			node("Label", "Text", "123", image.Rect(100, 300, 400, 350)),
+		),
+		hidden,
+		node("Footer", "Node", "", image.Rect(0, 900, 1000, 1000),
+			floating,
+			node("Label", "Text", "v1.0", image.Rect(100, 900, 200, 950)),
+		),
+	)
+}
+
+// labels returns the name of the nodes, followed by their text if any.
+func labels(nodes []*Node) []string {
+	result := []string{}
+	for _, node := range nodes {
+		label := node.Name
+		if text, _ := node.Payload[AttrText].(string); text != "" {
+			label += ":" + text
+		}
+		result = append(result, label)
+	}
+	return result
+}
+
+func TestSelect(t *testing.T) {
+	root := testTree()
+	tests := []struct {
+		name        string
+		expr        string
+		onlyVisible bool
+		want        []string
+	}{
+		{"name", `poco("Button")`, true, []string{"Button:OK", "Button:Cancel"}},
+		{"includes root", `poco("Root")`, true, []string{"Root"}},
+		{"invisible included", `poco("Button")`, false, []string{"Button:OK", "Button:Cancel", "Button:Secret"}},
+		{"invisible subtree pruned", `poco("Hidden").child()`, true, []string{}},
+		{"invisible subtree kept", `poco("Hidden").child()`, false, []string{"Button:Secret"}},
+		{"keyword", `poco(text="Cancel")`, true, []string{"Button:Cancel"}},
+		{"name and keyword", `poco('Button', type="Button", text='OK')`, true, []string{"Button:OK"}},
+		{"int payload", `poco(count=3)`, true, []string{"Button:OK"}},
+		{"bool", `poco(enabled=False)`, true, []string{"Button:Cancel"}},
+		{"none", `poco("Label", enabled=None)`, true, []string{"Label:123", "Label:v1.0"}},
+		{"matches", `poco(textMatches="\d+$")`, true, []string{"Label:123"}},
+		{"matches anchored at start", `poco(textMatches="1")`, true, []string{"Label:123"}},
+		{"matches prefix", `poco(textMatches=r"v\d")`, true, []string{"Label:v1.0"}},
+		{"name matches", `poco(nameMatches="Butt")`, true, []string{"Button:OK", "Button:Cancel"}},
+		{"child", `poco("Panel").child("Button")`, true, []string{"Button:OK", "Button:Cancel"}},
+		{"children", `poco("Panel").children()`, true, []string{"Button:OK", "Button:Cancel", "Label:123"}},
+		{"child is not offspring", `poco("Root").child("Button")`, true, []string{}},
+		{"offspring", `poco("Root").offspring("Button")`, true, []string{"Button:OK", "Button:Cancel"}},
+		{"offspring excludes self", `poco("Panel").offspring(type="Node")`, true, []string{}},
+		{"sibling", `poco(text="OK").sibling()`, true, []string{"Button:Cancel", "Label:123"}},
+		{"sibling with name", `poco(text="OK").sibling("Label")`, true, []string{"Label:123"}},
+		{"siblings deduplicated", `poco("Button").sibling()`, true, []string{"Button:Cancel", "Label:123", "Button:OK"}},
+		{"sibling of root", `poco("Root").sibling()`, true, []string{}},
+		{"parent", `poco(text="OK").parent()`, true, []string{"Panel"}},
+		{"parent deduplicated", `poco("Button").parent()`, true, []string{"Panel"}},
+		{"grandparent", `poco(text="OK").parent().parent()`, true, []string{"Root"}},
+		{"parent of root", `poco("Root").parent()`, true, []string{}},
+		{"index sorts left to right", `poco("Button")[0]`, true, []string{"Button:Cancel"}},
+		{"index sorts top down", `poco(type="Text")[0]`, true, []string{"Label:123"}},
+		{"second index", `poco("Button")[1]`, true, []string{"Button:OK"}},
+		{"negative index", `poco("Button")[-1]`, true, []string{"Button:OK"}},
+		{"index out of range", `poco("Button")[2]`, true, []string{}},
+		{"negative index out of range", `poco("Button")[-3]`, true, []string{}},
+		{"repeated index", `poco("Button")[1][0]`, true, []string{"Button:OK"}},
+		{"index then call", `poco("Button")[0].sibling("Label")`, true, []string{"Label:123"}},
+		{"without position last", `poco("Footer").child()[-1]`, true, []string{"Floating"}},
+		{"with position first", `poco("Footer").child()[0]`, true, []string{"Label:v1.0"}},
+		{"spaces", ` poco ( "Panel" ) . child ( text = "OK" ) [ 0 ] `, true, []string{"Button:OK"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := QuerySelector(root, tt.expr, tt.onlyVisible)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := labels(nodes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QuerySelector(%s) = %q, want %q", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`Button[text='OK']`,
+		`#welcome`,
+		`poco(`,
+		`poco("Button"`,
+		`poco("Button)`,
+		`poco(1)`,
+		`poco(text=)`,
+		`poco(text="OK" name="x")`,
+		`poco().click()`,
+		`poco()[x]`,
+		`poco()[0`,
+		`poco().parent("Panel")`,
+		`poco(textMatches="(")`,
+		`poco(textMatches=1)`,
+		`poco() extra`,
+	}
+	for _, expr := range tests {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := ParseSelector(expr); err == nil {
+				t.Errorf("ParseSelector(%s) succeeded", expr)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package poco
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/antchfx/xpath"
+)
+
+// QueryXPath returns the nodes of the tree matching the XPath expression in
+// document order. Elements are named by their type and the scalar payload
+// values are their attributes, a rect is split into x, y, width and height.
+func QueryXPath(root *Node, expr string) ([]*Node, error) {
+	compiled, err := xpath.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid xpath %q: %w", expr, err)
+	}
+	var nodes []*Node
+	seen := make(map[*Node]bool)
+	iter := compiled.Select(newNavigator(root))
+	for iter.MoveNext() {
+		nav, ok := iter.Current().(*navigator)
+		// 属性和文档节点不是元素，忽略
+		if !ok || nav.attr != -1 || len(nav.path) == 0 {
+			continue
+		}
+		node := nav.path[len(nav.path)-1]
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	// 反向轴如 ancestor 按离当前节点的远近返回，重新排成文档顺序
+	order := make(map[*Node]int)
+	root.Walk(func(node *Node) bool {
+		order[node] = len(order)
+		return true
+	})
+	sort.Slice(nodes, func(i, j int) bool { return order[nodes[i]] < order[nodes[j]] })
+	return nodes, nil
+}
+
+type attribute struct {
+	name, value string
+}
+
+// navigator implements xpath.NodeNavigator on a Node tree. Nodes do not
+// know their parents, so the path from the root is kept instead.
+type navigator struct {
+	root  *Node
+	path  []*Node // 从根到当前元素，为空时在文档节点上
+	index []int   // path 中每个元素在父元素 Children 中的位置
+	attrs []attribute
+	attr  int // 当前属性在 attrs 中的位置，-1 表示在元素上
+}
+
+func newNavigator(root *Node) *navigator {
+	return &navigator{root: root, attr: -1}
+}
+
+func (nav *navigator) current() *Node {
+	return nav.path[len(nav.path)-1]
+}
+
+func (nav *navigator) NodeType() xpath.NodeType {
+	switch {
+	case len(nav.path) == 0:
+		return xpath.RootNode
+	case nav.attr != -1:
+		return xpath.AttributeNode
+	}
+	return xpath.ElementNode
+}
+
+func (nav *navigator) LocalName() string {
+	switch {
+	case len(nav.path) == 0:
+		return ""
+	case nav.attr != -1:
+		return nav.attrs[nav.attr].name
+	}
+	return nav.current().Type()
+}
+
+func (nav *navigator) Prefix() string {
+	return ""
+}
+
+func (nav *navigator) Value() string {
+	switch {
+	case len(nav.path) == 0:
+		return ""
+	case nav.attr != -1:
+		return nav.attrs[nav.attr].value
+	}
+	text, _ := nav.current().Payload[AttrText].(string)
+	return text
+}
+
+func (nav *navigator) Copy() xpath.NodeNavigator {
+	cp := *nav
+	cp.path = append([]*Node(nil), nav.path...)
+	cp.index = append([]int(nil), nav.index...)
+	return &cp
+}
+
+func (nav *navigator) MoveToRoot() {
+	nav.path = nav.path[:0]
+	nav.index = nav.index[:0]
+	nav.attr = -1
+}
+
+func (nav *navigator) MoveToParent() bool {
+	if nav.attr != -1 {
+		nav.attr = -1
+		return true
+	}
+	if len(nav.path) == 0 {
+		return false
+	}
+	nav.path = nav.path[:len(nav.path)-1]
+	nav.index = nav.index[:len(nav.index)-1]
+	return true
+}
+
+func (nav *navigator) MoveToNextAttribute() bool {
+	if len(nav.path) == 0 {
+		return false
+	}
+	if nav.attr == -1 {
+		nav.attrs = attributes(nav.current())
+	}
+	if nav.attr+1 >= len(nav.attrs) {
+		return false
+	}
+	nav.attr++
+	return true
+}
+
+func (nav *navigator) MoveToChild() bool {
+	if nav.attr != -1 {
+		return false
+	}
+	if len(nav.path) == 0 {
+		nav.path = append(nav.path, nav.root)
+		nav.index = append(nav.index, 0)
+		return true
+	}
+	children := nav.current().Children
+	if len(children) == 0 {
+		return false
+	}
+	nav.path = append(nav.path, children[0])
+	nav.index = append(nav.index, 0)
+	return true
+}
+
+// moveToSibling moves to the i-th child of the parent of the current element.
+func (nav *navigator) moveToSibling(i int) bool {
+	if nav.attr != -1 || len(nav.path) < 2 {
+		return false
+	}
+	siblings := nav.path[len(nav.path)-2].Children
+	if i < 0 || i >= len(siblings) {
+		return false
+	}
+	nav.path[len(nav.path)-1] = siblings[i]
+	nav.index[len(nav.index)-1] = i
+	return true
+}
+
+func (nav *navigator) MoveToFirst() bool {
+	if len(nav.index) == 0 || nav.index[len(nav.index)-1] == 0 {
+		return false
+	}
+	return nav.moveToSibling(0)
+}
+
+func (nav *navigator) MoveToNext() bool {
+	if len(nav.index) == 0 {
+		return false
+	}
+	return nav.moveToSibling(nav.index[len(nav.index)-1] + 1)
+}
+
+func (nav *navigator) MoveToPrevious() bool {
+	if len(nav.index) == 0 {
+		return false
+	}
+	return nav.moveToSibling(nav.index[len(nav.index)-1] - 1)
+}
+
+func (nav *navigator) MoveTo(other xpath.NodeNavigator) bool {
+	o, ok := other.(*navigator)
+	if !ok || o.root != nav.root {
+		return false
+	}
+	nav.path = append(nav.path[:0], o.path...)
+	nav.index = append(nav.index[:0], o.index...)
+	nav.attrs = o.attrs
+	nav.attr = o.attr
+	return true
+}
+
+// attributes returns the scalar payload values of the node sorted by name.
+func attributes(node *Node) []attribute {
+	attrs := make([]attribute, 0, len(node.Payload))
+	for name, value := range node.Payload {
+		switch v := value.(type) {
+		case string:
+			attrs = append(attrs, attribute{name, v})
+		case bool:
+			attrs = append(attrs, attribute{name, strconv.FormatBool(v)})
+		case int:
+			attrs = append(attrs, attribute{name, strconv.Itoa(v)})
+		case float64:
+			attrs = append(attrs, attribute{name, strconv.FormatFloat(v, 'f', -1, 64)})
+		case Rect:
+			attrs = append(attrs,
+				attribute{"x", strconv.Itoa(v.X)},
+				attribute{"y", strconv.Itoa(v.Y)},
+				attribute{"width", strconv.Itoa(v.Width)},
+				attribute{"height", strconv.Itoa(v.Height)})
+		}
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].name < attrs[j].name })
+	return attrs
+}
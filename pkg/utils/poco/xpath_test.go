@@ -0,0 +1,96 @@
+package poco
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryXPath(t *testing.T) {
+	root := testTree()
+	tests := []struct {
+		name string
+		expr string
+		want []string
+	}{
+		{"descendants by type", "//Button", []string{"Button:OK", "Button:Cancel", "Button:Secret"}},
+		{"root element", "/Layer", []string{"Root"}},
+		{"absolute path", "/Layer/Node/Button", []string{"Button:OK", "Button:Cancel", "Button:Secret"}},
+		{"wildcard", "/Layer/*", []string{"Panel", "Hidden", "Footer"}},
+		{"string attribute", "//*[@name='Panel']", []string{"Panel"}},
+		{"text attribute", "//Button[@text='OK']", []string{"Button:OK"}},
+		{"element value is its text", "//Button[.='Cancel']", []string{"Button:Cancel"}},
+		{"bool attribute", "//*[@visible='false']", []string{"Hidden"}},
+		{"int attribute", "//*[@count=3]", []string{"Button:OK"}},
+		{"missing attribute", "//Button[not(@enabled)]", []string{"Button:OK", "Button:Secret"}},
+		{"rect x and y", "//*[@x=100 and @y=300]", []string{"Label:123"}},
+		{"rect width", "//Text[@width > 100]", []string{"Label:123"}},
+		{"rect height", "/Layer/*[@height=500]", []string{"Panel"}},
+		{"no rect without position", "//*[not(@x)]", []string{"Floating"}},
+		{"position", "/Layer/Node[1]/Button[2]", []string{"Button:Cancel"}},
+		{"position per parent", "//Node/*[1]", []string{"Button:OK", "Button:Secret", "Floating"}},
+		{"position in the whole set", "(//Button)[3]", []string{"Button:Secret"}},
+		{"last per parent", "//Node/Button[last()]", []string{"Button:Cancel", "Button:Secret"}},
+		{"position function", "/Layer/*[position() > 1]", []string{"Hidden", "Footer"}},
+		{"following siblings", "//Button[@text='OK']/following-sibling::*", []string{"Button:Cancel", "Label:123"}},
+		{"following sibling", "//Button[@text='OK']/following-sibling::*[1]", []string{"Button:Cancel"}},
+		{"preceding siblings", "//Text[@text='123']/preceding-sibling::Button", []string{"Button:OK", "Button:Cancel"}},
+		{"nearest preceding sibling", "//Text[@text='123']/preceding-sibling::*[1]", []string{"Button:Cancel"}},
+		{"parent", "//Button[@text='OK']/..", []string{"Panel"}},
+		{"parent axis deduplicated", "//Text/parent::*", []string{"Panel", "Footer"}},
+		{"ancestors", "//Button[@text='Secret']/ancestor::*", []string{"Root", "Hidden"}},
+		{"descendant axis", "/Layer/Node[3]/descendant::*", []string{"Floating", "Label:v1.0"}},
+		{"following", "//Button[@text='Secret']/following::Text", []string{"Label:v1.0"}},
+		{"attributes are not elements", "//Button/@text", []string{}},
+		{"no match", "//Image", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := QueryXPath(root, tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := labels(nodes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryXPath(%s) = %q, want %q", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryXPathErrors(t *testing.T) {
+	for _, expr := range []string{"", "//[", "//Button[@text="} {
+		if _, err := QueryXPath(testTree(), expr); err == nil {
+			t.Errorf("QueryXPath(%s) succeeded", expr)
+		}
+	}
+}
+
+func TestNavigatorAttributes(t *testing.T) {
+	nav := newNavigator(testTree())
+	if !nav.MoveToChild() || !nav.MoveToChild() || !nav.MoveToChild() {
+		t.Fatal("cannot move to the first button")
+	}
+	var got []string
+	for nav.MoveToNextAttribute() {
+		got = append(got, nav.LocalName()+"="+nav.Value())
+	}
+	want := []string{"count=3", "height=50", "name=Button", "text=OK", "type=Button", "visible=true", "width=100", "x=600", "y=100"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes = %q, want %q", got, want)
+	}
+	if !nav.MoveToParent() || nav.LocalName() != "Button" || nav.Value() != "OK" {
+		t.Errorf("MoveToParent from an attribute = %s %q, want the button", nav.LocalName(), nav.Value())
+	}
+	if nav.MoveToPrevious() || nav.MoveToFirst() {
+		t.Error("moved before the first child")
+	}
+	if !nav.MoveToNext() || !nav.MoveToNext() || nav.MoveToNext() || nav.Value() != "123" {
+		t.Errorf("MoveToNext ended at %q, want the last child 123", nav.Value())
+	}
+	if !nav.MoveToFirst() || nav.Value() != "OK" {
+		t.Errorf("MoveToFirst = %q, want OK", nav.Value())
+	}
+	nav.MoveToRoot()
+	if nav.MoveToParent() || nav.MoveToNext() {
+		t.Error("moved away from the document node")
+	}
+}
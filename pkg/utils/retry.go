@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent 包装的错误会让 Retry 立即停止重试
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Retry 调用 fn 直到成功、ctx 结束或用完 attempts 次，
+// 每次失败后的等待时间从 initial 开始翻倍，最多 max
+func Retry(ctx context.Context, attempts int, initial, max time.Duration, fn func(attempt int) error) error {
+	wait := initial
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = fn(attempt)
+		if err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if attempt == attempts {
+			break
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		wait *= 2
+		if wait > max {
+			wait = max
+		}
+	}
+	return err
+}
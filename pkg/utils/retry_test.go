@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	errTransient := errors.New("transient")
+	errFatal := errors.New("fatal")
+	tests := []struct {
+		name      string
+		attempts  int
+		failUntil int   // 前 failUntil 次返回 errTransient
+		fatalAt   int   // 第 fatalAt 次返回 Permanent(errFatal)
+		want      error // nil 表示成功
+		calls     int
+	}{
+		{"first attempt", 3, 0, 0, nil, 1},
+		{"after failures", 3, 2, 0, nil, 3},
+		{"attempts exhausted", 3, 5, 0, errTransient, 3},
+		{"single attempt", 1, 1, 0, errTransient, 1},
+		{"permanent stops", 5, 5, 2, errFatal, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := Retry(context.Background(), tt.attempts, time.Millisecond, 2*time.Millisecond, func(attempt int) error {
+				calls++
+				if attempt != calls {
+					t.Errorf("attempt = %d on call %d", attempt, calls)
+				}
+				if attempt == tt.fatalAt {
+					return Permanent(errFatal)
+				}
+				if attempt <= tt.failUntil {
+					return errTransient
+				}
+				return nil
+			})
+			if err != tt.want {
+				t.Errorf("Retry = %v, want %v", err, tt.want)
+			}
+			if calls != tt.calls {
+				t.Errorf("fn called %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	var times []time.Time
+	Retry(context.Background(), 5, 10*time.Millisecond, 20*time.Millisecond, func(int) error {
+		times = append(times, time.Now())
+		return errors.New("transient")
+	})
+	// 等待依次为 10、20、20、20 毫秒
+	for i, want := range []time.Duration{10, 20, 20, 20} {
+		if wait := times[i+1].Sub(times[i]); wait < want*time.Millisecond {
+			t.Errorf("wait %d = %s, want at least %dms", i+1, wait, want)
+		}
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	done := make(chan error)
+	go func() {
+		done <- Retry(ctx, 3, time.Hour, time.Hour, func(int) error {
+			calls++
+			return errors.New("transient")
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) || calls != 1 {
+			t.Errorf("Retry = %v after %d calls, want context.Canceled after 1", err, calls)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Retry kept waiting after ctx was cancelled")
+	}
+}
+
+func TestPermanentUnwrap(t *testing.T) {
+	err := errors.New("fatal")
+	if !errors.Is(Permanent(err), err) || Permanent(err).Error() != "fatal" {
+		t.Error("Permanent does not wrap the error")
+	}
+}
@@ -0,0 +1,79 @@
+package scrcpy
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// control message types of the scrcpy protocol
+const (
+	controlInjectKeycode = 0
+	controlInjectText    = 1
+	controlInjectTouch   = 2
+)
+
+// Android MotionEvent and KeyEvent actions
+const (
+	ActionDown = 0
+	ActionUp   = 1
+	ActionMove = 2
+)
+
+const maxTextLength = 300
+
+// InjectKeycode sends a key event, action is ActionDown or ActionUp.
+func (s *Session) InjectKeycode(action uint8, keycode, repeat, metaState uint32) error {
+	msg := make([]byte, 14)
+	msg[0] = controlInjectKeycode
+	msg[1] = action
+	binary.BigEndian.PutUint32(msg[2:], keycode)
+	binary.BigEndian.PutUint32(msg[6:], repeat)
+	binary.BigEndian.PutUint32(msg[10:], metaState)
+	return s.sendControl(msg)
+}
+
+// InjectText types text, scrcpy limits a message to 300 bytes.
+func (s *Session) InjectText(text string) error {
+	if len(text) > maxTextLength {
+		return errors.New("scrcpy: text too long")
+	}
+	msg := make([]byte, 5+len(text))
+	msg[0] = controlInjectText
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(text)))
+	copy(msg[5:], text)
+	return s.sendControl(msg)
+}
+
+// InjectTouch sends a touch event at x, y in pixels of the current video
+// size, scrcpy drops events whose screen size does not match it.
+func (s *Session) InjectTouch(action uint8, pointerID uint64, x, y int, pressure float64) error {
+	meta := s.Meta()
+	msg := make([]byte, 32)
+	msg[0] = controlInjectTouch
+	msg[1] = action
+	binary.BigEndian.PutUint64(msg[2:], pointerID)
+	binary.BigEndian.PutUint32(msg[10:], uint32(int32(x)))
+	binary.BigEndian.PutUint32(msg[14:], uint32(int32(y)))
+	binary.BigEndian.PutUint16(msg[18:], uint16(meta.Width))
+	binary.BigEndian.PutUint16(msg[20:], uint16(meta.Height))
+	binary.BigEndian.PutUint16(msg[22:], toFixedPoint16(pressure))
+	// action_button 和 buttons 对触摸事件为 0
+	return s.sendControl(msg)
+}
+
+func toFixedPoint16(v float64) uint16 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 1:
+		return 0xffff
+	}
+	return uint16(v * 65536)
+}
+
+func (s *Session) sendControl(msg []byte) error {
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+	_, err := s.control.Write(msg)
+	return err
+}
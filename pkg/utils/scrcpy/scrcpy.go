@@ -0,0 +1,214 @@
+package scrcpy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blacklee123/go-adb/adb"
+	"github.com/blacklee123/go-ios-android/pkg/utils/adbhost"
+)
+
+const (
+	RemoteJarPath = "/data/local/tmp/scrcpy-server.jar"
+
+	connectAttempts = 50
+	connectInterval = 100 * time.Millisecond
+
+	packetFlagConfig   = uint64(1) << 63
+	packetFlagKeyFrame = uint64(1) << 62
+	maxPacketSize      = 16 << 20
+)
+
+// Options of the video stream, zero values keep the scrcpy defaults.
+type Options struct {
+	MaxSize int
+	MaxFps  int
+	BitRate int
+}
+
+// Meta describes the video stream of a session.
+type Meta struct {
+	DeviceName string `json:"device_name"`
+	Codec      string `json:"codec"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+}
+
+// Packet is one H.264 access unit in Annex B format, config packets carry
+// SPS/PPS and have no PTS.
+type Packet struct {
+	PTS      uint64
+	Config   bool
+	KeyFrame bool
+	Data     []byte
+}
+
+// Session is a running scrcpy server with its video and control sockets.
+type Session struct {
+	video     net.Conn
+	control   net.Conn
+	controlMu sync.Mutex
+	meta      Meta
+	header    [12]byte
+	done      chan error
+	closeOnce sync.Once
+}
+
+// Start pushes the server jar to the device, starts scrcpy-server version
+// (which must match the jar) and connects to it.
+func Start(ctx context.Context, device adb.Device, jarPath, version string, options Options) (*Session, error) {
+	jar, err := os.Open(jarPath)
+	if err != nil {
+		return nil, err
+	}
+	err = device.Push(jar, RemoteJarPath, time.Now(), 0644)
+	jar.Close()
+	if err != nil {
+		return nil, fmt.Errorf("push scrcpy server: %w", err)
+	}
+
+	scid := fmt.Sprintf("%08x", rand.Int31())
+	args := []string{
+		"CLASSPATH=" + RemoteJarPath, "app_process", "/", "com.genymobile.scrcpy.Server", version,
+		"scid=" + scid, "log_level=warn", "audio=false", "control=true", "tunnel_forward=true",
+		"video_codec=h264", "send_device_meta=true", "send_frame_meta=true", "send_dummy_byte=true", "send_codec_meta=true",
+	}
+	if options.MaxSize > 0 {
+		args = append(args, fmt.Sprintf("max_size=%d", options.MaxSize))
+	}
+	if options.MaxFps > 0 {
+		args = append(args, fmt.Sprintf("max_fps=%d", options.MaxFps))
+	}
+	if options.BitRate > 0 {
+		args = append(args, fmt.Sprintf("video_bit_rate=%d", options.BitRate))
+	}
+
+	s := &Session{done: make(chan error, 1)}
+	go func() {
+		// 服务端在 socket 关闭后退出
+		output, err := device.RunShellCommand(args[0], args[1:]...)
+		if err == nil && strings.Contains(output, "ERROR") {
+			err = errors.New(strings.TrimSpace(output))
+		}
+		s.done <- err
+	}()
+
+	// 连接失败时服务端可能还在等待连接，需要结束它
+	started := false
+	defer func() {
+		if !started {
+			s.Close()
+			device.RunShellCommand("pkill", "-f", "scid="+scid)
+		}
+	}()
+
+	socket := "localabstract:scrcpy_" + scid
+	if s.video, err = s.connect(ctx, device.Serial(), socket, true); err != nil {
+		return nil, err
+	}
+	if s.control, err = s.connect(ctx, device.Serial(), socket, false); err != nil {
+		return nil, err
+	}
+	if err := s.readMeta(); err != nil {
+		return nil, err
+	}
+	started = true
+	// 设备发来的剪贴板等消息暂不处理，需要读走以免阻塞
+	go io.Copy(io.Discard, s.control)
+	return s, nil
+}
+
+// connect waits for the server socket, the dummy byte on the first socket
+// tells that the server has accepted the connection.
+func (s *Session) connect(ctx context.Context, serial, socket string, dummyByte bool) (net.Conn, error) {
+	var lastErr error
+	for attempt := 0; attempt < connectAttempts; attempt++ {
+		select {
+		case err := <-s.done:
+			return nil, fmt.Errorf("scrcpy server exited: %v", err)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		conn, err := adbhost.DialDevice(serial, socket)
+		if err == nil && dummyByte {
+			b := make([]byte, 1)
+			if _, err = io.ReadFull(conn, b); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		time.Sleep(connectInterval)
+	}
+	return nil, fmt.Errorf("scrcpy server not reachable: %w", lastErr)
+}
+
+func (s *Session) readMeta() error {
+	name := make([]byte, 64)
+	if _, err := io.ReadFull(s.video, name); err != nil {
+		return err
+	}
+	codec := make([]byte, 12)
+	if _, err := io.ReadFull(s.video, codec); err != nil {
+		return err
+	}
+	s.meta = Meta{
+		DeviceName: string(bytes.TrimRight(name, "\x00")),
+		Codec:      strings.TrimRight(string(codec[0:4]), "\x00"),
+		Width:      int(binary.BigEndian.Uint32(codec[4:8])),
+		Height:     int(binary.BigEndian.Uint32(codec[8:12])),
+	}
+	return nil
+}
+
+func (s *Session) Meta() Meta {
+	return s.meta
+}
+
+// ReadPacket blocks until the next video packet arrives.
+func (s *Session) ReadPacket() (Packet, error) {
+	if _, err := io.ReadFull(s.video, s.header[:]); err != nil {
+		return Packet{}, err
+	}
+	ptsAndFlags := binary.BigEndian.Uint64(s.header[0:8])
+	size := binary.BigEndian.Uint32(s.header[8:12])
+	if size > maxPacketSize {
+		return Packet{}, fmt.Errorf("scrcpy: packet of %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(s.video, data); err != nil {
+		return Packet{}, err
+	}
+	return Packet{
+		PTS:      ptsAndFlags &^ (packetFlagConfig | packetFlagKeyFrame),
+		Config:   ptsAndFlags&packetFlagConfig != 0,
+		KeyFrame: ptsAndFlags&packetFlagKeyFrame != 0,
+		Data:     data,
+	}, nil
+}
+
+// Close closes both sockets, which makes the server exit.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		if s.video != nil {
+			s.video.Close()
+		}
+		if s.control != nil {
+			s.control.Close()
+		}
+	})
+	return nil
+}
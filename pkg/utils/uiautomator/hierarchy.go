@@ -0,0 +1,128 @@
+package uiautomator
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image"
+	"regexp"
+	"strconv"
+
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+)
+
+// 常用的 uiautomator 属性名
+const (
+	AttrResourceID  = "resource-id"
+	AttrClass       = "class"
+	AttrContentDesc = "content-desc"
+	AttrBounds      = "bounds"
+)
+
+var boundsPattern = regexp.MustCompile(`^\[(-?\d+),(-?\d+)\]\[(-?\d+),(-?\d+)\]$`)
+
+type xmlNode struct {
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Children []xmlNode  `xml:"node"`
+}
+
+// Parse converts the XML written by `uiautomator dump` to Poco nodes. screen
+// is the size of the screen in its current orientation in pixels. The root
+// is the hierarchy element, every node keeps its uiautomator attributes in
+// the payload, "true" and "false" converted to booleans.
+func Parse(data []byte, screen image.Point) (*poco.Node, error) {
+	var hierarchy xmlNode
+	if err := xml.Unmarshal(data, &hierarchy); err != nil {
+		return nil, fmt.Errorf("invalid uiautomator dump: %w", err)
+	}
+	root := poco.NewNode("hierarchy", "hierarchy", image.Rectangle{Max: screen}, screen)
+	for _, attr := range hierarchy.Attrs {
+		root.Payload[attr.Name.Local] = attrValue(attr.Name.Local, attr.Value)
+	}
+	root.Payload[poco.AttrZOrders] = zOrders(0, 0)
+
+	global := 0
+	var convert func(parent *poco.Node, children []xmlNode)
+	convert = func(parent *poco.Node, children []xmlNode) {
+		for i, child := range children {
+			global++
+			node := convertNode(child, screen)
+			node.Payload[poco.AttrZOrders] = zOrders(global, i)
+			parent.Children = append(parent.Children, node)
+			convert(node, child.Children)
+		}
+	}
+	convert(root, hierarchy.Children)
+	return root, nil
+}
+
+// convertNode names the node by its resource-id like Poco's Android driver
+// does, the class is used for nodes without one.
+func convertNode(x xmlNode, screen image.Point) *poco.Node {
+	attrs := make(map[string]string, len(x.Attrs))
+	for _, attr := range x.Attrs {
+		attrs[attr.Name.Local] = attr.Value
+	}
+	name := attrs[AttrResourceID]
+	if name == "" {
+		name = attrs[AttrClass]
+	}
+	node := poco.NewNode(name, attrs[AttrClass], ParseBounds(attrs[AttrBounds]), screen)
+	for key, value := range attrs {
+		node.Payload[key] = attrValue(key, value)
+	}
+	// 新版本的 uiautomator 会给出 visible-to-user
+	if visible, ok := node.Payload["visible-to-user"].(bool); ok {
+		node.Payload[poco.AttrVisible] = visible
+	}
+	// 保持 name 和 type 不被同名属性覆盖
+	node.Payload[poco.AttrName] = name
+	node.Payload[poco.AttrType] = attrs[AttrClass]
+	return node
+}
+
+// ParseBounds parses uiautomator bounds like "[0,63][1080,210]", an empty
+// rectangle is returned for malformed ones.
+func ParseBounds(bounds string) image.Rectangle {
+	match := boundsPattern.FindStringSubmatch(bounds)
+	if match == nil {
+		return image.Rectangle{}
+	}
+	var v [4]int
+	for i := range v {
+		v[i], _ = strconv.Atoi(match[i+1])
+	}
+	return image.Rect(v[0], v[1], v[2], v[3])
+}
+
+// booleanAttrs are the uiautomator attributes holding booleans, text and
+// other attributes stay strings even when they read "true" or "false".
+var booleanAttrs = map[string]bool{
+	"checkable":       true,
+	"checked":         true,
+	"clickable":       true,
+	"enabled":         true,
+	"focusable":       true,
+	"focused":         true,
+	"scrollable":      true,
+	"long-clickable":  true,
+	"password":        true,
+	"selected":        true,
+	"visible-to-user": true,
+}
+
+func attrValue(key, value string) interface{} {
+	if !booleanAttrs[key] {
+		return value
+	}
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return value
+}
+
+func zOrders(global, local int) map[string]int {
+	return map[string]int{"global": global, "local": local}
+}
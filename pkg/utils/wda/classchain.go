@@ -0,0 +1,186 @@
+package wda
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+)
+
+// chainSegment is one level of a class chain like
+// XCUIElementTypeCell[`name BEGINSWITH "Wi"`][2].
+type chainSegment struct {
+	descendant bool // 以 **/ 开头，匹配任意深度的后代
+	typ        string
+	filters    []chainFilter
+}
+
+// ValidateClassChain returns the error QueryClassChain would give for the
+// class chain, without a tree to query.
+func ValidateClassChain(expr string) error {
+	if _, err := parseClassChain(expr); err != nil {
+		return fmt.Errorf("invalid class chain %q: %w", expr, err)
+	}
+	return nil
+}
+
+// chainFilter is a predicate, a descendant predicate or an index.
+type chainFilter struct {
+	predicate  *Predicate
+	descendant bool
+	index      int // 从 1 开始，负数从末尾数
+}
+
+// QueryClassChain returns the nodes matching a WDA class chain query such as
+// "**/XCUIElementTypeCell[`name BEGINSWITH 'Wi'`]/XCUIElementTypeButton[1]".
+// The first segment matches the children of root and "**/" lets the next
+// segment match descendants at any depth. The type may be "*", filters are
+// predicates in backticks, predicates on descendants in dollars or 1-based
+// indexes, negative ones counting from the end. Indexes pick from all
+// candidates of the segment like XCUIElementQuery does.
+func QueryClassChain(root *poco.Node, expr string) ([]*poco.Node, error) {
+	segments, err := parseClassChain(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid class chain %q: %w", expr, err)
+	}
+	current := []*poco.Node{root}
+	for _, segment := range segments {
+		var candidates []*poco.Node
+		seen := make(map[*poco.Node]bool)
+		add := func(node *poco.Node) bool {
+			if !seen[node] && (segment.typ == "*" || node.Type() == segment.typ) {
+				seen[node] = true
+				candidates = append(candidates, node)
+			}
+			return true
+		}
+		for _, node := range current {
+			for _, child := range node.Children {
+				if segment.descendant {
+					child.Walk(add)
+				} else {
+					add(child)
+				}
+			}
+		}
+		for _, filter := range segment.filters {
+			candidates = filter.apply(candidates)
+		}
+		current = candidates
+		if len(current) == 0 {
+			break
+		}
+	}
+	return current, nil
+}
+
+func (f chainFilter) apply(nodes []*poco.Node) []*poco.Node {
+	if f.predicate == nil {
+		i := f.index - 1
+		if f.index < 0 {
+			i = len(nodes) + f.index
+		}
+		if i < 0 || i >= len(nodes) {
+			return nil
+		}
+		return nodes[i : i+1]
+	}
+	var matched []*poco.Node
+	for _, node := range nodes {
+		if f.descendant {
+			if hasDescendant(node, f.predicate) {
+				matched = append(matched, node)
+			}
+		} else if f.predicate.Match(node) {
+			matched = append(matched, node)
+		}
+	}
+	return matched
+}
+
+func hasDescendant(node *poco.Node, predicate *Predicate) bool {
+	found := false
+	for _, child := range node.Children {
+		child.Walk(func(n *poco.Node) bool {
+			found = found || predicate.Match(n)
+			return !found
+		})
+	}
+	return found
+}
+
+func parseClassChain(expr string) ([]chainSegment, error) {
+	var segments []chainSegment
+	rest := expr
+	for {
+		var segment chainSegment
+		if after, ok := strings.CutPrefix(rest, "**/"); ok {
+			segment.descendant = true
+			rest = after
+		}
+		end := strings.IndexAny(rest, "[]/")
+		if end < 0 {
+			end = len(rest)
+		}
+		segment.typ = rest[:end]
+		if segment.typ == "" {
+			return nil, fmt.Errorf("missing type at %d", len(expr)-len(rest))
+		}
+		rest = rest[end:]
+		for strings.HasPrefix(rest, "[") {
+			filter, after, err := parseChainFilter(rest[1:])
+			if err != nil {
+				return nil, err
+			}
+			segment.filters = append(segment.filters, filter)
+			rest = after
+		}
+		segments = append(segments, segment)
+		if rest == "" {
+			return segments, nil
+		}
+		if !strings.HasPrefix(rest, "/") {
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+		rest = rest[1:]
+	}
+}
+
+// parseChainFilter parses a filter after its "[" and returns what follows
+// its "]". Backticks in predicates are escaped by doubling them.
+func parseChainFilter(s string) (chainFilter, string, error) {
+	if len(s) > 0 && (s[0] == '`' || s[0] == '$') {
+		quote := s[0]
+		var sb strings.Builder
+		i := 1
+		for ; i < len(s); i++ {
+			if s[i] == quote {
+				if i+1 < len(s) && s[i+1] == quote {
+					sb.WriteByte(quote)
+					i++
+					continue
+				}
+				break
+			}
+			sb.WriteByte(s[i])
+		}
+		if i+1 >= len(s) || s[i+1] != ']' {
+			return chainFilter{}, "", fmt.Errorf("unterminated predicate %q", s)
+		}
+		predicate, err := CompilePredicate(sb.String())
+		if err != nil {
+			return chainFilter{}, "", err
+		}
+		return chainFilter{predicate: predicate, descendant: quote == '$'}, s[i+2:], nil
+	}
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return chainFilter{}, "", fmt.Errorf("unterminated index %q", s)
+	}
+	index, err := strconv.Atoi(s[:end])
+	if err != nil || index == 0 {
+		return chainFilter{}, "", fmt.Errorf("invalid index %q", s[:end])
+	}
+	return chainFilter{index: index}, s[end+1:], nil
+}
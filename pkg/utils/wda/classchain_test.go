@@ -0,0 +1,77 @@
+package wda
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryClassChain(t *testing.T) {
+	root := testTree(t)
+	tests := []struct {
+		name string
+		expr string
+		want []string
+	}{
+		{"children of root", "XCUIElementTypeTable", []string{"XCUIElementTypeTable"}},
+		{"direct path", "XCUIElementTypeTable/XCUIElementTypeCell", []string{"Wi-Fi", "Bluetooth", `Say "hi"`}},
+		{"no descendants without **", "XCUIElementTypeCell", []string{}},
+		{"descendants", "**/XCUIElementTypeStaticText", []string{"wifi-title", "bt-title"}},
+		{"wildcard", "XCUIElementTypeTable/XCUIElementTypeCell[1]/*", []string{"wifi-title", "wifi-switch"}},
+		{"index", "**/XCUIElementTypeCell[2]", []string{"Bluetooth"}},
+		{"negative index", "**/XCUIElementTypeCell[-1]", []string{`Say "hi"`}},
+		{"negative index from the end", "**/XCUIElementTypeCell[-3]", []string{"Wi-Fi"}},
+		{"index out of range", "**/XCUIElementTypeCell[4]", []string{}},
+		{"negative index out of range", "**/XCUIElementTypeCell[-4]", []string{}},
+		{"index over all candidates", "**/XCUIElementTypeCell/XCUIElementTypeStaticText[2]", []string{"bt-title"}},
+		{"predicate", "**/XCUIElementTypeCell[`name BEGINSWITH 'Blue'`]", []string{"Bluetooth"}},
+		{"predicate then index", "**/XCUIElementTypeCell[`enabled == 1`][-1]", []string{"Bluetooth"}},
+		{"index then predicate", "**/XCUIElementTypeCell[1][`name == 'Bluetooth'`]", []string{}},
+		{"predicate with [c]", "**/XCUIElementTypeButton[`label ==[c] 'BACK'`]", []string{"Back"}},
+		{"predicate with IN", "**/XCUIElementTypeCell[`name IN {'Wi-Fi', 'Bluetooth'}`]", []string{"Wi-Fi", "Bluetooth"}},
+		{"escaped backtick", "**/XCUIElementTypeCell[`label == 'a``b'`]", []string{`Say "hi"`}},
+		{"escaped quote", "**/XCUIElementTypeCell[`name == \"Say \\\"hi\\\"\"`]", []string{`Say "hi"`}},
+		{"descendant predicate", "**/XCUIElementTypeCell[$type == 'XCUIElementTypeSwitch'$]", []string{"Wi-Fi"}},
+		{"descendant predicate then path", "**/XCUIElementTypeCell[$name == 'bt-title'$]/XCUIElementTypeStaticText", []string{"bt-title"}},
+		{"descendant predicate excludes self", "**/XCUIElementTypeCell[$name == 'Wi-Fi'$]", []string{}},
+		{"escaped dollar", "**/XCUIElementTypeCell[$label == 'Wi-Fi' OR name == 'x$$'$]", []string{"Wi-Fi"}},
+		{"descendants of descendants", "**/XCUIElementTypeTable/**/XCUIElementTypeSwitch", []string{"wifi-switch"}},
+		{"no duplicates", "**/*/**/XCUIElementTypeStaticText", []string{"wifi-title", "bt-title"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := QueryClassChain(root, tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(nodes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryClassChain(%s) = %q, want %q", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateClassChain(t *testing.T) {
+	tests := []struct {
+		expr  string
+		valid bool
+	}{
+		{"**/XCUIElementTypeCell[`name == 'a'`][2]/*", true},
+		{"", false},
+		{"**/", false},
+		{"XCUIElementTypeCell/", false},
+		{"XCUIElementTypeCell[0]", false},
+		{"XCUIElementTypeCell[x]", false},
+		{"XCUIElementTypeCell[1", false},
+		{"XCUIElementTypeCell[`name == 'a'", false},
+		{"XCUIElementTypeCell[`name == 'a'`", false},
+		{"XCUIElementTypeCell[$name ==$]", false},
+		{"XCUIElementTypeCell]", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if err := ValidateClassChain(tt.expr); (err == nil) != tt.valid {
+				t.Errorf("ValidateClassChain(%s) = %v, want valid %v", tt.expr, err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,559 @@
+package wda
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+)
+
+// Predicate is a compiled NSPredicate in the form WDA's "predicate string"
+// strategy takes it, evaluated against normalized source nodes. Supported
+// are the comparisons ==, !=, <, <=, >, >=, CONTAINS, BEGINSWITH, ENDSWITH,
+// LIKE, MATCHES and IN with the [c] option, AND, OR, NOT, parentheses and
+// TRUEPREDICATE/FALSEPREDICATE. The [d] option is accepted but ignored.
+type Predicate struct {
+	expr string
+	root predicateNode
+}
+
+// 与 WDA 一致的属性别名
+var keyAliases = map[string]string{
+	"elementType":  poco.AttrType,
+	"identifier":   poco.AttrName,
+	"isEnabled":    AttrEnabled,
+	"isVisible":    poco.AttrVisible,
+	"isAccessible": AttrAccessible,
+}
+
+// CompilePredicate parses the predicate.
+func CompilePredicate(expr string) (*Predicate, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid predicate %q: %w", expr, err)
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokEOF {
+		err = fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid predicate %q: %w", expr, err)
+	}
+	return &Predicate{expr: expr, root: root}, nil
+}
+
+func (p *Predicate) String() string {
+	return p.expr
+}
+
+// Match reports whether the node satisfies the predicate.
+func (p *Predicate) Match(node *poco.Node) bool {
+	return p.root.eval(node)
+}
+
+// QueryPredicate returns the descendants of root matching the predicate in
+// document order.
+func QueryPredicate(root *poco.Node, expr string) ([]*poco.Node, error) {
+	predicate, err := CompilePredicate(expr)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*poco.Node
+	for _, child := range root.Children {
+		child.Walk(func(node *poco.Node) bool {
+			if predicate.Match(node) {
+				nodes = append(nodes, node)
+			}
+			return true
+		})
+	}
+	return nodes, nil
+}
+
+type predicateNode interface {
+	eval(node *poco.Node) bool
+}
+
+type andNode struct{ left, right predicateNode }
+
+func (n andNode) eval(node *poco.Node) bool { return n.left.eval(node) && n.right.eval(node) }
+
+type orNode struct{ left, right predicateNode }
+
+func (n orNode) eval(node *poco.Node) bool { return n.left.eval(node) || n.right.eval(node) }
+
+type notNode struct{ x predicateNode }
+
+func (n notNode) eval(node *poco.Node) bool { return !n.x.eval(node) }
+
+type constNode bool
+
+func (n constNode) eval(*poco.Node) bool { return bool(n) }
+
+// operand is a key path or a literal, list holds the items of {a, b}.
+type operand struct {
+	keyPath string
+	value   interface{}
+	list    []interface{}
+}
+
+func (o operand) resolve(node *poco.Node) interface{} {
+	if o.keyPath == "" {
+		return o.value
+	}
+	return lookup(node, o.keyPath)
+}
+
+type compareNode struct {
+	left, right operand
+	op          string
+	fold        bool
+	re          *regexp.Regexp // LIKE 和 MATCHES 的右侧为字面量时预先编译
+}
+
+func (n compareNode) eval(node *poco.Node) bool {
+	left := n.left.resolve(node)
+	if n.op == "IN" {
+		if n.right.list != nil {
+			for _, item := range n.right.list {
+				if equal(left, item, n.fold) {
+					return true
+				}
+			}
+			return false
+		}
+		return strings.Contains(n.str(n.right.resolve(node)), n.str(left))
+	}
+	right := n.right.resolve(node)
+	switch n.op {
+	case "==":
+		return equal(left, right, n.fold)
+	case "!=":
+		return !equal(left, right, n.fold)
+	case "<", "<=", ">", ">=":
+		c, ok := order(left, right, n.fold)
+		if !ok {
+			return false
+		}
+		switch n.op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	case "CONTAINS":
+		return strings.Contains(n.str(left), n.str(right))
+	case "BEGINSWITH":
+		return strings.HasPrefix(n.str(left), n.str(right))
+	case "ENDSWITH":
+		return strings.HasSuffix(n.str(left), n.str(right))
+	case "LIKE", "MATCHES":
+		re := n.re
+		if re == nil {
+			var err error
+			if re, err = patternRegexp(n.op, toString(right), n.fold); err != nil {
+				return false
+			}
+		}
+		return re.MatchString(toString(left))
+	}
+	return false
+}
+
+func (n compareNode) str(v interface{}) string {
+	if n.fold {
+		return strings.ToLower(toString(v))
+	}
+	return toString(v)
+}
+
+// lookup returns the value of the key path, WDA's wd prefixed names like
+// wdName and rect.x style key paths included.
+func lookup(node *poco.Node, keyPath string) interface{} {
+	if rest, ok := strings.CutPrefix(keyPath, "wd"); ok && rest != "" && unicode.IsUpper(rune(rest[0])) {
+		keyPath = strings.ToLower(rest[:1]) + rest[1:]
+	}
+	if alias, ok := keyAliases[keyPath]; ok {
+		keyPath = alias
+	}
+	if field, ok := strings.CutPrefix(keyPath, "rect."); ok {
+		rect, _ := node.Payload[poco.AttrRect].(poco.Rect)
+		switch field {
+		case "x":
+			return float64(rect.X)
+		case "y":
+			return float64(rect.Y)
+		case "width":
+			return float64(rect.Width)
+		case "height":
+			return float64(rect.Height)
+		}
+		return nil
+	}
+	if keyPath == poco.AttrType {
+		return node.Type()
+	}
+	return node.Payload[keyPath]
+}
+
+func patternRegexp(op, pattern string, fold bool) (*regexp.Regexp, error) {
+	if op == "LIKE" {
+		var sb strings.Builder
+		for _, r := range pattern {
+			switch r {
+			case '*':
+				sb.WriteString(".*")
+			case '?':
+				sb.WriteString(".")
+			default:
+				sb.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		pattern = sb.String()
+	}
+	if fold {
+		pattern = "(?i)" + pattern
+	}
+	// MATCHES 和 LIKE 都要求整串匹配
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// toNumber converts booleans and numbers, strings only when they hold one.
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return toNumber(b)
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func isString(v interface{}) bool {
+	_, ok := v.(string)
+	return ok || v == nil
+}
+
+func equal(left, right interface{}, fold bool) bool {
+	c, ok := order(left, right, fold)
+	return ok && c == 0
+}
+
+// order compares numerically unless both sides are strings.
+func order(left, right interface{}, fold bool) (int, bool) {
+	if !isString(left) || !isString(right) {
+		l, lok := toNumber(left)
+		r, rok := toNumber(right)
+		if !lok || !rok {
+			return 0, false
+		}
+		switch {
+		case l < r:
+			return -1, true
+		case l > r:
+			return 1, true
+		}
+		return 0, true
+	}
+	l, r := toString(left), toString(right)
+	if fold {
+		l, r = strings.ToLower(l), strings.ToLower(r)
+	}
+	return strings.Compare(l, r), true
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokOption // [c]、[cd] 等比较选项
+	tokPunct  // ( ) { } ,
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func lex(expr string) ([]token, error) {
+	var tokens []token
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case strings.ContainsRune("(){},", r):
+			tokens = append(tokens, token{tokPunct, string(r)})
+			i++
+		case r == '\'' || r == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				sb.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{tokString, sb.String()})
+			i = j + 1
+		case r == '[':
+			j := i + 1
+			for j < len(runes) && runes[j] != ']' {
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated option at %d", i)
+			}
+			tokens = append(tokens, token{tokOption, strings.ToLower(string(runes[i+1 : j]))})
+			i = j + 1
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_' || r == '$' || r == '@':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, string(runes[i:j])})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<>", "<=", "=<", ">=", "=>", "&&", "||", "=", "<", ">", "!"} {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", r, i)
+			}
+			tokens = append(tokens, token{tokOp, op})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword reports whether the next token is one of the keywords or
+// operators and consumes it if so.
+func (p *parser) keyword(words ...string) bool {
+	t := p.peek()
+	if t.kind != tokIdent && t.kind != tokOp {
+		return false
+	}
+	for _, word := range words {
+		if strings.EqualFold(t.text, word) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) parseOr() (predicateNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR", "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (predicateNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND", "&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (predicateNode, error) {
+	if p.keyword("NOT", "!") {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (predicateNode, error) {
+	if t := p.peek(); t.kind == tokPunct && t.text == "(" {
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokPunct || t.text != ")" {
+			return nil, fmt.Errorf("expected ) instead of %q", t.text)
+		}
+		return x, nil
+	}
+	if p.keyword("TRUEPREDICATE") {
+		return constNode(true), nil
+	}
+	if p.keyword("FALSEPREDICATE") {
+		return constNode(false), nil
+	}
+	return p.parseComparison()
+}
+
+// 比较运算符到内部名称
+var comparisonOps = map[string]string{
+	"==": "==", "=": "==", "!=": "!=", "<>": "!=",
+	"<": "<", "<=": "<=", "=<": "<=", ">": ">", ">=": ">=", "=>": ">=",
+	"CONTAINS": "CONTAINS", "BEGINSWITH": "BEGINSWITH", "ENDSWITH": "ENDSWITH",
+	"LIKE": "LIKE", "MATCHES": "MATCHES", "IN": "IN",
+}
+
+func (p *parser) parseComparison() (predicateNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	t := p.next()
+	op, ok := comparisonOps[strings.ToUpper(t.text)]
+	if !ok || (t.kind != tokOp && t.kind != tokIdent) {
+		return nil, fmt.Errorf("expected comparison instead of %q", t.text)
+	}
+	n := compareNode{left: left, op: op}
+	if p.peek().kind == tokOption {
+		n.fold = strings.Contains(p.next().text, "c")
+	}
+	if n.right, err = p.parseOperand(); err != nil {
+		return nil, err
+	}
+	if n.right.list != nil && op != "IN" {
+		return nil, fmt.Errorf("a list is only allowed after IN")
+	}
+	if (op == "LIKE" || op == "MATCHES") && n.right.keyPath == "" {
+		if n.re, err = patternRegexp(op, toString(n.right.value), n.fold); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return operand{value: t.text}, nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return operand{}, err
+		}
+		return operand{value: f}, nil
+	case tokIdent:
+		switch strings.ToUpper(t.text) {
+		case "TRUE", "YES":
+			return operand{value: true}, nil
+		case "FALSE", "NO":
+			return operand{value: false}, nil
+		case "NIL", "NULL":
+			return operand{value: nil}, nil
+		}
+		return operand{keyPath: t.text}, nil
+	case tokPunct:
+		if t.text == "{" {
+			list := []interface{}{}
+			for {
+				item, err := p.parseOperand()
+				if err != nil {
+					return operand{}, err
+				}
+				if item.keyPath != "" || item.list != nil {
+					return operand{}, fmt.Errorf("only literals are allowed in a list")
+				}
+				list = append(list, item.value)
+				if sep := p.next(); sep.text == "}" {
+					return operand{list: list}, nil
+				} else if sep.text != "," {
+					return operand{}, fmt.Errorf("expected , or } instead of %q", sep.text)
+				}
+			}
+		}
+	}
+	return operand{}, fmt.Errorf("unexpected %q", t.text)
+}
@@ -0,0 +1,125 @@
+package wda
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+)
+
+// testSource 是测试用的设置页面
+const testSource = `<?xml version="1.0" encoding="UTF-8"?>
+<AppiumAUT>
+<XCUIElementTypeApplication type="XCUIElementTypeApplication" name="Settings" label="Settings" enabled="true" visible="true" x="0" y="0" width="390" height="844">
+  <XCUIElementTypeTable type="XCUIElementTypeTable" enabled="true" visible="true" x="0" y="0" width="390" height="844">
+    <XCUIElementTypeCell type="XCUIElementTypeCell" name="Wi-Fi" label="Wi-Fi" value="Home" enabled="true" visible="true" x="0" y="100" width="390" height="44">
+      <XCUIElementTypeStaticText type="XCUIElementTypeStaticText" name="wifi-title" label="Wi-Fi" enabled="true" visible="true" x="16" y="100" width="60" height="44"/>
+      <XCUIElementTypeSwitch type="XCUIElementTypeSwitch" name="wifi-switch" value="1" enabled="true" visible="true" x="320" y="106" width="51" height="31"/>
+    </XCUIElementTypeCell>
+    <XCUIElementTypeCell type="XCUIElementTypeCell" name="Bluetooth" label="Bluetooth" value="On" enabled="true" visible="true" x="0" y="144" width="390" height="44">
+      <XCUIElementTypeStaticText type="XCUIElementTypeStaticText" name="bt-title" label="Bluetooth" enabled="true" visible="true" x="16" y="144" width="80" height="44"/>
+    </XCUIElementTypeCell>
+    <XCUIElementTypeCell type="XCUIElementTypeCell" name="Say &quot;hi&quot;" label="a&#96;b" enabled="false" visible="false" x="0" y="188" width="390" height="44"/>
+  </XCUIElementTypeTable>
+  <XCUIElementTypeButton type="XCUIElementTypeButton" name="Back" label="Back" enabled="true" visible="true" x="0" y="800" width="80" height="44"/>
+</XCUIElementTypeApplication>
+</AppiumAUT>`
+
+func testTree(t *testing.T) *poco.Node {
+	t.Helper()
+	root, err := ParseXMLSource([]byte(testSource))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// names returns the WDA names of the nodes, the type for unnamed ones.
+func names(nodes []*poco.Node) []string {
+	result := []string{}
+	for _, node := range nodes {
+		result = append(result, node.Name)
+	}
+	return result
+}
+
+func TestQueryPredicate(t *testing.T) {
+	root := testTree(t)
+	tests := []struct {
+		name string
+		expr string
+		want []string
+	}{
+		{"equal", `name == "Bluetooth"`, []string{"Bluetooth"}},
+		{"single equal sign", `name = 'Back'`, []string{"Back"}},
+		{"not equal", `type == 'XCUIElementTypeCell' AND name != "Wi-Fi"`, []string{"Bluetooth", `Say "hi"`}},
+		{"diamond", `type == 'XCUIElementTypeCell' AND name <> 'Wi-Fi' AND enabled == 1`, []string{"Bluetooth"}},
+		{"case sensitive", `name == "bluetooth"`, []string{}},
+		{"case insensitive", `name ==[c] "bluetooth"`, []string{"Bluetooth"}},
+		{"diacritic option", `label ==[cd] "back"`, []string{"Back"}},
+		{"contains", `label CONTAINS "tooth"`, []string{"Bluetooth", "bt-title"}},
+		{"contains case insensitive", `label CONTAINS[c] "WI"`, []string{"Wi-Fi", "wifi-title"}},
+		{"beginswith", `name BEGINSWITH "wifi"`, []string{"wifi-title", "wifi-switch"}},
+		{"endswith", `name ENDSWITH "-switch"`, []string{"wifi-switch"}},
+		{"like", `name LIKE "wi?i-*"`, []string{"wifi-title", "wifi-switch"}},
+		{"like matches whole string", `name LIKE "wifi"`, []string{}},
+		{"matches", `name MATCHES "^(Wi-Fi|Back)$"`, []string{"Wi-Fi", "Back"}},
+		{"matches case insensitive", `name MATCHES[c] "BACK"`, []string{"Back"}},
+		{"in list", `name IN {"Back", 'Bluetooth'}`, []string{"Bluetooth", "Back"}},
+		{"in list case insensitive", `name IN[c] {"back"}`, []string{"Back"}},
+		{"in string", `type == "XCUIElementTypeCell" AND name IN "Bluetooth settings"`, []string{"Bluetooth"}},
+		{"number", `rect.y >= 800`, []string{"Back"}},
+		{"number range", `rect.y > 100 AND rect.y <= 144`, []string{"wifi-switch", "Bluetooth", "bt-title"}},
+		{"string number", `value == 1`, []string{"wifi-switch"}},
+		{"boolean", `enabled == false`, []string{`Say "hi"`}},
+		{"wd prefix and alias", `wdVisible == NO AND elementType == "XCUIElementTypeCell"`, []string{`Say "hi"`}},
+		{"isEnabled", `isEnabled == 0`, []string{`Say "hi"`}},
+		{"escaped quote", `name == "Say \"hi\""`, []string{`Say "hi"`}},
+		{"single quoted escape", `name == 'Say "hi"'`, []string{`Say "hi"`}},
+		{"or and precedence", `name == "Back" OR name == "Wi-Fi" AND enabled == 0`, []string{"Back"}},
+		{"parentheses", `(name == "Back" OR name == "Wi-Fi") AND enabled == 1`, []string{"Wi-Fi", "Back"}},
+		{"not", `type == "XCUIElementTypeCell" AND NOT name BEGINSWITH "Wi"`, []string{"Bluetooth", `Say "hi"`}},
+		{"bang and ampersands", `!(enabled == 1) && type == "XCUIElementTypeCell"`, []string{`Say "hi"`}},
+		{"missing key", `placeholder == "x"`, []string{}},
+		{"nil", `type == "XCUIElementTypeButton" AND placeholder == nil`, []string{"Back"}},
+		{"truepredicate", `TRUEPREDICATE AND type == "XCUIElementTypeButton"`, []string{"Back"}},
+		{"falsepredicate", `FALSEPREDICATE`, []string{}},
+		{"lowercase keywords", `name beginswith "Blue" and enabled == true`, []string{"Bluetooth"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := QueryPredicate(root, tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(nodes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryPredicate(%s) = %q, want %q", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompilePredicateErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`name ==`,
+		`name "Back"`,
+		`name == "Back`,
+		`name ==[c "Back"`,
+		`(name == "Back"`,
+		`name == "Back")`,
+		`name == {"Back"}`,
+		`name IN {"Back", label}`,
+		`name IN {"Back" "Wi-Fi"}`,
+		`name MATCHES "("`,
+		`name == "Back" AND`,
+		`name # "Back"`,
+	}
+	for _, expr := range tests {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := CompilePredicate(expr); err == nil {
+				t.Errorf("CompilePredicate(%s) succeeded", expr)
+			}
+		})
+	}
+}
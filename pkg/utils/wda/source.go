@@ -0,0 +1,205 @@
+package wda
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/blacklee123/go-ios-android/pkg/utils/poco"
+)
+
+// WDA 元素的属性名，和 XML source 中的一致
+const (
+	AttrLabel      = "label"
+	AttrValue      = "value"
+	AttrEnabled    = "enabled"
+	AttrAccessible = "accessible"
+	AttrIdentifier = "rawIdentifier"
+)
+
+const typePrefix = "XCUIElementType"
+
+// jsonElement is an element of `GET /source?format=json`. Depending on the
+// WDA version the flags are "1"/"0" strings or booleans.
+type jsonElement struct {
+	Type          string        `json:"type"`
+	RawIdentifier *string       `json:"rawIdentifier"`
+	Name          *string       `json:"name"`
+	Label         *string       `json:"label"`
+	Value         interface{}   `json:"value"`
+	Rect          jsonRect      `json:"rect"`
+	IsEnabled     interface{}   `json:"isEnabled"`
+	IsVisible     interface{}   `json:"isVisible"`
+	IsAccessible  interface{}   `json:"isAccessible"`
+	Children      []jsonElement `json:"children"`
+}
+
+type jsonRect struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+type xmlElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr   `xml:",any,attr"`
+	Children []xmlElement `xml:",any"`
+}
+
+// element is the common form of JSON and XML elements before normalizing.
+type element struct {
+	typ      string
+	attrs    map[string]interface{}
+	rect     image.Rectangle
+	children []element
+}
+
+// ParseJSONSource converts the value of `GET /source?format=json`.
+func ParseJSONSource(data []byte) (*poco.Node, error) {
+	var root jsonElement
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid WDA source: %w", err)
+	}
+	return normalize(fromJSON(root)), nil
+}
+
+// ParseXMLSource converts the value of `GET /source?format=xml`.
+func ParseXMLSource(data []byte) (*poco.Node, error) {
+	var root xmlElement
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid WDA source: %w", err)
+	}
+	// WDA 把应用包在 <AppiumAUT> 中
+	for root.XMLName.Local == "AppiumAUT" && len(root.Children) == 1 {
+		root = root.Children[0]
+	}
+	return normalize(fromXML(root)), nil
+}
+
+func fromJSON(e jsonElement) element {
+	el := element{
+		typ: fullType(e.Type),
+		attrs: map[string]interface{}{
+			poco.AttrName:    deref(e.Name),
+			AttrLabel:        deref(e.Label),
+			AttrValue:        stringValue(e.Value),
+			AttrIdentifier:   deref(e.RawIdentifier),
+			AttrEnabled:      flag(e.IsEnabled, true),
+			poco.AttrVisible: flag(e.IsVisible, true),
+			AttrAccessible:   flag(e.IsAccessible, false),
+		},
+		rect: image.Rect(int(e.Rect.X), int(e.Rect.Y), int(e.Rect.X+e.Rect.Width), int(e.Rect.Y+e.Rect.Height)),
+	}
+	for _, child := range e.Children {
+		el.children = append(el.children, fromJSON(child))
+	}
+	return el
+}
+
+func fromXML(e xmlElement) element {
+	// 旧版本的 WDA 不输出 visible
+	el := element{typ: e.XMLName.Local, attrs: map[string]interface{}{poco.AttrVisible: true}}
+	var x, y, w, h int
+	for _, attr := range e.Attrs {
+		switch name := attr.Name.Local; name {
+		case "x":
+			x, _ = strconv.Atoi(attr.Value)
+		case "y":
+			y, _ = strconv.Atoi(attr.Value)
+		case "width":
+			w, _ = strconv.Atoi(attr.Value)
+		case "height":
+			h, _ = strconv.Atoi(attr.Value)
+		case poco.AttrType:
+			el.typ = attr.Value
+		case AttrEnabled, poco.AttrVisible, AttrAccessible, "focused", "selected":
+			el.attrs[name] = attr.Value == "true"
+		default:
+			el.attrs[name] = attr.Value
+		}
+	}
+	el.rect = image.Rect(x, y, x+w, y+h)
+	for _, child := range e.Children {
+		el.children = append(el.children, fromXML(child))
+	}
+	return el
+}
+
+// normalize converts the tree to Poco nodes, pos and size are normalized to
+// the rect of the application. Rects are in points, the coordinates WDA
+// takes for taps.
+func normalize(root element) *poco.Node {
+	screen := root.rect.Size()
+	global := 0
+	var convert func(e element, local int) *poco.Node
+	convert = func(e element, local int) *poco.Node {
+		// 没有 name 的元素以类型命名，payload 中保留 WDA 的原值
+		wdaName, _ := e.attrs[poco.AttrName].(string)
+		name := wdaName
+		if name == "" {
+			name = e.typ
+		}
+		node := poco.NewNode(name, e.typ, e.rect, screen)
+		for key, value := range e.attrs {
+			node.Payload[key] = value
+		}
+		node.Payload[poco.AttrName] = wdaName
+		node.Payload[poco.AttrType] = e.typ
+		if label, _ := e.attrs[AttrLabel].(string); label != "" {
+			node.Payload[poco.AttrText] = label
+		} else {
+			node.Payload[poco.AttrText], _ = e.attrs[AttrValue].(string)
+		}
+		node.Payload[poco.AttrZOrders] = map[string]int{"global": global, "local": local}
+		global++
+		for i, child := range e.children {
+			node.Children = append(node.Children, convert(child, i))
+		}
+		return node
+	}
+	return convert(root, 0)
+}
+
+// fullType returns the type with the XCUIElementType prefix that the JSON
+// source leaves out.
+func fullType(typ string) string {
+	if typ == "" || strings.HasPrefix(typ, typePrefix) {
+		return typ
+	}
+	return typePrefix + typ
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+func flag(value interface{}, def bool) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "1" || v == "true"
+	case float64:
+		return v != 0
+	}
+	return def
+}
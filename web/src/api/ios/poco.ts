@@ -21,6 +21,24 @@ export interface PocoNode {
   children: PocoNode[]
 }
 
-export function pocoDump(udid: string, port: number): Promise<PocoNode> {
-  return axiosInstance.get(`/ios/${udid}/poco/${port}/dump`)
+export function pocoDump(udid: string, port: number, platform: 'ios' | 'android' = 'ios'): Promise<PocoNode> {
+  return axiosInstance.get(`/${platform}/${udid}/poco/${port}/dump`)
+}
+
+export interface PocoElement {
+  node: PocoNode
+  pos?: [ x: number, y: number ]
+  center?: [ x: number, y: number ]
+  rect?: { x: number, y: number, width: number, height: number }
+}
+
+export interface PocoSelectResponse {
+  count: number
+  width: number
+  height: number
+  elements: PocoElement[]
+}
+
+export function pocoSelect(udid: string, port: number, selector: string, platform: 'ios' | 'android' = 'ios'): Promise<PocoSelectResponse> {
+  return axiosInstance.get(`/${platform}/${udid}/poco/${port}/select`, { params: { selector } })
 }